@@ -0,0 +1,30 @@
+package main
+
+import (
+	model "chat-app/internal/Models"
+	"chat-app/internal/database"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// runGrantAdmin implements `chat-app grant-admin <username>`, which is how
+// the first admin of a fresh deployment is created.
+func runGrantAdmin(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: grant-admin <username>")
+	}
+
+	db := database.New(slog.Default())
+	defer db.Close()
+
+	user, err := db.GetUserByUserName(args[0])
+	if err != nil {
+		return fmt.Errorf("cannot find user %q: %w", args[0], err)
+	}
+	if err := db.SetUserRole(user.Id, model.RoleAdmin); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "User %s (ID: %s) is now an admin\n", user.UserName, user.Id)
+	return nil
+}
@@ -3,30 +3,51 @@ package jwtauth
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
-var secretKey = []byte("Jay-Golang-Developer")
+// Token types stored in the "typ" claim so a refresh token cannot be used
+// as an access token and vice versa.
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+)
+
+// CreateToken issues an access and refresh token pair for user_id. The
+// roles are embedded in the access token only; they are looked up again
+// whenever the pair is refreshed.
+func CreateToken(user_id string, roles ...string) (map[string]string, error) {
+	keys, err := DefaultKeyring()
+	if err != nil {
+		return nil, err
+	}
 
-func CreateToken(user_id string) (map[string]string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	if roles == nil {
+		roles = []string{}
+	}
+	tokenString, err := keys.Sign(jwt.MapClaims{
 		"user_id": user_id,
+		"jti":     uuid.NewString(),
+		"typ":     accessTokenType,
+		"roles":   roles,
 		"exp":     time.Now().Add(time.Minute * 10).Unix(),
 	})
-
-	tokenString, err := token.SignedString(secretKey)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshToken := jwt.New(jwt.SigningMethodHS256)
-	rtClaims := refreshToken.Claims.(jwt.MapClaims)
+	rtClaims := jwt.MapClaims{}
 	rtClaims["user_id"] = user_id
+	rtClaims["jti"] = uuid.NewString()
+	rtClaims["typ"] = refreshTokenType
 	rtClaims["exp"] = time.Now().Add(time.Hour * 24).Unix()
 	//fmt.Printf("Type of exp is: %T", time.Now().Add(time.Hour*24).Unix())
-	refreshTokenString, err := refreshToken.SignedString(secretKey)
+	refreshTokenString, err := keys.Sign(rtClaims)
 	if err != nil {
 		return nil, err
 	}
@@ -40,64 +61,66 @@ func CreateToken(user_id string) (map[string]string, error) {
 	return response, nil
 }
 
-func RefreshAccessToken(refreshTokenString string) (map[string]string, error) {
-
-	refreshToken, err := jwt.Parse(refreshTokenString, func(t *jwt.Token) (interface{}, error) {
-		return secretKey, nil
-	})
+// ParseRefreshToken validates a refresh token and returns the principal it
+// was issued to.
+func ParseRefreshToken(refreshTokenString string) (Principal, error) {
+	rtClaims, err := parseClaims(refreshTokenString, refreshTokenType)
 	if err != nil {
-		return nil, err
-	}
-
-	if !refreshToken.Valid {
-		return nil, fmt.Errorf("refresh token is invalid")
+		return Principal{}, err
 	}
 
-	rtClaims, ok := refreshToken.Claims.(jwt.MapClaims)
-	if !ok || rtClaims["user_id"].(string) == "" {
-		return nil, fmt.Errorf("invalid claims in refresh token")
-	}
-
-	tokenPair, err := CreateToken(rtClaims["user_id"].(string))
+	principal, err := principalFromClaims(rtClaims)
 	if err != nil {
-		return nil, err
+		return Principal{}, fmt.Errorf("invalid claims in refresh token")
 	}
-
-	tokenPair["user_id"] = rtClaims["user_id"].(string)
-
-	return tokenPair, nil
+	return principal, nil
 }
 
-func VerifyToken(r *http.Request) error {
+// VerifyToken validates the bearer access token of r and returns its
+// principal. WebSocket handshakes may pass the token in the access_token
+// query parameter because browsers cannot set headers on them.
+func VerifyToken(r *http.Request) (Principal, error) {
 	tokenString := r.Header.Get("Authorization")
-	if tokenString == "" || len(tokenString) <= len("Bearer ") {
-		return fmt.Errorf("missing authorization token")
+	if tokenString == "" && websocket.IsWebSocketUpgrade(r) {
+		tokenString = "Bearer " + r.URL.Query().Get("access_token")
+	}
+	if tokenString == "" || len(tokenString) <= len("Bearer ") || !strings.HasPrefix(tokenString, "Bearer ") {
+		return Principal{}, fmt.Errorf("missing authorization token")
 	}
 
 	tokenString = tokenString[len("Bearer "):]
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		return secretKey, nil
-	})
+	return ParseAccessToken(tokenString)
+}
+
+// ParseAccessToken validates an access token and returns its principal.
+func ParseAccessToken(tokenString string) (Principal, error) {
+	claims, err := parseClaims(tokenString, accessTokenType)
 	if err != nil {
-		return err
+		return Principal{}, err
 	}
+	return principalFromClaims(claims)
+}
 
-	if !token.Valid {
-		return fmt.Errorf("invalid token")
+func parseClaims(tokenString string, tokenType string) (jwt.MapClaims, error) {
+	keys, err := DefaultKeyring()
+	if err != nil {
+		return nil, err
 	}
-	return nil
-}
 
-func VerifyToken_old(tokenString string) error {
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		return secretKey, nil
-	})
+	token, err := keys.Parse(tokenString)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !token.Valid {
-		return fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("invalid token claims")
+	}
+	if typ, _ := claims["typ"].(string); typ != tokenType {
+		return nil, fmt.Errorf("expected a %s token", tokenType)
 	}
-	return nil
+	return claims, nil
 }
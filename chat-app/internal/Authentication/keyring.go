@@ -0,0 +1,286 @@
+package jwtauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is one entry of a Keyring. Keys loaded from a public key only can
+// verify tokens but never sign them.
+type Key struct {
+	Id        string
+	Algorithm string
+
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+func (k *Key) canSign() bool {
+	return k.signKey != nil
+}
+
+// NewHMACKey returns an HS256 key. HMAC keys are never published in the JWKS.
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("key %s: HMAC secret must be at least 32 bytes", id)
+	}
+	return &Key{Id: id, Algorithm: jwt.SigningMethodHS256.Alg(), method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}, nil
+}
+
+// NewKeyFromPEM parses an RSA (RS256) or Ed25519 (EdDSA) private or public
+// key in PEM format.
+func NewKeyFromPEM(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s: no PEM block found", id)
+	}
+
+	if strings.Contains(block.Type, "PRIVATE KEY") {
+		if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+			return &Key{Id: id, Algorithm: jwt.SigningMethodRS256.Alg(), method: jwt.SigningMethodRS256, signKey: rsaKey, verifyKey: &rsaKey.PublicKey}, nil
+		}
+		if edKey, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+			private := edKey.(ed25519.PrivateKey)
+			return &Key{Id: id, Algorithm: jwt.SigningMethodEdDSA.Alg(), method: jwt.SigningMethodEdDSA, signKey: private, verifyKey: private.Public()}, nil
+		}
+		return nil, fmt.Errorf("key %s: unsupported private key, expected RSA or Ed25519", id)
+	}
+
+	if rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return &Key{Id: id, Algorithm: jwt.SigningMethodRS256.Alg(), method: jwt.SigningMethodRS256, verifyKey: rsaKey}, nil
+	}
+	if edKey, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return &Key{Id: id, Algorithm: jwt.SigningMethodEdDSA.Alg(), method: jwt.SigningMethodEdDSA, verifyKey: edKey}, nil
+	}
+	return nil, fmt.Errorf("key %s: unsupported public key, expected RSA or Ed25519", id)
+}
+
+// Keyring holds every key that may verify tokens. The newest key that has
+// private material signs new tokens, so a key is rotated by adding a newer
+// one and removed once the tokens it signed have expired.
+type Keyring struct {
+	keys   []*Key
+	byId   map[string]*Key
+	signer *Key
+}
+
+// NewKeyring builds a Keyring from keys ordered oldest to newest.
+func NewKeyring(keys ...*Key) (*Keyring, error) {
+	k := &Keyring{byId: make(map[string]*Key)}
+	for _, key := range keys {
+		if _, dup := k.byId[key.Id]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", key.Id)
+		}
+		k.keys = append(k.keys, key)
+		k.byId[key.Id] = key
+		if key.canSign() {
+			k.signer = key
+		}
+	}
+	if k.signer == nil {
+		return nil, fmt.Errorf("keyring has no key that can sign tokens")
+	}
+	return k, nil
+}
+
+// SigningKeyId returns the kid stamped on newly issued tokens.
+func (k *Keyring) SigningKeyId() string {
+	return k.signer.Id
+}
+
+// Sign issues a token signed with the newest key.
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signer.method, claims)
+	token.Header["kid"] = k.signer.Id
+	return token.SignedString(k.signer.signKey)
+}
+
+// Parse verifies a token with the key named by its kid header. The token's
+// alg must match the key so a public key can never be used as an HMAC
+// secret.
+func (k *Keyring) Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		key := k.signer
+		if kid, ok := t.Header["kid"].(string); ok {
+			if key, ok = k.byId[kid]; !ok {
+				return nil, fmt.Errorf("unknown signing key %q", kid)
+			}
+		}
+		if t.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return key.verifyKey, nil
+	})
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every asymmetric key. HMAC secrets are
+// left out because they cannot be shared.
+func (k *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.keys {
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.Id,
+				Alg: key.Algorithm,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Kid: key.Id,
+				Alg: key.Algorithm,
+				Use: "sig",
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+	return set
+}
+
+// LoadKeyringFromEnv builds the keyring from configuration:
+//
+//   - JWT_KEYS_DIR: every *.pem (RSA or Ed25519, private or public) and
+//     *.secret (HS256) file in the directory, ordered by file name. The
+//     file name without extension is the kid, so naming files by date
+//     (2024-01.pem, 2024-07.pem) makes the newest key sign.
+//   - JWT_SECRET: a single HS256 secret with kid "default", used when
+//     JWT_KEYS_DIR is not set.
+//
+// Without either, an ephemeral Ed25519 key is generated; tokens then stop
+// verifying when the process restarts.
+func LoadKeyringFromEnv() (*Keyring, error) {
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		return LoadKeyringFromDir(dir)
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		key, err := NewHMACKey("default", []byte(secret))
+		if err != nil {
+			return nil, err
+		}
+		return NewKeyring(key)
+	}
+
+	slog.Warn("JWT_KEYS_DIR and JWT_SECRET are not set, using an ephemeral signing key")
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(&Key{
+		Id:        "ephemeral",
+		Algorithm: jwt.SigningMethodEdDSA.Alg(),
+		method:    jwt.SigningMethodEdDSA,
+		signKey:   private,
+		verifyKey: private.Public().(ed25519.PublicKey),
+	})
+}
+
+// LoadKeyringFromDir loads the *.pem and *.secret files in dir.
+func LoadKeyringFromDir(dir string) (*Keyring, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (ext == ".pem" || ext == ".secret") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var keys []*Key
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		ext := filepath.Ext(name)
+		id := strings.TrimSuffix(name, ext)
+
+		var key *Key
+		if ext == ".secret" {
+			key, err = NewHMACKey(id, []byte(strings.TrimSpace(string(data))))
+		} else {
+			key, err = NewKeyFromPEM(id, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no *.pem or *.secret keys found in %s", dir)
+	}
+	return NewKeyring(keys...)
+}
+
+var (
+	keyringMu sync.RWMutex
+	keyring   *Keyring
+)
+
+// SetKeyring replaces the keyring used by the package-level token functions.
+func SetKeyring(k *Keyring) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	keyring = k
+}
+
+// DefaultKeyring returns the keyring set with SetKeyring, loading it from
+// the environment on first use.
+func DefaultKeyring() (*Keyring, error) {
+	keyringMu.RLock()
+	k := keyring
+	keyringMu.RUnlock()
+	if k != nil {
+		return k, nil
+	}
+
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	if keyring == nil {
+		loaded, err := LoadKeyringFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		keyring = loaded
+	}
+	return keyring, nil
+}
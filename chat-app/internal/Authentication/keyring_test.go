@@ -0,0 +1,167 @@
+package jwtauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func rsaPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() returned error: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func ed25519PEM(t *testing.T) []byte {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() returned error: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() returned error: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func mustKey(t *testing.T, id string, data []byte) *Key {
+	t.Helper()
+	key, err := NewKeyFromPEM(id, data)
+	if err != nil {
+		t.Fatalf("NewKeyFromPEM(%s) returned error: %v", id, err)
+	}
+	return key
+}
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{"user_id": "1", "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := mustKey(t, "2024-01", rsaPEM(t))
+	newKey := mustKey(t, "2024-07", ed25519PEM(t))
+
+	oldRing, err := NewKeyring(oldKey)
+	if err != nil {
+		t.Fatalf("NewKeyring() returned error: %v", err)
+	}
+	oldToken, err := oldRing.Sign(claims())
+	if err != nil {
+		t.Fatalf("Sign() returned error: %v", err)
+	}
+
+	rotated, err := NewKeyring(oldKey, newKey)
+	if err != nil {
+		t.Fatalf("NewKeyring() returned error: %v", err)
+	}
+	if rotated.SigningKeyId() != "2024-07" {
+		t.Fatalf("expected the newest key to sign, got %s", rotated.SigningKeyId())
+	}
+
+	newToken, err := rotated.Sign(claims())
+	if err != nil {
+		t.Fatalf("Sign() returned error: %v", err)
+	}
+	parsed, err := rotated.Parse(newToken)
+	if err != nil {
+		t.Fatalf("Parse() of a new token returned error: %v", err)
+	}
+	if parsed.Header["kid"] != "2024-07" || parsed.Method.Alg() != "EdDSA" {
+		t.Fatalf("unexpected header %v", parsed.Header)
+	}
+
+	if _, err := rotated.Parse(oldToken); err != nil {
+		t.Fatalf("expected a token signed by a rotated-out key to verify, got %v", err)
+	}
+
+	retired, err := NewKeyring(newKey)
+	if err != nil {
+		t.Fatalf("NewKeyring() returned error: %v", err)
+	}
+	if _, err := retired.Parse(oldToken); err == nil {
+		t.Fatalf("expected a token signed by a removed key to be rejected")
+	}
+}
+
+func TestRejectsAlgorithmConfusion(t *testing.T) {
+	rsaKey := mustKey(t, "rsa", rsaPEM(t))
+	keys, err := NewKeyring(rsaKey)
+	if err != nil {
+		t.Fatalf("NewKeyring() returned error: %v", err)
+	}
+
+	// An attacker signs with HS256 using the public key bytes as the secret.
+	public, err := x509.MarshalPKIXPublicKey(rsaKey.verifyKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() returned error: %v", err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	forged.Header["kid"] = "rsa"
+	forgedString, err := forged.SignedString(public)
+	if err != nil {
+		t.Fatalf("SignedString() returned error: %v", err)
+	}
+
+	if _, err := keys.Parse(forgedString); err == nil {
+		t.Fatalf("expected an HS256 token for an RSA key to be rejected")
+	}
+}
+
+func TestJWKSOmitsSecrets(t *testing.T) {
+	hmacKey, err := NewHMACKey("hmac", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("NewHMACKey() returned error: %v", err)
+	}
+	keys, err := NewKeyring(hmacKey, mustKey(t, "rsa", rsaPEM(t)), mustKey(t, "ed", ed25519PEM(t)))
+	if err != nil {
+		t.Fatalf("NewKeyring() returned error: %v", err)
+	}
+
+	set := keys.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("expected 2 public keys, got %d", len(set.Keys))
+	}
+	if set.Keys[0].Kty != "RSA" || set.Keys[0].N == "" || set.Keys[0].E != "AQAB" {
+		t.Fatalf("unexpected RSA JWK %+v", set.Keys[0])
+	}
+	if set.Keys[1].Kty != "OKP" || set.Keys[1].Crv != "Ed25519" || set.Keys[1].X == "" {
+		t.Fatalf("unexpected Ed25519 JWK %+v", set.Keys[1])
+	}
+}
+
+func TestLoadKeyringFromDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"2024-01.secret": []byte("0123456789abcdef0123456789abcdef\n"),
+		"2024-07.pem":    rsaPEM(t),
+		"README.txt":     []byte("ignored"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatalf("WriteFile() returned error: %v", err)
+		}
+	}
+
+	keys, err := LoadKeyringFromDir(dir)
+	if err != nil {
+		t.Fatalf("LoadKeyringFromDir() returned error: %v", err)
+	}
+	if keys.SigningKeyId() != "2024-07" {
+		t.Fatalf("expected 2024-07 to sign, got %s", keys.SigningKeyId())
+	}
+	if len(keys.keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys.keys))
+	}
+}
@@ -0,0 +1,232 @@
+// Package password hashes and verifies user passwords.
+//
+// Hashes are stored with a format prefix so the algorithm and parameters can
+// change over time: argon2id hashes use the PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash) and bcrypt hashes keep their
+// native $2a$/$2b$ prefix. Anything without a known prefix is treated as a
+// legacy plaintext value. Verify reports when a stored hash should be
+// replaced so callers can upgrade it after a successful login.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+var ErrMismatch = errors.New("password does not match")
+
+// Params configures how new hashes are produced.
+type Params struct {
+	// Algorithm is Argon2id or Bcrypt.
+	Algorithm string
+
+	Argon2Time    uint32
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+	Argon2KeyLen  uint32
+	SaltLen       uint32
+
+	BcryptCost int
+}
+
+// DefaultParams follows the OWASP recommendation for argon2id.
+func DefaultParams() Params {
+	return Params{
+		Algorithm:     Argon2id,
+		Argon2Time:    2,
+		Argon2Memory:  19 * 1024,
+		Argon2Threads: 1,
+		Argon2KeyLen:  32,
+		SaltLen:       16,
+		BcryptCost:    bcrypt.DefaultCost,
+	}
+}
+
+// ParamsFromEnv starts from DefaultParams and applies PASSWORD_HASH_ALGORITHM,
+// PASSWORD_ARGON2_TIME, PASSWORD_ARGON2_MEMORY, PASSWORD_ARGON2_THREADS and
+// PASSWORD_BCRYPT_COST when they are set.
+func ParamsFromEnv() (Params, error) {
+	params := DefaultParams()
+	if algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm != "" {
+		params.Algorithm = algorithm
+	}
+
+	uintVars := map[string]*uint32{
+		"PASSWORD_ARGON2_TIME":   &params.Argon2Time,
+		"PASSWORD_ARGON2_MEMORY": &params.Argon2Memory,
+	}
+	for name, target := range uintVars {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return params, fmt.Errorf("%s: %w", name, err)
+			}
+			*target = uint32(parsed)
+		}
+	}
+	if value := os.Getenv("PASSWORD_ARGON2_THREADS"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return params, fmt.Errorf("PASSWORD_ARGON2_THREADS: %w", err)
+		}
+		params.Argon2Threads = uint8(parsed)
+	}
+	if value := os.Getenv("PASSWORD_BCRYPT_COST"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return params, fmt.Errorf("PASSWORD_BCRYPT_COST: %w", err)
+		}
+		params.BcryptCost = parsed
+	}
+
+	return params, params.validate()
+}
+
+func (p Params) validate() error {
+	switch p.Algorithm {
+	case Argon2id:
+		if p.Argon2Time == 0 || p.Argon2Memory == 0 || p.Argon2Threads == 0 || p.Argon2KeyLen == 0 || p.SaltLen == 0 {
+			return fmt.Errorf("argon2id parameters must be greater than zero")
+		}
+	case Bcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hash algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// Hasher hashes new passwords with one set of Params and verifies hashes
+// produced by any supported algorithm.
+type Hasher struct {
+	params Params
+}
+
+func NewHasher(params Params) (*Hasher, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &Hasher{params: params}, nil
+}
+
+// Hash returns the encoded hash of password.
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.params.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.params.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, h.params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.params.Argon2Time, h.params.Argon2Memory, h.params.Argon2Threads, h.params.Argon2KeyLen)
+	return encodeArgon2(argon2Hash{
+		memory:  h.params.Argon2Memory,
+		time:    h.params.Argon2Time,
+		threads: h.params.Argon2Threads,
+		salt:    salt,
+		key:     key,
+	}), nil
+}
+
+// Verify checks password against an encoded hash. It returns ErrMismatch if
+// the password is wrong. On success, needsRehash is true when the stored
+// hash uses a different algorithm or weaker parameters than the Hasher, or
+// is a legacy plaintext value.
+func (h *Hasher) Verify(password, encoded string) (needsRehash bool, err error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		stored, err := decodeArgon2(encoded)
+		if err != nil {
+			return false, err
+		}
+		key := argon2.IDKey([]byte(password), stored.salt, stored.time, stored.memory, stored.threads, uint32(len(stored.key)))
+		if subtle.ConstantTimeCompare(key, stored.key) != 1 {
+			return false, ErrMismatch
+		}
+		return h.params.Algorithm != Argon2id ||
+			stored.time != h.params.Argon2Time ||
+			stored.memory != h.params.Argon2Memory ||
+			stored.threads != h.params.Argon2Threads ||
+			uint32(len(stored.key)) != h.params.Argon2KeyLen, nil
+
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		if err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, ErrMismatch
+			}
+			return false, err
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		if err != nil {
+			return false, err
+		}
+		return h.params.Algorithm != Bcrypt || cost != h.params.BcryptCost, nil
+
+	default:
+		// Rows written before passwords were hashed hold the plaintext.
+		if subtle.ConstantTimeCompare([]byte(password), []byte(encoded)) != 1 {
+			return false, ErrMismatch
+		}
+		return true, nil
+	}
+}
+
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func encodeArgon2(h argon2Hash) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(h.salt), base64.RawStdEncoding.EncodeToString(h.key))
+}
+
+func decodeArgon2(encoded string) (argon2Hash, error) {
+	var h argon2Hash
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return h, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return h, fmt.Errorf("malformed argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return h, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return h, fmt.Errorf("malformed argon2id key: %w", err)
+	}
+	return h, nil
+}
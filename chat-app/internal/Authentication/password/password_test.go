@@ -0,0 +1,104 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func mustHasher(t *testing.T, params Params) *Hasher {
+	t.Helper()
+	hasher, err := NewHasher(params)
+	if err != nil {
+		t.Fatalf("NewHasher() returned error: %v", err)
+	}
+	return hasher
+}
+
+func TestArgon2id(t *testing.T) {
+	hasher := mustHasher(t, DefaultParams())
+
+	hash, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash() returned error: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$") {
+		t.Fatalf("expected an argon2id PHC string, got %q", hash)
+	}
+
+	needsRehash, err := hasher.Verify("correct horse", hash)
+	if err != nil || needsRehash {
+		t.Fatalf("Verify() = %v, %v; want false, nil", needsRehash, err)
+	}
+	if _, err := hasher.Verify("wrong horse", hash); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch, got %v", err)
+	}
+}
+
+func TestBcrypt(t *testing.T) {
+	params := DefaultParams()
+	params.Algorithm = Bcrypt
+	params.BcryptCost = bcrypt.MinCost
+	hasher := mustHasher(t, params)
+
+	hash, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash() returned error: %v", err)
+	}
+	needsRehash, err := hasher.Verify("correct horse", hash)
+	if err != nil || needsRehash {
+		t.Fatalf("Verify() = %v, %v; want false, nil", needsRehash, err)
+	}
+	if _, err := hasher.Verify("wrong horse", hash); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch, got %v", err)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcryptParams := DefaultParams()
+	bcryptParams.Algorithm = Bcrypt
+	bcryptParams.BcryptCost = bcrypt.MinCost
+	bcryptHash, err := mustHasher(t, bcryptParams).Hash("secret")
+	if err != nil {
+		t.Fatalf("Hash() returned error: %v", err)
+	}
+
+	weakParams := DefaultParams()
+	weakParams.Argon2Time = 1
+	weakHash, err := mustHasher(t, weakParams).Hash("secret")
+	if err != nil {
+		t.Fatalf("Hash() returned error: %v", err)
+	}
+
+	hasher := mustHasher(t, DefaultParams())
+	tests := map[string]string{
+		"plaintext":     "secret",
+		"bcrypt":        bcryptHash,
+		"weaker argon2": weakHash,
+	}
+	for name, stored := range tests {
+		t.Run(name, func(t *testing.T) {
+			needsRehash, err := hasher.Verify("secret", stored)
+			if err != nil {
+				t.Fatalf("Verify() returned error: %v", err)
+			}
+			if !needsRehash {
+				t.Fatalf("expected %s hash to need a rehash", name)
+			}
+		})
+	}
+
+	if _, err := hasher.Verify("other", "secret"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch for a wrong plaintext password, got %v", err)
+	}
+}
+
+func TestInvalidParams(t *testing.T) {
+	params := DefaultParams()
+	params.Algorithm = "md5"
+	if _, err := NewHasher(params); err == nil {
+		t.Fatalf("expected an unknown algorithm to be rejected")
+	}
+}
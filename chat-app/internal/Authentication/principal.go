@@ -0,0 +1,57 @@
+package jwtauth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Principal is the authenticated caller of a request, taken from a verified
+// access token.
+type Principal struct {
+	UserId  string
+	Roles   []string
+	TokenId string
+}
+
+// HasRole reports whether the principal was granted role.
+func (p Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx that carries p.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal stored by WithPrincipal.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// principalFromClaims extracts the principal from verified token claims.
+func principalFromClaims(claims jwt.MapClaims) (Principal, error) {
+	userId, ok := claims["user_id"].(string)
+	if !ok || userId == "" {
+		return Principal{}, fmt.Errorf("token has no user_id claim")
+	}
+	p := Principal{UserId: userId}
+	p.TokenId, _ = claims["jti"].(string)
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if name, ok := role.(string); ok {
+				p.Roles = append(p.Roles, name)
+			}
+		}
+	}
+	return p, nil
+}
@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 type UserAuth struct {
 	UserName string
 	Password string
@@ -11,16 +13,75 @@ type User struct {
 	UserName   string `json:"username"`
 	Password   string `json:"password_hash"`
 	Email      string `json:"email"`
+	Status     string `json:"status"`
+	Role       string `json:"role"`
 	Created_at string `json:"created_at"`
 	Upated_at  string `json:"updated_at"`
+	// Last_seen_at is when the user last connected or disconnected a
+	// WebSocket. It is empty for users who never connected.
+	Last_seen_at string `json:"last_seen_at"`
+}
+
+// User.Status values. Self-registered users stay pending until they verify
+// their email address.
+const (
+	UserStatusPending = "pending"
+	UserStatusActive  = "active"
+)
+
+// Global roles stored in User.Role.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Roles a user can hold within one chat room, from most to least
+// privileged. Every room has exactly one owner, its creator.
+const (
+	RoomRoleOwner     = "owner"
+	RoomRoleModerator = "moderator"
+	RoomRoleMember    = "member"
+)
+
+// Registration is the body of the public POST /register endpoint.
+type Registration struct {
+	UserName string `json:"username"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
 }
 
 type ChatRoom struct {
 	ChatRoomId  string
 	Name        string
 	Description string
-	Created_at  string
-	Upated_at   string
+	OwnerId     string
+	// IsPrivate rooms can only be joined by invitation and are hidden from
+	// users who are not members.
+	IsPrivate  bool
+	Created_at string
+	Upated_at  string
+}
+
+// RoomMember is one user's membership of a chat room.
+type RoomMember struct {
+	ChatRoomId string `json:"chatroom_id"`
+	UserId     string `json:"user_id"`
+	UserName   string `json:"username"`
+	Role       string `json:"role"`
+	Joined_at  string `json:"joined_at"`
+}
+
+// MessagePage selects a window of a conversation by message id, keeping
+// only messages older than Before and newer than After when those are set.
+// When only After is set the window holds the Limit oldest matching
+// messages, otherwise the Limit newest. A Limit of 0 or less keeps all of
+// them. Messages are returned oldest first unless NewestFirst is set.
+type MessagePage struct {
+	Before      string
+	After       string
+	Limit       int
+	NewestFirst bool
 }
 
 type Message struct {
@@ -28,6 +89,83 @@ type Message struct {
 	ChatRoomId  string
 	Sender_Id   string
 	Receiver_Id string
-	Content     string
-	Created_at  string
+	// ParentMessageId makes a room message a reply in the thread of another
+	// message of the same room. Threads are one level deep.
+	ParentMessageId string
+	Content         string
+	Created_at      string
+	// Edited_at is set once the content has been changed.
+	Edited_at string
+	// Deleted_at marks a tombstone: the message was deleted and its content
+	// removed. Earlier contents stay in its revision history.
+	Deleted_at string
+	// ReplyCount and Last_reply_at summarize the thread of a message.
+	ReplyCount    int
+	Last_reply_at string
+	// Reactions are filled in for the user reading the message history.
+	Reactions []Reaction
+}
+
+// Reaction counts the users who reacted to a message with one emoji.
+type Reaction struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
+}
+
+// MessageRevision is the content a message had before one edit or its
+// deletion, and who made that change.
+type MessageRevision struct {
+	MessageId  string `json:"message_id"`
+	Content    string `json:"content"`
+	EditedBy   string `json:"edited_by"`
+	Created_at string `json:"created_at"`
+}
+
+// MessageSearch is a full-text query over the messages UserId can read: the
+// rooms they are a member of, or every room when AllRooms is set, and their
+// direct conversations. A message matches when its content contains every
+// word of Query. The other fields narrow the search when set; From is
+// inclusive and To exclusive.
+type MessageSearch struct {
+	Query      string
+	UserId     string
+	AllRooms   bool
+	SenderId   string
+	ChatRoomId string
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
+
+// MessageSearchResult is a message matching a MessageSearch. Snippet is an
+// HTML-escaped excerpt of its content with the matched words wrapped in
+// <mark> tags.
+type MessageSearchResult struct {
+	Message Message `json:"message"`
+	Snippet string  `json:"snippet"`
+}
+
+// UnreadCount is the number of messages a user has not read in one
+// conversation: a chat room when ChatRoomId is set, otherwise the direct
+// conversation with UserId.
+type UnreadCount struct {
+	ChatRoomId string `json:"chatroom_id,omitempty"`
+	UserId     string `json:"user_id,omitempty"`
+	Unread     int    `json:"unread"`
+}
+
+// Presence statuses of a user. A user is online while any of their sockets
+// is active, away while all of them are idle, and offline without sockets.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Presence is the current status of a user and when they were last seen.
+type Presence struct {
+	UserId       string `json:"user_id"`
+	Status       string `json:"status"`
+	Last_seen_at string `json:"last_seen_at,omitempty"`
 }
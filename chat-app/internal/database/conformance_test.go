@@ -0,0 +1,23 @@
+package database_test
+
+import (
+	"chat-app/internal/database"
+	"chat-app/internal/database/databasetest"
+	"chat-app/internal/logging"
+	"testing"
+)
+
+func TestMySQLConformance(t *testing.T) {
+	database.RequireMySQL(t)
+	t.Setenv("DB_AUTO_MIGRATE", "true")
+
+	srv, err := database.Open("mysql", logging.Discard())
+	if err != nil {
+		t.Fatalf("Open(mysql) returned error: %v", err)
+	}
+	defer srv.Close()
+
+	databasetest.Run(t, func(t *testing.T) database.Service {
+		return srv
+	})
+}
@@ -4,10 +4,12 @@ import (
 	model "chat-app/internal/Models"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -16,6 +18,10 @@ import (
 
 // Service represents a service that interacts with a database.
 type Service interface {
+	// WithContext returns a Service whose calls belong to ctx: they are
+	// canceled with it and traced as part of its span.
+	WithContext(ctx context.Context) Service
+
 	// Health returns a map of health status information.
 	// The keys and values in the map are service-specific.
 	Health() map[string]string
@@ -28,11 +34,15 @@ type Service interface {
 
 	DeleteRefreshToken() (string, error)
 
+	// CreateUser inserts a user. It returns ErrUsernameTaken if the
+	// username belongs to another account.
 	CreateUser(user model.User) (string, error)
 
 	GetAllUsers() ([]model.User, error)
 
-	GetAUser(userName string, pass string) (model.User, error)
+	// GetUserByUserName returns the user including its password hash so the
+	// caller can verify credentials.
+	GetUserByUserName(userName string) (model.User, error)
 
 	UpdateUserPassword(Id string, password string) error
 
@@ -42,6 +52,14 @@ type Service interface {
 
 	GetAUserv2(Id string) (model.User, error)
 
+	// CreateVerificationToken stores the hash of a single-use email
+	// verification token for a pending user.
+	CreateVerificationToken(user_id string, tokenHash string, expiresAt time.Time) error
+
+	// ConsumeVerificationToken deletes an unexpired verification token,
+	// activates its user and returns the user's id.
+	ConsumeVerificationToken(tokenHash string) (string, error)
+
 	CreateChatRoom(chatRoom model.ChatRoom) (string, error)
 
 	DeleteChatRoom(Id string) error
@@ -50,19 +68,119 @@ type Service interface {
 
 	GetChatRoom(Id string) (model.ChatRoom, error)
 
-	CreateMessage(message model.Message) (string, error)
+	// SetUserRole changes the global role (model.RoleUser or model.RoleAdmin)
+	// of a user.
+	SetUserRole(Id string, role string) error
+
+	// GetRoomRole returns the role user_id holds in a chat room, or an empty
+	// string if the user is not a member.
+	GetRoomRole(chatRoomId string, user_id string) (string, error)
+
+	// SetRoomMemberRole changes the role of an existing member of a room.
+	SetRoomMemberRole(chatRoomId string, user_id string, role string) error
+
+	// AddRoomMember adds user_id to the chat room with the given room role.
+	// It fails if the user is already a member.
+	AddRoomMember(chatRoomId string, user_id string, role string) error
+
+	// RemoveRoomMember removes user_id from the chat room.
+	RemoveRoomMember(chatRoomId string, user_id string) error
+
+	// GetRoomMembers lists the members of a chat room in the order they joined.
+	GetRoomMembers(chatRoomId string) ([]model.RoomMember, error)
+
+	// CreateMessage stores a room or direct message, or a reply in a room
+	// thread, and returns it with its id and timestamp.
+	CreateMessage(message model.Message) (model.Message, error)
+
+	// GetMessagesForChatRoom returns one page of a room's messages, oldest
+	// first. Replies are left out; they are listed by GetThread.
+	GetMessagesForChatRoom(chatRoomId string, page model.MessagePage) ([]model.Message, error)
+
+	// GetThread returns one page of the replies to a message, oldest first.
+	GetThread(parentId string, page model.MessagePage) ([]model.Message, error)
+
+	// GetMessagesforIndividualChat returns one page of the direct messages
+	// between sender_id and receiver_id, oldest first.
+	GetMessagesforIndividualChat(senderReceiver map[string]string, page model.MessagePage) ([]model.Message, error)
+
+	// GetMessage returns a single message, or a tombstone if it was deleted.
+	GetMessage(Id string) (model.Message, error)
+
+	// UpdateMessage replaces the content of a message, keeping the previous
+	// content as a revision made by editorId. It returns ErrMessageDeleted
+	// for tombstones.
+	UpdateMessage(Id string, content string, editorId string) (model.Message, error)
+
+	// DeleteMessage turns a message into a tombstone without content. The
+	// content is kept as a revision made by editorId. It returns
+	// ErrMessageDeleted if the message was already deleted.
+	DeleteMessage(Id string, editorId string) (model.Message, error)
+
+	// GetMessageRevisions lists the earlier contents of a message, oldest
+	// first.
+	GetMessageRevisions(Id string) ([]model.MessageRevision, error)
+
+	// AddReaction records that user_id reacted to a message with emoji. It
+	// returns ErrReactionExists if they already did.
+	AddReaction(messageId string, user_id string, emoji string) error
+
+	// RemoveReaction takes back a reaction of user_id.
+	RemoveReaction(messageId string, user_id string, emoji string) error
 
-	GetMessagesForChatRoom(chatRoomId string) ([]model.Message, error)
+	// GetReactions counts the reactions to each of the given messages, in
+	// the order each emoji was first used, and marks those of user_id.
+	GetReactions(messageIds []string, user_id string) (map[string][]model.Reaction, error)
 
-	GetMessagesforIndividualChat(senderReceiver map[string]string) ([]model.Message, error)
+	// UpdateLastSeen sets the last seen time of a user to now.
+	UpdateLastSeen(Id string) error
+
+	// GetLastSeen returns the last seen time of each of the given users who
+	// exists. Users who never connected map to an empty string.
+	GetLastSeen(Ids []string) (map[string]string, error)
+
+	// GetContacts returns the ids of the users who share a chat room or a
+	// direct conversation with user_id.
+	GetContacts(user_id string) ([]string, error)
+
+	// MarkRoomRead records that user_id has read a chat room up to and
+	// including messageId. Read markers only move forward.
+	MarkRoomRead(chatRoomId string, user_id string, messageId string) error
+
+	// MarkDirectRead records that user_id has read their direct
+	// conversation with peerId up to and including messageId.
+	MarkDirectRead(user_id string, peerId string, messageId string) error
+
+	// GetUnreadCounts counts the messages of others that user_id has not
+	// read, for each of their rooms and then each direct conversation. Thread
+	// replies and deleted messages are not counted, nor are conversations
+	// without unread messages.
+	GetUnreadCounts(user_id string) ([]model.UnreadCount, error)
+
+	// SearchMessages returns the messages matching search, newest first. It
+	// returns ErrNoSearchTerms if the query has no words.
+	SearchMessages(search model.MessageSearch) ([]model.MessageSearchResult, error)
 
 	// Close terminates the database connection.
 	// It returns an error if the connection cannot be closed.
 	Close() error
 }
 
+// Pool is implemented by the services backed by a connection pool, whose
+// statistics are exported as metrics.
+type Pool interface {
+	Stats() sql.DBStats
+}
+
 type service struct {
 	db *sql.DB
+	// name identifies the database in log output.
+	name string
+	// fullText implements message search for the SQL dialect.
+	fullText fullText
+	logger   *slog.Logger
+	// ctx is the context of the calls, set with WithContext.
+	ctx context.Context
 }
 
 var (
@@ -71,42 +189,74 @@ var (
 	username   = os.Getenv("DB_USERNAME")
 	port       = os.Getenv("DB_PORT")
 	host       = os.Getenv("DB_HOST")
-	dbInstance *service
+	dbInstance Service
 )
 
-func PrintEnv() {
-	fmt.Println("port>>>", port)
-	fmt.Println("host: ", host)
-	fmt.Println("dbname<<<<", dbname)
+func init() {
+	Register("mysql", openMySQL)
+}
+
+func mysqlDSN() string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", username, password, host, port, dbname)
 }
 
-func New() Service {
+// New returns the shared Service for the driver selected by DB_DRIVER
+// (mysql, sqlite or memory), logging to logger. It terminates the program if
+// the driver cannot be opened.
+func New(logger *slog.Logger) Service {
 	// Reuse Connection
 	if dbInstance != nil {
 		return dbInstance
 	}
 
+	srv, err := Open(DriverName(), logger)
+	if err != nil {
+		logger.Error("Cannot open the database", "driver", DriverName(), "error", err)
+		os.Exit(1)
+	}
+	dbInstance = srv
+	return dbInstance
+}
+
+func openMySQL(logger *slog.Logger) (Service, error) {
 	// Opening a driver typically will not attempt to connect to the database.
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", username, password, host, port, dbname))
+	db, err := sql.Open("mysql", mysqlDSN())
 	if err != nil {
 		// This will not be a connection error, but a DSN parse error or
 		// another initialization error.
-		log.Fatal(err)
+		return nil, err
 	}
 	db.SetConnMaxLifetime(0)
 	db.SetMaxIdleConns(50)
 	db.SetMaxOpenConns(50)
 
-	dbInstance = &service{
-		db: db,
+	if err := autoMigrate(db, "mysql", logger); err != nil {
+		return nil, err
 	}
-	return dbInstance
+	return &service{db: db, name: dbname, fullText: mysqlFullText, logger: logger}, nil
+}
+
+// autoMigrate brings the schema up to date when DB_AUTO_MIGRATE=true.
+func autoMigrate(db *sql.DB, dialect string, logger *slog.Logger) error {
+	if enabled, _ := strconv.ParseBool(os.Getenv("DB_AUTO_MIGRATE")); !enabled {
+		return nil
+	}
+	migrator, err := NewMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up()
+	if err != nil {
+		return err
+	}
+	logger.Info("Applied migrations", "dialect", dialect, "count", applied)
+	return nil
 }
 
 // Health checks the health of the database connection by pinging the database.
 // It returns a map with keys indicating various health statistics.
 func (s *service) Health() map[string]string {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	ctx, cancel := context.WithTimeout(s.context(), 1*time.Second)
 	defer cancel()
 
 	stats := make(map[string]string)
@@ -116,7 +266,7 @@ func (s *service) Health() map[string]string {
 	if err != nil {
 		stats["status"] = "down"
 		stats["error"] = fmt.Sprintf("db down: %v", err)
-		log.Fatalf(fmt.Sprintf("db down: %v", err)) // Log the error and terminate the program
+		s.logger.Error("Database is down", "database", s.name, "error", err)
 		return stats
 	}
 
@@ -154,19 +304,19 @@ func (s *service) Health() map[string]string {
 }
 
 func (s *service) CreateRefreshToken(user_id string, refreshTokenString string) error {
-	result, err := s.db.Exec("INSERT INTO refresh_tokens (user_id, token, expires_at) VALUES(?, ?, ?)", &user_id, &refreshTokenString,
+	result, err := s.exec("INSERT INTO refresh_tokens (user_id, token, expires_at) VALUES(?, ?, ?)", &user_id, &refreshTokenString,
 		time.Now().Add(time.Hour*24))
 	if err != nil {
 		return err
 	}
 	refreshToken_id, _ := result.LastInsertId()
-	fmt.Println("Refresh-token is inserted in the system with Id:", refreshToken_id)
+	s.logger.Debug("Inserted refresh token", "user_id", user_id, "refresh_token_id", refreshToken_id)
 	return nil
 }
 
 func (s *service) GetRefreshToken(refreshTokenString string) (bool, error) {
 	var isValid bool
-	err := s.db.QueryRow("SELECT is_valid FROM refresh_tokens WHERE token = ? AND expires_at > ?", &refreshTokenString,
+	err := s.queryRow("SELECT is_valid FROM refresh_tokens WHERE token = ? AND expires_at > ?", &refreshTokenString,
 		time.Now()).Scan(&isValid)
 	if err != nil {
 		return false, err
@@ -178,7 +328,7 @@ func (s *service) GetRefreshToken(refreshTokenString string) (bool, error) {
 }
 
 func (s *service) UpdateRefreshToken(refreshTokenString string, user_id string) error {
-	_, err := s.db.Exec("Update refresh_tokens SET is_valid = ? WHERE token = ? AND user_id = ?", false, &refreshTokenString, &user_id)
+	_, err := s.exec("Update refresh_tokens SET is_valid = ? WHERE token = ? AND user_id = ?", false, &refreshTokenString, &user_id)
 	if err != nil {
 		return err
 	}
@@ -187,22 +337,37 @@ func (s *service) UpdateRefreshToken(refreshTokenString string, user_id string)
 }
 
 func (s *service) DeleteRefreshToken() (string, error) {
-	result, err := s.db.Exec("DELETE FROM refresh_tokens WHERE is_valid = false OR expires_at < ?", time.Now())
+	result, err := s.exec("DELETE FROM refresh_tokens WHERE is_valid = false OR expires_at < ?", time.Now())
 	if err != nil {
 		return "", err
 	}
 
 	totalDeletedRows, _ := result.RowsAffected()
-	fmt.Println("Total Deleted refresh tokens:", totalDeletedRows)
+	s.logger.Info("Deleted invalid refresh tokens", "count", totalDeletedRows)
 
 	return fmt.Sprint("Invalid Refresh Tokens Deleted: ", totalDeletedRows), nil
 }
 
+// ErrUsernameTaken is returned by CreateUser when another account already has
+// the username.
+var ErrUsernameTaken = errors.New("username is already taken")
+
 func (s *service) CreateUser(user model.User) (string, error) {
+	if user.Status == "" {
+		user.Status = model.UserStatusActive
+	}
+	if user.Role == "" {
+		user.Role = model.RoleUser
+	}
 
-	result, err := s.db.Exec("INSERT INTO user (username, password_hash, Name, email, created_at, updated_at) VALUES(?, ?, ?, ?, ?, ?)",
-		&user.UserName, &user.Password, &user.Name, &user.Email, time.Now(), time.Now())
+	result, err := s.exec("INSERT INTO user (username, password_hash, Name, email, status, role, created_at, updated_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		&user.UserName, &user.Password, &user.Name, &user.Email, &user.Status, &user.Role, time.Now(), time.Now())
 	if err != nil {
+		// The unique index rejected the row; the error text differs per
+		// driver, so check whether the name exists now.
+		if _, lookupErr := s.GetUserByUserName(user.UserName); lookupErr == nil {
+			return "", ErrUsernameTaken
+		}
 		return "", err
 	}
 	userID, _ := result.LastInsertId()
@@ -212,12 +377,11 @@ func (s *service) CreateUser(user model.User) (string, error) {
 
 func (s *service) GetAllUsers() ([]model.User, error) {
 	var users = []model.User{}
-	rows, err := s.db.Query("SELECT username, Name, email FROM user")
+	rows, err := s.query("SELECT username, Name, email FROM user")
 	if err != nil {
 		return users, err
 	}
 	defer rows.Close()
-	fmt.Println("rows:", rows)
 
 	for rows.Next() {
 		var user model.User
@@ -226,16 +390,16 @@ func (s *service) GetAllUsers() ([]model.User, error) {
 		}
 		users = append(users, user)
 	}
-	fmt.Println("users:", users)
 
 	return users, nil
 }
 
-func (s *service) GetAUser(userName string, pass string) (model.User, error) {
+func (s *service) GetUserByUserName(userName string) (model.User, error) {
 	var user model.User
 
-	err := s.db.QueryRow("SELECT id, username, password_hash, Name, email, created_at, updated_at FROM user WHERE username = ? AND password_hash = ?",
-		userName, pass).Scan(&user.Id, &user.UserName, &user.Password, &user.Name, &user.Email, &user.Created_at, &user.Upated_at)
+	err := s.queryRow("SELECT id, username, password_hash, Name, email, status, role, created_at, updated_at, last_seen_at FROM user WHERE username = ?",
+		userName).Scan(&user.Id, &user.UserName, &user.Password, &user.Name, &user.Email, &user.Status, &user.Role,
+		timestamp{&user.Created_at}, timestamp{&user.Upated_at}, timestamp{&user.Last_seen_at})
 	if err != nil {
 		return user, err
 	}
@@ -246,8 +410,9 @@ func (s *service) GetAUser(userName string, pass string) (model.User, error) {
 func (s *service) GetAUserv2(Id string) (model.User, error) {
 	var user model.User
 
-	err := s.db.QueryRow("SELECT id, username, Name, password_hash, email, created_at, updated_at FROM user WHERE id = ?",
-		Id).Scan(&user.Id, &user.UserName, &user.Name, &user.Password, &user.Email, &user.Created_at, &user.Upated_at)
+	err := s.queryRow("SELECT id, username, Name, password_hash, email, status, role, created_at, updated_at, last_seen_at FROM user WHERE id = ?",
+		Id).Scan(&user.Id, &user.UserName, &user.Name, &user.Password, &user.Email, &user.Status, &user.Role,
+		timestamp{&user.Created_at}, timestamp{&user.Upated_at}, timestamp{&user.Last_seen_at})
 	if err != nil {
 		return user, err
 	}
@@ -256,35 +421,37 @@ func (s *service) GetAUserv2(Id string) (model.User, error) {
 }
 
 func (s *service) UpdateUserPassword(Id string, password string) error {
-	result, err := s.db.Exec("UPDATE user SET password_hash = ?, updated_at = ? WHERE id = ?",
+	result, err := s.exec("UPDATE user SET password_hash = ?, updated_at = ? WHERE id = ?",
 		password, time.Now(), Id)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("result: %v\n", result)
+	updated, _ := result.RowsAffected()
+	s.logger.Debug("Updated user password", "user_id", Id, "count", updated)
 	return nil
 }
 
 func (s *service) UpdateUserDetails(Id string, user model.User) error {
-	result, err := s.db.Exec("UPDATE user SET email = ?, Name = ?, updated_at = ? WHERE id = ?",
+	result, err := s.exec("UPDATE user SET email = ?, Name = ?, updated_at = ? WHERE id = ?",
 		&user.Email, &user.Name, time.Now(), Id)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("result: ", result)
+	updated, _ := result.RowsAffected()
+	s.logger.Debug("Updated user details", "user_id", Id, "count", updated)
 	return nil
 }
 
 func (s *service) DeleteUser(Id string) error {
-	result, err := s.db.Exec("DELETE FROM user WHERE Id = ?", Id)
+	result, err := s.exec("DELETE FROM user WHERE Id = ?", Id)
 	if err != nil {
 		return err
 	}
 
 	totalDeletedRows, _ := result.RowsAffected()
-	fmt.Println("Total Deleted Rows:", totalDeletedRows)
+	s.logger.Debug("Deleted user", "user_id", Id, "count", totalDeletedRows)
 
 	if totalDeletedRows > 0 {
 		return nil
@@ -294,24 +461,42 @@ func (s *service) DeleteUser(Id string) error {
 
 // Chatroom
 func (s *service) CreateChatRoom(chatRoom model.ChatRoom) (string, error) {
-	result, err := s.db.Exec("INSERT INTO chatroom (name, description, created_at, updated_at) VALUES(?, ?, ?, ?)",
-		&chatRoom.Name, &chatRoom.Description, time.Now(), time.Now())
+	tx, err := s.begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	result, err := s.txExec(tx, "INSERT INTO chatroom (name, description, is_private, created_at, updated_at) VALUES(?, ?, ?, ?, ?)",
+		&chatRoom.Name, &chatRoom.Description, chatRoom.IsPrivate, time.Now(), time.Now())
 	if err != nil {
 		return "", err
 	}
 	chatRoomID, _ := result.LastInsertId()
 
+	// The creator owns the room.
+	if chatRoom.OwnerId != "" {
+		_, err = s.txExec(tx, "INSERT INTO room_members (chatroomid, user_id, role, joined_at) VALUES(?, ?, ?, ?)",
+			chatRoomID, chatRoom.OwnerId, model.RoomRoleOwner, time.Now())
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
 	return "ChatRoom is created with ID: " + fmt.Sprintf("%d", chatRoomID), nil
 }
 
 func (s *service) DeleteChatRoom(Id string) error {
-	result, err := s.db.Exec("DELETE FROM chatroom WHERE chatroomid = ?", Id)
+	result, err := s.exec("DELETE FROM chatroom WHERE chatroomid = ?", Id)
 	if err != nil {
 		return err
 	}
 
 	totalDeletedRows, _ := result.RowsAffected()
-	fmt.Println("Total Deleted Rows:", totalDeletedRows)
+	s.logger.Debug("Deleted chat room", "chatroom_id", Id, "count", totalDeletedRows)
 
 	if totalDeletedRows > 0 {
 		return nil
@@ -322,8 +507,9 @@ func (s *service) DeleteChatRoom(Id string) error {
 
 func (s *service) GetChatRoom(Id string) (model.ChatRoom, error) {
 	var chatRoom model.ChatRoom
-	err := s.db.QueryRow("SELECT chatRoomId, Name, description, created_at, updated_at FROM chatroom WHERE chatRoomId = ?",
-		&Id).Scan(&chatRoom.ChatRoomId, &chatRoom.Name, &chatRoom.Description, &chatRoom.Created_at, &chatRoom.Upated_at)
+	err := s.queryRow("SELECT chatRoomId, Name, description, is_private, "+ownerIdColumn+", created_at, updated_at FROM chatroom WHERE chatRoomId = ?",
+		&Id).Scan(&chatRoom.ChatRoomId, &chatRoom.Name, &chatRoom.Description, &chatRoom.IsPrivate, &chatRoom.OwnerId,
+		timestamp{&chatRoom.Created_at}, timestamp{&chatRoom.Upated_at})
 	if err != nil {
 		return chatRoom, err
 	}
@@ -332,14 +518,15 @@ func (s *service) GetChatRoom(Id string) (model.ChatRoom, error) {
 
 func (s *service) GetAllChatRoom() ([]model.ChatRoom, error) {
 	var chatRooms []model.ChatRoom
-	rows, err := s.db.Query("SELECT chatroomId, name, description, created_at, updated_at FROM chatroom")
+	rows, err := s.query("SELECT chatroomId, name, description, is_private, " + ownerIdColumn + ", created_at, updated_at FROM chatroom")
 	if err != nil {
 		return chatRooms, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var chatRoom model.ChatRoom
-		if err := rows.Scan(&chatRoom.ChatRoomId, &chatRoom.Name, &chatRoom.Description, &chatRoom.Created_at, &chatRoom.Upated_at); err != nil {
+		if err := rows.Scan(&chatRoom.ChatRoomId, &chatRoom.Name, &chatRoom.Description, &chatRoom.IsPrivate, &chatRoom.OwnerId,
+			timestamp{&chatRoom.Created_at}, timestamp{&chatRoom.Upated_at}); err != nil {
 			return chatRooms, err
 		}
 		chatRooms = append(chatRooms, chatRoom)
@@ -347,70 +534,185 @@ func (s *service) GetAllChatRoom() ([]model.ChatRoom, error) {
 	return chatRooms, nil
 }
 
-func (s *service) CreateMessage(message model.Message) (string, error) {
-	if message.Receiver_Id != "" && message.ChatRoomId == "" {
-		result, err := s.db.Exec("INSERT INTO message (sender_id, receiver_id, content, created_at) VALUES(?, ?, ?, ?)",
-			&message.Sender_Id, &message.Receiver_Id, &message.Content, time.Now())
-
-		if err != nil {
-			return "", err
-		}
-		messageID, _ := result.LastInsertId()
+// storedTimeLayouts are the ways SQLite may hand back a timestamp as text:
+// as written with _time_format=sqlite, or by time.Time.String in older rows.
+var storedTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+}
 
-		return "Message is created with ID: " + fmt.Sprintf("%d", messageID), nil
-	}
-	if message.ChatRoomId != "" && message.Receiver_Id == "" {
-		result, err := s.db.Exec("INSERT INTO message (chatroomid, sender_id, content, created_at) VALUES(?, ?, ?, ?)",
-			&message.ChatRoomId, &message.Sender_Id, &message.Content, time.Now())
+// timestamp scans a DATETIME column, which may be NULL, into dest in
+// timeLayout. MySQL returns that text already; SQLite returns a time.Time
+// for columns and text for expressions such as subqueries.
+type timestamp struct {
+	dest *string
+}
 
-		if err != nil {
-			return "", err
+func (t timestamp) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*t.dest = ""
+	case time.Time:
+		*t.dest = v.UTC().Format(timeLayout)
+	case []byte:
+		return t.Scan(string(v))
+	case string:
+		*t.dest = v
+		text, _, _ := strings.Cut(v, " m=")
+		for _, layout := range storedTimeLayouts {
+			if parsed, err := time.Parse(layout, text); err == nil {
+				*t.dest = parsed.UTC().Format(timeLayout)
+				break
+			}
 		}
-		messageID, _ := result.LastInsertId()
-
-		return "Message is created with ID: " + fmt.Sprintf("%d", messageID), nil
+	default:
+		return fmt.Errorf("cannot scan %T into a timestamp", src)
 	}
-	return "", fmt.Errorf("there cannot have both chatroomid and receiver_id in the body")
+	return nil
 }
 
-func (s *service) GetMessagesForChatRoom(chatRoomId string) ([]model.Message, error) {
-	var messages []model.Message
-	rows, err := s.db.Query("SELECT messageid, chatroomid, sender_id, content, created_at FROM message WHERE chatroomid = ? ORDER BY created_at",
-		chatRoomId)
-	if err != nil {
-		return messages, err
-	}
+// messageColumns are the columns scanMessages expects, in order.
+// The last two summarize the thread of each message.
+const messageColumns = "messageid, COALESCE(chatroomid, ''), sender_id, COALESCE(receiver_id, ''), COALESCE(parent_message_id, ''), " +
+	"content, created_at, edited_at, deleted_at, " +
+	"(SELECT COUNT(*) FROM message reply WHERE reply.parent_message_id = message.messageid), " +
+	"(SELECT reply.created_at FROM message reply WHERE reply.parent_message_id = message.messageid ORDER BY reply.messageid DESC LIMIT 1)"
 
+func scanMessages(rows *sql.Rows) ([]model.Message, error) {
+	defer rows.Close()
+	messages := []model.Message{}
 	for rows.Next() {
 		var message model.Message
-		err := rows.Scan(&message.MessageId, &message.ChatRoomId, &message.Sender_Id, &message.Content,
-			&message.Created_at)
+		err := rows.Scan(&message.MessageId, &message.ChatRoomId, &message.Sender_Id, &message.Receiver_Id, &message.ParentMessageId,
+			&message.Content, timestamp{&message.Created_at}, timestamp{&message.Edited_at}, timestamp{&message.Deleted_at},
+			&message.ReplyCount, timestamp{&message.Last_reply_at})
 		if err != nil {
 			return messages, err
 		}
 		messages = append(messages, message)
 	}
-	return messages, nil
+	return messages, rows.Err()
 }
 
-func (s *service) GetMessagesforIndividualChat(senderReceiver map[string]string) ([]model.Message, error) {
-	var messages []model.Message
-	rows, err := s.db.Query("SELECT messageid, sender_id, receiver_id, content, created_at FROM message WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?) ORDER BY created_at",
-		senderReceiver["sender_id"], senderReceiver["receiver_id"], senderReceiver["receiver_id"], senderReceiver["sender_id"])
+func (s *service) CreateMessage(message model.Message) (model.Message, error) {
+	var result sql.Result
+	var err error
+	switch {
+	case message.Receiver_Id != "" && message.ChatRoomId == "":
+		if message.ParentMessageId != "" {
+			return model.Message{}, fmt.Errorf("direct messages cannot be replies")
+		}
+		result, err = s.exec("INSERT INTO message (sender_id, receiver_id, content, created_at) VALUES(?, ?, ?, ?)",
+			&message.Sender_Id, &message.Receiver_Id, &message.Content, time.Now())
+	case message.ChatRoomId != "" && message.Receiver_Id == "":
+		if message.ParentMessageId != "" {
+			parent, err := s.GetMessage(message.ParentMessageId)
+			if err != nil {
+				return model.Message{}, fmt.Errorf("no message exists with Id: %s", message.ParentMessageId)
+			}
+			if err := checkReply(message, parent); err != nil {
+				return model.Message{}, err
+			}
+		}
+		result, err = s.exec("INSERT INTO message (chatroomid, parent_message_id, sender_id, content, created_at) VALUES(?, ?, ?, ?, ?)",
+			&message.ChatRoomId, sql.NullString{String: message.ParentMessageId, Valid: message.ParentMessageId != ""},
+			&message.Sender_Id, &message.Content, time.Now())
+	default:
+		return model.Message{}, fmt.Errorf("there cannot have both chatroomid and receiver_id in the body")
+	}
+	if err != nil {
+		return model.Message{}, err
+	}
+	messageID, _ := result.LastInsertId()
+
+	// Read the row back so the timestamp is formatted like every other read.
+	return s.GetMessage(strconv.FormatInt(messageID, 10))
+}
+
+// pageQuery appends the cursors and limit of page to a message query whose
+// WHERE clause is already written.
+func (s *service) pageQuery(query string, page model.MessagePage, args ...interface{}) ([]model.Message, error) {
+	before, after, err := parseCursors(page)
+	if err != nil {
+		return nil, err
+	}
+	if before > 0 {
+		query += " AND messageid < ?"
+		args = append(args, before)
+	}
+	if after > 0 {
+		query += " AND messageid > ?"
+		args = append(args, after)
+	}
+	forward := after > 0 && before == 0
+	if forward {
+		query += " ORDER BY messageid ASC"
+	} else {
+		query += " ORDER BY messageid DESC"
+	}
+	if page.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, page.Limit)
+	}
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
 	if err != nil {
 		return messages, err
 	}
+	if forward == page.NewestFirst {
+		reverseMessages(messages)
+	}
+	return messages, nil
+}
 
-	for rows.Next() {
-		var message model.Message
-		err := rows.Scan(&message.MessageId, &message.Sender_Id, &message.Receiver_Id, &message.Content,
-			&message.Created_at)
-		if err != nil {
-			return messages, err
+// parseCursors returns the numeric Before and After ids of page, 0 if unset.
+func parseCursors(page model.MessagePage) (before int64, after int64, err error) {
+	if page.Before != "" {
+		if before, err = strconv.ParseInt(page.Before, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid message cursor %q", page.Before)
 		}
-		messages = append(messages, message)
 	}
-	return messages, nil
+	if page.After != "" {
+		if after, err = strconv.ParseInt(page.After, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid message cursor %q", page.After)
+		}
+	}
+	return before, after, nil
+}
+
+func reverseMessages(messages []model.Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+func (s *service) GetMessagesForChatRoom(chatRoomId string, page model.MessagePage) ([]model.Message, error) {
+	return s.pageQuery("SELECT "+messageColumns+" FROM message WHERE chatroomid = ? AND parent_message_id IS NULL", page, chatRoomId)
+}
+
+func (s *service) GetThread(parentId string, page model.MessagePage) ([]model.Message, error) {
+	return s.pageQuery("SELECT "+messageColumns+" FROM message WHERE parent_message_id = ?", page, parentId)
+}
+
+// checkReply validates the parent of a new reply. Threads stay within one
+// chat room and are one level deep.
+func checkReply(reply model.Message, parent model.Message) error {
+	if parent.ChatRoomId == "" || parent.ChatRoomId != reply.ChatRoomId {
+		return fmt.Errorf("replies must be posted in the chat room of message %s", parent.MessageId)
+	}
+	if parent.ParentMessageId != "" {
+		return fmt.Errorf("message %s is a reply and cannot have replies", parent.MessageId)
+	}
+	return nil
+}
+
+func (s *service) GetMessagesforIndividualChat(senderReceiver map[string]string, page model.MessagePage) ([]model.Message, error) {
+	return s.pageQuery("SELECT "+messageColumns+" FROM message WHERE ((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))", page,
+		senderReceiver["sender_id"], senderReceiver["receiver_id"], senderReceiver["receiver_id"], senderReceiver["sender_id"])
 }
 
 // Close closes the database connection.
@@ -418,6 +720,58 @@ func (s *service) GetMessagesforIndividualChat(senderReceiver map[string]string)
 // If the connection is successfully closed, it returns nil.
 // If an error occurs while closing the connection, it returns the error.
 func (s *service) Close() error {
-	log.Printf("Disconnected from database: %s", dbname)
+	s.logger.Info("Disconnected from database", "database", s.name)
 	return s.db.Close()
 }
+
+// Stats returns the statistics of the connection pool.
+func (s *service) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
+func (s *service) WithContext(ctx context.Context) Service {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+// context returns the context of the calls, context.Background() unless
+// set with WithContext.
+func (s *service) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// exec runs a statement and counts the rows it affected for tracing.
+func (s *service) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.counted(s.db.ExecContext(s.context(), query, args...))
+}
+
+// txExec runs a statement in tx and counts the rows it affected for
+// tracing.
+func (s *service) txExec(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	return s.counted(tx.ExecContext(s.context(), query, args...))
+}
+
+func (s *service) counted(result sql.Result, err error) (sql.Result, error) {
+	if err == nil {
+		if n, err := result.RowsAffected(); err == nil {
+			countRows(s.context(), n)
+		}
+	}
+	return result, err
+}
+
+func (s *service) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(s.context(), query, args...)
+}
+
+func (s *service) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(s.context(), query, args...)
+}
+
+func (s *service) begin() (*sql.Tx, error) {
+	return s.db.BeginTx(s.context(), nil)
+}
@@ -3,9 +3,12 @@ package database
 import (
 	"context"
 	"log"
+	"os"
 	"testing"
 	"time"
 
+	"chat-app/internal/logging"
+
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/mysql"
 	"github.com/testcontainers/testcontainers-go/wait"
@@ -49,28 +52,46 @@ func mustStartMySQLContainer() (func(context.Context) error, error) {
 	return dbContainer.Terminate, err
 }
 
+// containerErr is why the MySQL container did not start, if it did not.
+var containerErr error
+
+// TestMain starts a MySQL container for the tests that need one. Without
+// Docker, those tests are skipped and the others still run.
 func TestMain(m *testing.M) {
 	teardown, err := mustStartMySQLContainer()
 	if err != nil {
-		log.Fatalf("could not start mysql container: %v", err)
+		containerErr = err
+		log.Printf("could not start mysql container, skipping the MySQL tests: %v", err)
 	}
 
-	m.Run()
+	code := m.Run()
 
 	if teardown != nil && teardown(context.Background()) != nil {
 		log.Fatalf("could not teardown mysql container: %v", err)
 	}
+	os.Exit(code)
+}
+
+// RequireMySQL skips a test that needs the MySQL container if it did not
+// start. It is exported for the tests of package database_test.
+func RequireMySQL(t *testing.T) {
+	t.Helper()
+	if containerErr != nil {
+		t.Skipf("MySQL container unavailable: %v", containerErr)
+	}
 }
 
 func TestNew(t *testing.T) {
-	srv := New()
+	RequireMySQL(t)
+	srv := New(logging.Discard())
 	if srv == nil {
 		t.Fatal("New() returned nil")
 	}
 }
 
 func TestHealth(t *testing.T) {
-	srv := New()
+	RequireMySQL(t)
+	srv := New(logging.Discard())
 
 	stats := srv.Health()
 
@@ -87,8 +108,48 @@ func TestHealth(t *testing.T) {
 	}
 }
 
+func TestMigrations(t *testing.T) {
+	RequireMySQL(t)
+	srv := New(logging.Discard()).(*service)
+
+	migrator, err := NewMigrator(srv.db, "mysql")
+	if err != nil {
+		t.Fatalf("NewMigrator() returned error: %v", err)
+	}
+
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("Up() returned error: %v", err)
+	}
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatalf("Status() returned error: %v", err)
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Fatalf("expected migration %d_%s to be applied", status.Version, status.Name)
+		}
+	}
+
+	reverted, err := migrator.Down(0)
+	if err != nil {
+		t.Fatalf("Down() returned error: %v", err)
+	}
+	if reverted != len(statuses) {
+		t.Fatalf("expected %d migrations to be rolled back, got %d", len(statuses), reverted)
+	}
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("Up() after Down() returned error: %v", err)
+	}
+	if applied != len(statuses) {
+		t.Fatalf("expected %d migrations to be re-applied, got %d", len(statuses), applied)
+	}
+}
+
 func TestClose(t *testing.T) {
-	srv := New()
+	RequireMySQL(t)
+	srv := New(logging.Discard())
 
 	if srv.Close() != nil {
 		t.Fatalf("expected Close() to return nil")
@@ -0,0 +1,1107 @@
+// Package databasetest holds the conformance suite every database.Service
+// implementation must pass.
+package databasetest
+
+import (
+	model "chat-app/internal/Models"
+	"chat-app/internal/database"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// OpenFunc returns a Service for a single test. Implementations backed by a
+// shared database may return the same Service every time; the suite only
+// relies on data it created itself.
+type OpenFunc func(t *testing.T) database.Service
+
+var sequence atomic.Int64
+
+// unique returns a name that is not used by any other test in this process
+// or by earlier runs against the same database.
+func unique(prefix string) string {
+	return fmt.Sprintf("%s_%d_%d", prefix, time.Now().UnixNano()%1e9, sequence.Add(1))
+}
+
+// uniqueWord returns a word of letters only that no other test uses, so
+// full-text searches only find the messages of the calling test.
+func uniqueWord() string {
+	word := []byte("zq")
+	for n := time.Now().UnixNano()%1e9*1000 + sequence.Add(1); n > 0; n /= 26 {
+		word = append(word, byte('a'+n%26))
+	}
+	return string(word)
+}
+
+// idFrom extracts the trailing id from responses such as
+// "User is inserted with ID: 7".
+func idFrom(t *testing.T, response string) string {
+	t.Helper()
+	i := strings.LastIndex(response, ": ")
+	if i < 0 {
+		t.Fatalf("response %q does not contain an id", response)
+	}
+	return response[i+2:]
+}
+
+// CreateUser inserts a user with a unique username and returns it with its id.
+func CreateUser(t *testing.T, srv database.Service) model.User {
+	t.Helper()
+	user := model.User{
+		UserName: unique("user"),
+		Password: "secret",
+		Name:     "Test User",
+		Email:    "test@example.com",
+	}
+	response, err := srv.CreateUser(user)
+	if err != nil {
+		t.Fatalf("CreateUser() returned error: %v", err)
+	}
+	user.Id = idFrom(t, response)
+	return user
+}
+
+// CreateChatRoom inserts a chat room with a unique name and returns its id.
+func CreateChatRoom(t *testing.T, srv database.Service) string {
+	t.Helper()
+	response, err := srv.CreateChatRoom(model.ChatRoom{Name: unique("room"), Description: "conformance"})
+	if err != nil {
+		t.Fatalf("CreateChatRoom() returned error: %v", err)
+	}
+	return idFrom(t, response)
+}
+
+// Run executes the conformance suite against the Service returned by open.
+func Run(t *testing.T, open OpenFunc) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, srv database.Service)
+	}{
+		{"Health", testHealth},
+		{"Users", testUsers},
+		{"DuplicateUsername", testDuplicateUsername},
+		{"RefreshTokens", testRefreshTokens},
+		{"ChatRooms", testChatRooms},
+		{"RoomMessages", testRoomMessages},
+		{"DirectMessages", testDirectMessages},
+		{"MessagePages", testMessagePages},
+		{"InvalidMessage", testInvalidMessage},
+		{"DeleteUserCascades", testDeleteUserCascades},
+		{"EmailVerification", testEmailVerification},
+		{"Roles", testRoles},
+		{"RoomMembers", testRoomMembers},
+		{"SearchMessages", testSearchMessages},
+		{"MessageEdits", testMessageEdits},
+		{"Reactions", testReactions},
+		{"Threads", testThreads},
+		{"ReadMarkers", testReadMarkers},
+		{"Presence", testPresence},
+		{"Timestamps", testTimestamps},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, open(t))
+		})
+	}
+}
+
+func testHealth(t *testing.T, srv database.Service) {
+	if status := srv.Health()["status"]; status != "up" {
+		t.Fatalf("expected status to be up, got %s", status)
+	}
+}
+
+func testUsers(t *testing.T, srv database.Service) {
+	user := CreateUser(t, srv)
+
+	got, err := srv.GetAUserv2(user.Id)
+	if err != nil {
+		t.Fatalf("GetAUserv2() returned error: %v", err)
+	}
+	if got.UserName != user.UserName || got.Email != user.Email || got.Name != user.Name {
+		t.Fatalf("GetAUserv2() = %+v, want %+v", got, user)
+	}
+	if got.Created_at == "" {
+		t.Fatalf("expected created_at to be set")
+	}
+	if got.Status != model.UserStatusActive {
+		t.Fatalf("expected new users to default to %q, got %q", model.UserStatusActive, got.Status)
+	}
+
+	byName, err := srv.GetUserByUserName(user.UserName)
+	if err != nil {
+		t.Fatalf("GetUserByUserName() returned error: %v", err)
+	}
+	if byName.Id != user.Id || byName.Password != user.Password {
+		t.Fatalf("GetUserByUserName() = %+v, want id %s with its password hash", byName, user.Id)
+	}
+	if _, err := srv.GetUserByUserName(unique("missing")); err == nil {
+		t.Fatalf("expected GetUserByUserName() for an unknown user to fail")
+	}
+
+	if err := srv.UpdateUserDetails(user.Id, model.User{Name: "Renamed", Email: "renamed@example.com"}); err != nil {
+		t.Fatalf("UpdateUserDetails() returned error: %v", err)
+	}
+	if err := srv.UpdateUserPassword(user.Id, "changed"); err != nil {
+		t.Fatalf("UpdateUserPassword() returned error: %v", err)
+	}
+	got, err = srv.GetAUserv2(user.Id)
+	if err != nil {
+		t.Fatalf("GetAUserv2() returned error: %v", err)
+	}
+	if got.Name != "Renamed" || got.Email != "renamed@example.com" {
+		t.Fatalf("expected updated details, got %+v", got)
+	}
+	if got.Password != "changed" {
+		t.Fatalf("expected password hash to be updated, got %q", got.Password)
+	}
+
+	users, err := srv.GetAllUsers()
+	if err != nil {
+		t.Fatalf("GetAllUsers() returned error: %v", err)
+	}
+	found := false
+	for _, u := range users {
+		found = found || u.UserName == user.UserName
+	}
+	if !found {
+		t.Fatalf("GetAllUsers() did not return %s", user.UserName)
+	}
+
+	if err := srv.DeleteUser(user.Id); err != nil {
+		t.Fatalf("DeleteUser() returned error: %v", err)
+	}
+	if _, err := srv.GetAUserv2(user.Id); err == nil {
+		t.Fatalf("expected deleted user to be gone")
+	}
+	if err := srv.DeleteUser(user.Id); err == nil {
+		t.Fatalf("expected deleting a missing user to fail")
+	}
+}
+
+func testDuplicateUsername(t *testing.T, srv database.Service) {
+	user := CreateUser(t, srv)
+	if _, err := srv.CreateUser(user); !errors.Is(err, database.ErrUsernameTaken) {
+		t.Fatalf("expected ErrUsernameTaken for a duplicate username, got %v", err)
+	}
+}
+
+func testRefreshTokens(t *testing.T, srv database.Service) {
+	user := CreateUser(t, srv)
+	token := unique("token")
+
+	if err := srv.CreateRefreshToken(user.Id, token); err != nil {
+		t.Fatalf("CreateRefreshToken() returned error: %v", err)
+	}
+	if valid, err := srv.GetRefreshToken(token); err != nil || !valid {
+		t.Fatalf("GetRefreshToken() = %v, %v; want true, nil", valid, err)
+	}
+
+	if err := srv.UpdateRefreshToken(token, user.Id); err != nil {
+		t.Fatalf("UpdateRefreshToken() returned error: %v", err)
+	}
+	if valid, err := srv.GetRefreshToken(token); err == nil || valid {
+		t.Fatalf("expected an invalidated refresh token to be rejected")
+	}
+
+	if _, err := srv.DeleteRefreshToken(); err != nil {
+		t.Fatalf("DeleteRefreshToken() returned error: %v", err)
+	}
+	if _, err := srv.GetRefreshToken(token); err == nil {
+		t.Fatalf("expected the invalid refresh token to be deleted")
+	}
+	if _, err := srv.GetRefreshToken(unique("missing")); err == nil {
+		t.Fatalf("expected an unknown refresh token to be rejected")
+	}
+}
+
+func testChatRooms(t *testing.T, srv database.Service) {
+	id := CreateChatRoom(t, srv)
+
+	room, err := srv.GetChatRoom(id)
+	if err != nil {
+		t.Fatalf("GetChatRoom() returned error: %v", err)
+	}
+	if room.ChatRoomId != id || room.Description != "conformance" {
+		t.Fatalf("GetChatRoom() = %+v", room)
+	}
+
+	rooms, err := srv.GetAllChatRoom()
+	if err != nil {
+		t.Fatalf("GetAllChatRoom() returned error: %v", err)
+	}
+	found := false
+	for _, r := range rooms {
+		found = found || r.ChatRoomId == id
+	}
+	if !found {
+		t.Fatalf("GetAllChatRoom() did not return room %s", id)
+	}
+
+	if err := srv.DeleteChatRoom(id); err != nil {
+		t.Fatalf("DeleteChatRoom() returned error: %v", err)
+	}
+	if _, err := srv.GetChatRoom(id); err == nil {
+		t.Fatalf("expected deleted chat room to be gone")
+	}
+	if err := srv.DeleteChatRoom(id); err == nil {
+		t.Fatalf("expected deleting a missing chat room to fail")
+	}
+}
+
+func testRoomMessages(t *testing.T, srv database.Service) {
+	sender := CreateUser(t, srv)
+	roomId := CreateChatRoom(t, srv)
+
+	for _, content := range []string{"first", "second"} {
+		created, err := srv.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: sender.Id, Content: content})
+		if err != nil {
+			t.Fatalf("CreateMessage() returned error: %v", err)
+		}
+		if created.MessageId == "" || created.Created_at == "" || created.Content != content || created.ChatRoomId != roomId {
+			t.Fatalf("CreateMessage() = %+v, want the stored message", created)
+		}
+	}
+
+	messages, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{})
+	if err != nil {
+		t.Fatalf("GetMessagesForChatRoom() returned error: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Content != "first" || messages[1].Content != "second" {
+		t.Fatalf("GetMessagesForChatRoom() = %+v", messages)
+	}
+	if messages[0].Sender_Id != sender.Id || messages[0].ChatRoomId != roomId {
+		t.Fatalf("unexpected message fields: %+v", messages[0])
+	}
+
+	if err := srv.DeleteChatRoom(roomId); err != nil {
+		t.Fatalf("DeleteChatRoom() returned error: %v", err)
+	}
+	messages, err = srv.GetMessagesForChatRoom(roomId, model.MessagePage{})
+	if err != nil {
+		t.Fatalf("GetMessagesForChatRoom() returned error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("expected messages to be deleted with their room, got %d", len(messages))
+	}
+}
+
+func testDirectMessages(t *testing.T, srv database.Service) {
+	alice := CreateUser(t, srv)
+	bob := CreateUser(t, srv)
+	carol := CreateUser(t, srv)
+
+	send := func(from, to model.User, content string) {
+		t.Helper()
+		if _, err := srv.CreateMessage(model.Message{Sender_Id: from.Id, Receiver_Id: to.Id, Content: content}); err != nil {
+			t.Fatalf("CreateMessage() returned error: %v", err)
+		}
+	}
+	send(alice, bob, "hi bob")
+	send(bob, alice, "hi alice")
+	send(alice, carol, "hi carol")
+
+	messages, err := srv.GetMessagesforIndividualChat(map[string]string{"sender_id": bob.Id, "receiver_id": alice.Id}, model.MessagePage{})
+	if err != nil {
+		t.Fatalf("GetMessagesforIndividualChat() returned error: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Content != "hi bob" || messages[1].Content != "hi alice" {
+		t.Fatalf("GetMessagesforIndividualChat() = %+v", messages)
+	}
+}
+
+func testMessagePages(t *testing.T, srv database.Service) {
+	alice := CreateUser(t, srv)
+	bob := CreateUser(t, srv)
+	roomId := CreateChatRoom(t, srv)
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		created, err := srv.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: alice.Id, Content: fmt.Sprint("room ", i)})
+		if err != nil {
+			t.Fatalf("CreateMessage() returned error: %v", err)
+		}
+		ids = append(ids, created.MessageId)
+		if _, err := srv.CreateMessage(model.Message{Sender_Id: alice.Id, Receiver_Id: bob.Id, Content: fmt.Sprint("direct ", i)}); err != nil {
+			t.Fatalf("CreateMessage() returned error: %v", err)
+		}
+	}
+
+	contents := func(messages []model.Message) string {
+		var parts []string
+		for _, message := range messages {
+			parts = append(parts, message.Content)
+		}
+		return strings.Join(parts, ",")
+	}
+
+	latest, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{Limit: 2})
+	if err != nil {
+		t.Fatalf("GetMessagesForChatRoom() returned error: %v", err)
+	}
+	if got := contents(latest); got != "room 3,room 4" {
+		t.Fatalf("latest page = %s, want room 3,room 4", got)
+	}
+	older, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{Before: latest[0].MessageId, Limit: 2})
+	if err != nil {
+		t.Fatalf("GetMessagesForChatRoom() returned error: %v", err)
+	}
+	if got := contents(older); got != "room 1,room 2" {
+		t.Fatalf("older page = %s, want room 1,room 2", got)
+	}
+	oldest, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{Before: ids[1], Limit: 2})
+	if err != nil {
+		t.Fatalf("GetMessagesForChatRoom() returned error: %v", err)
+	}
+	if got := contents(oldest); got != "room 0" {
+		t.Fatalf("oldest page = %s, want room 0", got)
+	}
+
+	direct, err := srv.GetMessagesforIndividualChat(map[string]string{"sender_id": bob.Id, "receiver_id": alice.Id}, model.MessagePage{Limit: 3})
+	if err != nil {
+		t.Fatalf("GetMessagesforIndividualChat() returned error: %v", err)
+	}
+	if got := contents(direct); got != "direct 2,direct 3,direct 4" {
+		t.Fatalf("direct page = %s, want direct 2,direct 3,direct 4", got)
+	}
+
+	newer, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{After: ids[0], Limit: 2})
+	if err != nil {
+		t.Fatalf("GetMessagesForChatRoom() returned error: %v", err)
+	}
+	if got := contents(newer); got != "room 1,room 2" {
+		t.Fatalf("page after %s = %s, want room 1,room 2", ids[0], got)
+	}
+	between, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{After: ids[0], Before: ids[4], NewestFirst: true})
+	if err != nil {
+		t.Fatalf("GetMessagesForChatRoom() returned error: %v", err)
+	}
+	if got := contents(between); got != "room 3,room 2,room 1" {
+		t.Fatalf("newest-first range = %s, want room 3,room 2,room 1", got)
+	}
+	newestFirst, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{After: ids[2], NewestFirst: true})
+	if err != nil {
+		t.Fatalf("GetMessagesForChatRoom() returned error: %v", err)
+	}
+	if got := contents(newestFirst); got != "room 4,room 3" {
+		t.Fatalf("newest-first page after %s = %s, want room 4,room 3", ids[2], got)
+	}
+
+	if _, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{Before: "not-an-id"}); err == nil {
+		t.Fatalf("expected an invalid cursor to be rejected")
+	}
+}
+
+func testInvalidMessage(t *testing.T, srv database.Service) {
+	sender := CreateUser(t, srv)
+	receiver := CreateUser(t, srv)
+	roomId := CreateChatRoom(t, srv)
+
+	invalid := []model.Message{
+		{Sender_Id: sender.Id, Content: "nowhere"},
+		{Sender_Id: sender.Id, Receiver_Id: receiver.Id, ChatRoomId: roomId, Content: "both"},
+		{Sender_Id: sender.Id, Receiver_Id: "999999999", Content: "unknown receiver"},
+		{Sender_Id: sender.Id, ChatRoomId: "999999999", Content: "unknown room"},
+	}
+	for _, message := range invalid {
+		if _, err := srv.CreateMessage(message); err == nil {
+			t.Errorf("expected CreateMessage(%+v) to fail", message)
+		}
+	}
+}
+
+func testDeleteUserCascades(t *testing.T, srv database.Service) {
+	alice := CreateUser(t, srv)
+	bob := CreateUser(t, srv)
+
+	if _, err := srv.CreateMessage(model.Message{Sender_Id: alice.Id, Receiver_Id: bob.Id, Content: "bye"}); err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+	token := unique("token")
+	if err := srv.CreateRefreshToken(alice.Id, token); err != nil {
+		t.Fatalf("CreateRefreshToken() returned error: %v", err)
+	}
+
+	if err := srv.DeleteUser(alice.Id); err != nil {
+		t.Fatalf("DeleteUser() returned error: %v", err)
+	}
+
+	messages, err := srv.GetMessagesforIndividualChat(map[string]string{"sender_id": alice.Id, "receiver_id": bob.Id}, model.MessagePage{})
+	if err != nil {
+		t.Fatalf("GetMessagesforIndividualChat() returned error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("expected messages of a deleted user to be removed, got %d", len(messages))
+	}
+	if _, err := srv.GetRefreshToken(token); err == nil {
+		t.Fatalf("expected refresh tokens of a deleted user to be removed")
+	}
+}
+
+func testEmailVerification(t *testing.T, srv database.Service) {
+	user := model.User{UserName: unique("pending"), Password: "secret", Email: "pending@example.com", Status: model.UserStatusPending}
+	response, err := srv.CreateUser(user)
+	if err != nil {
+		t.Fatalf("CreateUser() returned error: %v", err)
+	}
+	user.Id = idFrom(t, response)
+
+	got, err := srv.GetUserByUserName(user.UserName)
+	if err != nil {
+		t.Fatalf("GetUserByUserName() returned error: %v", err)
+	}
+	if got.Status != model.UserStatusPending {
+		t.Fatalf("expected status %q, got %q", model.UserStatusPending, got.Status)
+	}
+
+	tokenHash := unique("hash")
+	if err := srv.CreateVerificationToken(user.Id, tokenHash, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("CreateVerificationToken() returned error: %v", err)
+	}
+	expiredHash := unique("expired")
+	if err := srv.CreateVerificationToken(user.Id, expiredHash, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("CreateVerificationToken() returned error: %v", err)
+	}
+
+	if _, err := srv.ConsumeVerificationToken(expiredHash); err == nil {
+		t.Fatalf("expected an expired verification token to be rejected")
+	}
+	userId, err := srv.ConsumeVerificationToken(tokenHash)
+	if err != nil {
+		t.Fatalf("ConsumeVerificationToken() returned error: %v", err)
+	}
+	if userId != user.Id {
+		t.Fatalf("ConsumeVerificationToken() = %s, want %s", userId, user.Id)
+	}
+	if _, err := srv.ConsumeVerificationToken(tokenHash); err == nil {
+		t.Fatalf("expected a verification token to be single-use")
+	}
+
+	got, err = srv.GetAUserv2(user.Id)
+	if err != nil {
+		t.Fatalf("GetAUserv2() returned error: %v", err)
+	}
+	if got.Status != model.UserStatusActive {
+		t.Fatalf("expected status %q after verification, got %q", model.UserStatusActive, got.Status)
+	}
+}
+
+// CreateOwnedChatRoom inserts a chat room owned by ownerId and returns its id.
+func CreateOwnedChatRoom(t *testing.T, srv database.Service, ownerId string) string {
+	t.Helper()
+	response, err := srv.CreateChatRoom(model.ChatRoom{Name: unique("room"), Description: "conformance", OwnerId: ownerId})
+	if err != nil {
+		t.Fatalf("CreateChatRoom() returned error: %v", err)
+	}
+	return idFrom(t, response)
+}
+
+func testRoles(t *testing.T, srv database.Service) {
+	owner := CreateUser(t, srv)
+	other := CreateUser(t, srv)
+
+	got, err := srv.GetAUserv2(owner.Id)
+	if err != nil {
+		t.Fatalf("GetAUserv2() returned error: %v", err)
+	}
+	if got.Role != model.RoleUser {
+		t.Fatalf("expected new users to have role %q, got %q", model.RoleUser, got.Role)
+	}
+	if err := srv.SetUserRole(owner.Id, model.RoleAdmin); err != nil {
+		t.Fatalf("SetUserRole() returned error: %v", err)
+	}
+	if got, _ := srv.GetUserByUserName(owner.UserName); got.Role != model.RoleAdmin {
+		t.Fatalf("expected role %q after SetUserRole(), got %q", model.RoleAdmin, got.Role)
+	}
+	if err := srv.SetUserRole("999999999", model.RoleAdmin); err == nil {
+		t.Fatalf("expected SetUserRole() for a missing user to fail")
+	}
+
+	roomId := CreateOwnedChatRoom(t, srv, owner.Id)
+	room, err := srv.GetChatRoom(roomId)
+	if err != nil {
+		t.Fatalf("GetChatRoom() returned error: %v", err)
+	}
+	if room.OwnerId != owner.Id {
+		t.Fatalf("expected owner %s, got %q", owner.Id, room.OwnerId)
+	}
+
+	if role, err := srv.GetRoomRole(roomId, owner.Id); err != nil || role != model.RoomRoleOwner {
+		t.Fatalf("GetRoomRole(owner) = %q, %v", role, err)
+	}
+	if role, err := srv.GetRoomRole(roomId, other.Id); err != nil || role != "" {
+		t.Fatalf("GetRoomRole(non-member) = %q, %v; want empty", role, err)
+	}
+	if err := srv.SetRoomMemberRole(roomId, other.Id, model.RoomRoleModerator); err == nil {
+		t.Fatalf("expected SetRoomMemberRole() for a non-member to fail")
+	}
+
+	if err := srv.DeleteUser(owner.Id); err != nil {
+		t.Fatalf("DeleteUser() returned error: %v", err)
+	}
+	if role, err := srv.GetRoomRole(roomId, owner.Id); err != nil || role != "" {
+		t.Fatalf("expected memberships of a deleted user to be removed, got %q, %v", role, err)
+	}
+}
+
+func testRoomMembers(t *testing.T, srv database.Service) {
+	owner := CreateUser(t, srv)
+	member := CreateUser(t, srv)
+
+	response, err := srv.CreateChatRoom(model.ChatRoom{Name: unique("room"), OwnerId: owner.Id, IsPrivate: true})
+	if err != nil {
+		t.Fatalf("CreateChatRoom() returned error: %v", err)
+	}
+	roomId := idFrom(t, response)
+	room, err := srv.GetChatRoom(roomId)
+	if err != nil {
+		t.Fatalf("GetChatRoom() returned error: %v", err)
+	}
+	if !room.IsPrivate {
+		t.Fatalf("expected room %s to be private", roomId)
+	}
+
+	if err := srv.AddRoomMember(roomId, member.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+	if err := srv.AddRoomMember(roomId, member.Id, model.RoomRoleMember); err == nil {
+		t.Fatalf("expected adding an existing member to fail")
+	}
+	if role, err := srv.GetRoomRole(roomId, member.Id); err != nil || role != model.RoomRoleMember {
+		t.Fatalf("GetRoomRole(member) = %q, %v", role, err)
+	}
+
+	members, err := srv.GetRoomMembers(roomId)
+	if err != nil {
+		t.Fatalf("GetRoomMembers() returned error: %v", err)
+	}
+	if len(members) != 2 || members[0].UserId != owner.Id || members[1].UserId != member.Id {
+		t.Fatalf("GetRoomMembers() = %+v, want owner then member", members)
+	}
+	if members[1].UserName != member.UserName || members[1].Role != model.RoomRoleMember || members[1].Joined_at == "" {
+		t.Fatalf("GetRoomMembers() returned incomplete member %+v", members[1])
+	}
+
+	if err := srv.RemoveRoomMember(roomId, member.Id); err != nil {
+		t.Fatalf("RemoveRoomMember() returned error: %v", err)
+	}
+	if err := srv.RemoveRoomMember(roomId, member.Id); err == nil {
+		t.Fatalf("expected removing a non-member to fail")
+	}
+	if members, _ := srv.GetRoomMembers(roomId); len(members) != 1 {
+		t.Fatalf("expected only the owner to remain, got %+v", members)
+	}
+}
+
+func testSearchMessages(t *testing.T, srv database.Service) {
+	alice := CreateUser(t, srv)
+	bob := CreateUser(t, srv)
+	carol := CreateUser(t, srv)
+	roomId := CreateOwnedChatRoom(t, srv, alice.Id)
+	if err := srv.AddRoomMember(roomId, bob.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+	otherRoomId := CreateOwnedChatRoom(t, srv, carol.Id)
+
+	word := uniqueWord()
+	send := func(message model.Message) string {
+		t.Helper()
+		created, err := srv.CreateMessage(message)
+		if err != nil {
+			t.Fatalf("CreateMessage() returned error: %v", err)
+		}
+		return created.MessageId
+	}
+	deploy := send(model.Message{ChatRoomId: roomId, Sender_Id: alice.Id, Content: "Deploy the " + word + " service <today>"})
+	rollback := send(model.Message{ChatRoomId: roomId, Sender_Id: bob.Id, Content: word + " deploy rollback"})
+	hidden := send(model.Message{ChatRoomId: otherRoomId, Sender_Id: carol.Id, Content: word + " secret"})
+	direct := send(model.Message{Sender_Id: bob.Id, Receiver_Id: alice.Id, Content: "about " + word})
+	send(model.Message{Sender_Id: carol.Id, Receiver_Id: bob.Id, Content: word + " between others"})
+	long := send(model.Message{Sender_Id: alice.Id, Receiver_Id: bob.Id, Content: strings.Repeat("filler ", 30) + word + strings.Repeat(" filler", 30)})
+
+	search := func(search model.MessageSearch) []model.MessageSearchResult {
+		t.Helper()
+		results, err := srv.SearchMessages(search)
+		if err != nil {
+			t.Fatalf("SearchMessages(%+v) returned error: %v", search, err)
+		}
+		return results
+	}
+	idsOf := func(results []model.MessageSearchResult) string {
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.Message.MessageId)
+		}
+		return strings.Join(ids, ",")
+	}
+	expect := func(name string, results []model.MessageSearchResult, ids ...string) {
+		t.Helper()
+		if got, want := idsOf(results), strings.Join(ids, ","); got != want {
+			t.Errorf("%s found messages %q, want %q", name, got, want)
+		}
+	}
+
+	expect("search", search(model.MessageSearch{Query: word, UserId: alice.Id}), long, direct, rollback, deploy)
+	expect("every word", search(model.MessageSearch{Query: "DEPLOY " + word, UserId: alice.Id}), rollback, deploy)
+	expect("sender filter", search(model.MessageSearch{Query: word, UserId: alice.Id, SenderId: bob.Id}), direct, rollback)
+	expect("room filter", search(model.MessageSearch{Query: word, UserId: alice.Id, ChatRoomId: roomId}), rollback, deploy)
+	expect("all rooms", search(model.MessageSearch{Query: word, UserId: alice.Id, AllRooms: true}), long, direct, hidden, rollback, deploy)
+	expect("limit", search(model.MessageSearch{Query: word, UserId: alice.Id, Limit: 2}), long, direct)
+	expect("date range", search(model.MessageSearch{Query: word, UserId: alice.Id, ChatRoomId: roomId,
+		From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}), rollback, deploy)
+	expect("future", search(model.MessageSearch{Query: word, UserId: alice.Id, From: time.Now().Add(time.Hour)}))
+	expect("past", search(model.MessageSearch{Query: word, UserId: alice.Id, To: time.Now().Add(-time.Hour)}))
+	expect("missing word", search(model.MessageSearch{Query: word + " nonexistent", UserId: alice.Id}))
+
+	results := search(model.MessageSearch{Query: "deploy " + word, UserId: alice.Id, ChatRoomId: roomId})
+	if want := "<mark>Deploy</mark> the <mark>" + word + "</mark> service &lt;today&gt;"; len(results) != 2 || results[1].Snippet != want {
+		t.Fatalf("snippet = %+v, want %q", results, want)
+	}
+	results = search(model.MessageSearch{Query: word, UserId: bob.Id, SenderId: alice.Id})
+	if len(results) != 2 || !strings.HasPrefix(results[0].Snippet, "…") || !strings.HasSuffix(results[0].Snippet, "…") ||
+		!strings.Contains(results[0].Snippet, "<mark>"+word+"</mark>") {
+		t.Fatalf("expected a shortened snippet around the match, got %+v", results)
+	}
+
+	if _, err := srv.SearchMessages(model.MessageSearch{Query: " !? ", UserId: alice.Id}); err != database.ErrNoSearchTerms {
+		t.Fatalf("SearchMessages() without words returned %v, want ErrNoSearchTerms", err)
+	}
+
+	// Members that left a room no longer find its messages, and deleted
+	// messages are gone from the index.
+	if err := srv.RemoveRoomMember(roomId, bob.Id); err != nil {
+		t.Fatalf("RemoveRoomMember() returned error: %v", err)
+	}
+	expect("after leaving", search(model.MessageSearch{Query: word + " deploy", UserId: bob.Id}))
+	if err := srv.DeleteChatRoom(roomId); err != nil {
+		t.Fatalf("DeleteChatRoom() returned error: %v", err)
+	}
+	expect("after deleting the room", search(model.MessageSearch{Query: word, UserId: alice.Id, AllRooms: true}), long, direct, hidden)
+}
+
+func testMessageEdits(t *testing.T, srv database.Service) {
+	author := CreateUser(t, srv)
+	moderator := CreateUser(t, srv)
+	roomId := CreateOwnedChatRoom(t, srv, author.Id)
+
+	created, err := srv.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: author.Id, Content: "frist draft"})
+	if err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+	if created.Edited_at != "" || created.Deleted_at != "" {
+		t.Fatalf("expected a new message to be unedited, got %+v", created)
+	}
+
+	edited, err := srv.UpdateMessage(created.MessageId, "first draft", author.Id)
+	if err != nil {
+		t.Fatalf("UpdateMessage() returned error: %v", err)
+	}
+	if edited.Content != "first draft" || edited.Edited_at == "" || edited.Created_at != created.Created_at {
+		t.Fatalf("UpdateMessage() = %+v", edited)
+	}
+	if stored, err := srv.GetMessage(created.MessageId); err != nil || !reflect.DeepEqual(stored, edited) {
+		t.Fatalf("GetMessage() = %+v, %v; want %+v", stored, err, edited)
+	}
+	word := uniqueWord()
+	if _, err := srv.UpdateMessage(created.MessageId, "final "+word, author.Id); err != nil {
+		t.Fatalf("UpdateMessage() returned error: %v", err)
+	}
+	if results, _ := srv.SearchMessages(model.MessageSearch{Query: word, UserId: author.Id}); len(results) != 1 {
+		t.Fatalf("expected search to find the edited content, got %+v", results)
+	}
+
+	deleted, err := srv.DeleteMessage(created.MessageId, moderator.Id)
+	if err != nil {
+		t.Fatalf("DeleteMessage() returned error: %v", err)
+	}
+	if deleted.Content != "" || deleted.Deleted_at == "" {
+		t.Fatalf("DeleteMessage() = %+v, want a tombstone", deleted)
+	}
+	messages, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{})
+	if err != nil || len(messages) != 1 || messages[0].Deleted_at == "" {
+		t.Fatalf("expected the tombstone to stay in the history, got %+v, %v", messages, err)
+	}
+	if results, _ := srv.SearchMessages(model.MessageSearch{Query: word, UserId: author.Id}); len(results) != 0 {
+		t.Fatalf("expected search not to find deleted messages, got %+v", results)
+	}
+	if _, err := srv.UpdateMessage(created.MessageId, "again", author.Id); err != database.ErrMessageDeleted {
+		t.Fatalf("UpdateMessage() of a tombstone returned %v, want ErrMessageDeleted", err)
+	}
+	if _, err := srv.DeleteMessage(created.MessageId, author.Id); err != database.ErrMessageDeleted {
+		t.Fatalf("DeleteMessage() of a tombstone returned %v, want ErrMessageDeleted", err)
+	}
+
+	revisions, err := srv.GetMessageRevisions(created.MessageId)
+	if err != nil {
+		t.Fatalf("GetMessageRevisions() returned error: %v", err)
+	}
+	var contents []string
+	for _, revision := range revisions {
+		contents = append(contents, revision.Content)
+		if revision.MessageId != created.MessageId || revision.Created_at == "" {
+			t.Fatalf("incomplete revision %+v", revision)
+		}
+	}
+	if got, want := strings.Join(contents, "|"), "frist draft|first draft|final "+word; got != want {
+		t.Fatalf("revisions = %q, want %q", got, want)
+	}
+	if revisions[0].EditedBy != author.Id || revisions[2].EditedBy != moderator.Id {
+		t.Fatalf("revisions do not record their editors: %+v", revisions)
+	}
+
+	if _, err := srv.GetMessage("999999999"); err == nil {
+		t.Fatalf("expected GetMessage() of a missing message to fail")
+	}
+	if _, err := srv.UpdateMessage("999999999", "x", author.Id); err == nil || err == database.ErrMessageDeleted {
+		t.Fatalf("UpdateMessage() of a missing message returned %v", err)
+	}
+}
+
+func testReactions(t *testing.T, srv database.Service) {
+	alice := CreateUser(t, srv)
+	bob := CreateUser(t, srv)
+	carol := CreateUser(t, srv)
+	roomId := CreateOwnedChatRoom(t, srv, alice.Id)
+	first, err := srv.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: alice.Id, Content: "lunch?"})
+	if err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+	second, err := srv.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: carol.Id, Content: "pizza"})
+	if err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+
+	add := func(message model.Message, user model.User, emoji string) {
+		t.Helper()
+		if err := srv.AddReaction(message.MessageId, user.Id, emoji); err != nil {
+			t.Fatalf("AddReaction(%s, %s) returned error: %v", user.UserName, emoji, err)
+		}
+	}
+	add(first, alice, "👍")
+	if err := srv.AddReaction(first.MessageId, alice.Id, "👍"); err != database.ErrReactionExists {
+		t.Fatalf("expected a duplicate reaction to return ErrReactionExists, got %v", err)
+	}
+	add(first, bob, "❤️")
+	add(first, bob, "👍")
+	add(second, carol, "🎉")
+	if err := srv.AddReaction("999999999", alice.Id, "👍"); err == nil || err == database.ErrReactionExists {
+		t.Fatalf("expected reacting to a missing message to fail, got %v", err)
+	}
+	if err := srv.RemoveReaction(first.MessageId, carol.Id, "👍"); err == nil {
+		t.Fatalf("expected removing a missing reaction to fail")
+	}
+
+	expect := func(viewer model.User, want map[string][]model.Reaction) {
+		t.Helper()
+		got, err := srv.GetReactions([]string{first.MessageId, second.MessageId}, viewer.Id)
+		if err != nil {
+			t.Fatalf("GetReactions() returned error: %v", err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("GetReactions() as %s = %+v, want %+v", viewer.UserName, got, want)
+		}
+		for messageId, reactions := range want {
+			if !reflect.DeepEqual(got[messageId], reactions) {
+				t.Fatalf("GetReactions() as %s = %+v, want %+v", viewer.UserName, got, want)
+			}
+		}
+	}
+	// Emoji are in the order they were first used on each message.
+	expect(alice, map[string][]model.Reaction{
+		first.MessageId:  {{Emoji: "👍", Count: 2, ReactedByMe: true}, {Emoji: "❤️", Count: 1}},
+		second.MessageId: {{Emoji: "🎉", Count: 1}},
+	})
+	expect(bob, map[string][]model.Reaction{
+		first.MessageId:  {{Emoji: "👍", Count: 2, ReactedByMe: true}, {Emoji: "❤️", Count: 1, ReactedByMe: true}},
+		second.MessageId: {{Emoji: "🎉", Count: 1}},
+	})
+	if reactions, err := srv.GetReactions(nil, alice.Id); err != nil || len(reactions) != 0 {
+		t.Fatalf("GetReactions(nil) = %+v, %v", reactions, err)
+	}
+
+	// Bob's 👍 came after his ❤️, so 👍 moves back once it is his alone.
+	if err := srv.RemoveReaction(first.MessageId, alice.Id, "👍"); err != nil {
+		t.Fatalf("RemoveReaction() returned error: %v", err)
+	}
+	if err := srv.RemoveReaction(first.MessageId, alice.Id, "👍"); err == nil {
+		t.Fatalf("expected removing a reaction twice to fail")
+	}
+	expect(alice, map[string][]model.Reaction{
+		first.MessageId:  {{Emoji: "❤️", Count: 1}, {Emoji: "👍", Count: 1}},
+		second.MessageId: {{Emoji: "🎉", Count: 1}},
+	})
+
+	// Deleting a user takes their reactions, deleting the room its messages'.
+	if err := srv.DeleteUser(bob.Id); err != nil {
+		t.Fatalf("DeleteUser() returned error: %v", err)
+	}
+	expect(alice, map[string][]model.Reaction{
+		second.MessageId: {{Emoji: "🎉", Count: 1}},
+	})
+	if err := srv.DeleteChatRoom(roomId); err != nil {
+		t.Fatalf("DeleteChatRoom() returned error: %v", err)
+	}
+	expect(alice, map[string][]model.Reaction{})
+}
+
+func testThreads(t *testing.T, srv database.Service) {
+	author := CreateUser(t, srv)
+	replier := CreateUser(t, srv)
+	roomId := CreateOwnedChatRoom(t, srv, author.Id)
+	otherRoomId := CreateOwnedChatRoom(t, srv, author.Id)
+
+	send := func(message model.Message) model.Message {
+		t.Helper()
+		created, err := srv.CreateMessage(message)
+		if err != nil {
+			t.Fatalf("CreateMessage(%+v) returned error: %v", message, err)
+		}
+		return created
+	}
+	parent := send(model.Message{ChatRoomId: roomId, Sender_Id: author.Id, Content: "question"})
+	first := send(model.Message{ChatRoomId: roomId, ParentMessageId: parent.MessageId, Sender_Id: replier.Id, Content: "answer"})
+	last := send(model.Message{ChatRoomId: roomId, ParentMessageId: parent.MessageId, Sender_Id: author.Id, Content: "thanks"})
+	if first.ParentMessageId != parent.MessageId {
+		t.Fatalf("CreateMessage() = %+v, want a reply to %s", first, parent.MessageId)
+	}
+
+	history, err := srv.GetMessagesForChatRoom(roomId, model.MessagePage{})
+	if err != nil {
+		t.Fatalf("GetMessagesForChatRoom() returned error: %v", err)
+	}
+	if len(history) != 1 || history[0].MessageId != parent.MessageId {
+		t.Fatalf("expected the room history to leave out replies, got %+v", history)
+	}
+	if history[0].ReplyCount != 2 || history[0].Last_reply_at != last.Created_at {
+		t.Fatalf("expected the parent to summarize its thread, got %+v", history[0])
+	}
+	if stored, err := srv.GetMessage(parent.MessageId); err != nil || stored.ReplyCount != 2 {
+		t.Fatalf("GetMessage() = %+v, %v; want 2 replies", stored, err)
+	}
+
+	thread, err := srv.GetThread(parent.MessageId, model.MessagePage{})
+	if err != nil {
+		t.Fatalf("GetThread() returned error: %v", err)
+	}
+	if len(thread) != 2 || thread[0].MessageId != first.MessageId || thread[1].MessageId != last.MessageId {
+		t.Fatalf("GetThread() = %+v, want both replies oldest first", thread)
+	}
+	if thread, _ := srv.GetThread(parent.MessageId, model.MessagePage{Limit: 1}); len(thread) != 1 || thread[0].MessageId != last.MessageId {
+		t.Fatalf("GetThread(limit 1) = %+v, want the newest reply", thread)
+	}
+
+	for name, invalid := range map[string]model.Message{
+		"reply to a reply":    {ChatRoomId: roomId, ParentMessageId: first.MessageId},
+		"reply in other room": {ChatRoomId: otherRoomId, ParentMessageId: parent.MessageId},
+		"direct reply":        {Receiver_Id: replier.Id, ParentMessageId: parent.MessageId},
+		"missing parent":      {ChatRoomId: roomId, ParentMessageId: "999999999"},
+	} {
+		invalid.Sender_Id, invalid.Content = author.Id, "invalid"
+		if _, err := srv.CreateMessage(invalid); err == nil {
+			t.Errorf("expected a %s to be rejected", name)
+		}
+	}
+
+	// Replies go away with their author, and with their parent.
+	if err := srv.DeleteUser(replier.Id); err != nil {
+		t.Fatalf("DeleteUser() returned error: %v", err)
+	}
+	if stored, _ := srv.GetMessage(parent.MessageId); stored.ReplyCount != 1 {
+		t.Fatalf("expected one reply to remain, got %+v", stored)
+	}
+	bystander := CreateUser(t, srv)
+	send(model.Message{ChatRoomId: roomId, ParentMessageId: parent.MessageId, Sender_Id: bystander.Id, Content: "me too"})
+	if err := srv.DeleteUser(author.Id); err != nil {
+		t.Fatalf("DeleteUser() returned error: %v", err)
+	}
+	if thread, _ := srv.GetThread(parent.MessageId, model.MessagePage{}); len(thread) != 0 {
+		t.Fatalf("expected the thread to be deleted with its parent, got %+v", thread)
+	}
+}
+
+func testReadMarkers(t *testing.T, srv database.Service) {
+	reader := CreateUser(t, srv)
+	writer := CreateUser(t, srv)
+	roomId := CreateOwnedChatRoom(t, srv, writer.Id)
+	if err := srv.AddRoomMember(roomId, reader.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+
+	send := func(message model.Message) model.Message {
+		t.Helper()
+		created, err := srv.CreateMessage(message)
+		if err != nil {
+			t.Fatalf("CreateMessage(%+v) returned error: %v", message, err)
+		}
+		return created
+	}
+	unread := func(want ...model.UnreadCount) {
+		t.Helper()
+		counts, err := srv.GetUnreadCounts(reader.Id)
+		if err != nil {
+			t.Fatalf("GetUnreadCounts() returned error: %v", err)
+		}
+		if want == nil {
+			want = []model.UnreadCount{}
+		}
+		if !reflect.DeepEqual(counts, want) {
+			t.Fatalf("GetUnreadCounts() = %+v, want %+v", counts, want)
+		}
+	}
+
+	first := send(model.Message{ChatRoomId: roomId, Sender_Id: writer.Id, Content: "one"})
+	second := send(model.Message{ChatRoomId: roomId, Sender_Id: writer.Id, Content: "two"})
+	send(model.Message{ChatRoomId: roomId, ParentMessageId: first.MessageId, Sender_Id: writer.Id, Content: "reply"})
+	send(model.Message{ChatRoomId: roomId, Sender_Id: reader.Id, Content: "mine"})
+	direct := send(model.Message{Receiver_Id: reader.Id, Sender_Id: writer.Id, Content: "psst"})
+	unread(model.UnreadCount{ChatRoomId: roomId, Unread: 2}, model.UnreadCount{UserId: writer.Id, Unread: 1})
+
+	if err := srv.MarkRoomRead(roomId, reader.Id, first.MessageId); err != nil {
+		t.Fatalf("MarkRoomRead() returned error: %v", err)
+	}
+	unread(model.UnreadCount{ChatRoomId: roomId, Unread: 1}, model.UnreadCount{UserId: writer.Id, Unread: 1})
+
+	if err := srv.MarkRoomRead(roomId, reader.Id, second.MessageId); err != nil {
+		t.Fatalf("MarkRoomRead() returned error: %v", err)
+	}
+	if err := srv.MarkDirectRead(reader.Id, writer.Id, direct.MessageId); err != nil {
+		t.Fatalf("MarkDirectRead() returned error: %v", err)
+	}
+	unread()
+
+	// Markers never move back, and deleted messages are not unread.
+	if err := srv.MarkRoomRead(roomId, reader.Id, first.MessageId); err != nil {
+		t.Fatalf("MarkRoomRead() returned error: %v", err)
+	}
+	deleted := send(model.Message{ChatRoomId: roomId, Sender_Id: writer.Id, Content: "oops"})
+	if _, err := srv.DeleteMessage(deleted.MessageId, writer.Id); err != nil {
+		t.Fatalf("DeleteMessage() returned error: %v", err)
+	}
+	unread()
+
+	send(model.Message{ChatRoomId: roomId, Sender_Id: writer.Id, Content: "three"})
+	unread(model.UnreadCount{ChatRoomId: roomId, Unread: 1})
+
+	if err := srv.MarkRoomRead("999999999", reader.Id, first.MessageId); err == nil {
+		t.Fatal("expected marking a missing chat room read to fail")
+	}
+	if err := srv.DeleteChatRoom(roomId); err != nil {
+		t.Fatalf("DeleteChatRoom() returned error: %v", err)
+	}
+	unread()
+}
+
+func testPresence(t *testing.T, srv database.Service) {
+	user := CreateUser(t, srv)
+	roommate := CreateUser(t, srv)
+	correspondent := CreateUser(t, srv)
+	stranger := CreateUser(t, srv)
+	roomId := CreateOwnedChatRoom(t, srv, user.Id)
+	if err := srv.AddRoomMember(roomId, roommate.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+	if _, err := srv.CreateMessage(model.Message{Sender_Id: correspondent.Id, Receiver_Id: user.Id, Content: "hi"}); err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+
+	contacts, err := srv.GetContacts(user.Id)
+	if err != nil {
+		t.Fatalf("GetContacts() returned error: %v", err)
+	}
+	if !reflect.DeepEqual(contacts, []string{roommate.Id, correspondent.Id}) {
+		t.Fatalf("GetContacts() = %v, want [%s %s]", contacts, roommate.Id, correspondent.Id)
+	}
+	if contacts, _ := srv.GetContacts(stranger.Id); len(contacts) != 0 {
+		t.Fatalf("GetContacts() = %v for a user without rooms or messages", contacts)
+	}
+
+	if lastSeen, err := srv.GetLastSeen([]string{user.Id}); err != nil || lastSeen[user.Id] != "" {
+		t.Fatalf("GetLastSeen() = %v, %v; want an empty time before the first connection", lastSeen, err)
+	}
+	if err := srv.UpdateLastSeen(user.Id); err != nil {
+		t.Fatalf("UpdateLastSeen() returned error: %v", err)
+	}
+	lastSeen, err := srv.GetLastSeen([]string{user.Id, stranger.Id, "999999999"})
+	if err != nil {
+		t.Fatalf("GetLastSeen() returned error: %v", err)
+	}
+	if len(lastSeen) != 2 || lastSeen[user.Id] == "" || lastSeen[stranger.Id] != "" {
+		t.Fatalf("GetLastSeen() = %v, want times for the two existing users", lastSeen)
+	}
+	if stored, err := srv.GetAUserv2(user.Id); err != nil || stored.Last_seen_at != lastSeen[user.Id] {
+		t.Fatalf("GetAUserv2() = %+v, %v; want Last_seen_at %s", stored, err, lastSeen[user.Id])
+	}
+	if err := srv.UpdateLastSeen("999999999"); err == nil {
+		t.Fatal("expected updating a missing user to fail")
+	}
+}
+
+// timeLayout is the format of every timestamp a driver returns, the way
+// MySQL renders DATETIME columns.
+const timeLayout = "2006-01-02 15:04:05"
+
+func testTimestamps(t *testing.T, srv database.Service) {
+	user := CreateUser(t, srv)
+	if err := srv.UpdateLastSeen(user.Id); err != nil {
+		t.Fatalf("UpdateLastSeen() returned error: %v", err)
+	}
+	roomId := CreateOwnedChatRoom(t, srv, user.Id)
+	parent, err := srv.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: user.Id, Content: "parent"})
+	if err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+	if _, err := srv.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: user.Id, ParentMessageId: parent.MessageId, Content: "reply"}); err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+	if _, err := srv.UpdateMessage(parent.MessageId, "edited", user.Id); err != nil {
+		t.Fatalf("UpdateMessage() returned error: %v", err)
+	}
+	deleted, err := srv.DeleteMessage(parent.MessageId, user.Id)
+	if err != nil {
+		t.Fatalf("DeleteMessage() returned error: %v", err)
+	}
+
+	stored, err := srv.GetAUserv2(user.Id)
+	if err != nil {
+		t.Fatalf("GetAUserv2() returned error: %v", err)
+	}
+	room, err := srv.GetChatRoom(roomId)
+	if err != nil {
+		t.Fatalf("GetChatRoom() returned error: %v", err)
+	}
+	members, err := srv.GetRoomMembers(roomId)
+	if err != nil || len(members) != 1 {
+		t.Fatalf("GetRoomMembers() = %+v, %v", members, err)
+	}
+	revisions, err := srv.GetMessageRevisions(parent.MessageId)
+	if err != nil || len(revisions) == 0 {
+		t.Fatalf("GetMessageRevisions() = %+v, %v", revisions, err)
+	}
+	lastSeen, err := srv.GetLastSeen([]string{user.Id})
+	if err != nil {
+		t.Fatalf("GetLastSeen() returned error: %v", err)
+	}
+
+	for name, value := range map[string]string{
+		"user created_at":       stored.Created_at,
+		"user updated_at":       stored.Upated_at,
+		"user last_seen_at":     stored.Last_seen_at,
+		"GetLastSeen":           lastSeen[user.Id],
+		"chat room created_at":  room.Created_at,
+		"member joined_at":      members[0].Joined_at,
+		"message created_at":    deleted.Created_at,
+		"message edited_at":     deleted.Edited_at,
+		"message deleted_at":    deleted.Deleted_at,
+		"message last_reply_at": deleted.Last_reply_at,
+		"revision created_at":   revisions[0].Created_at,
+	} {
+		if _, err := time.Parse(timeLayout, value); err != nil {
+			t.Errorf("expected %s in the format %q, got %q", name, timeLayout, value)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package databasetest
+
+import (
+	"chat-app/internal/database"
+	"chat-app/internal/logging"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMemory(t *testing.T) {
+	Run(t, func(t *testing.T) database.Service {
+		srv, err := database.Open("memory", logging.Discard())
+		if err != nil {
+			t.Fatalf("Open(memory) returned error: %v", err)
+		}
+		return srv
+	})
+}
+
+func TestSQLite(t *testing.T) {
+	Run(t, openSQLite)
+}
+
+func openSQLite(t *testing.T) database.Service {
+	t.Helper()
+	t.Setenv("DB_SQLITE_PATH", filepath.Join(t.TempDir(), "chat.db"))
+	t.Setenv("DB_AUTO_MIGRATE", "true")
+
+	srv, err := database.Open("sqlite", logging.Discard())
+	if err != nil {
+		t.Fatalf("Open(sqlite) returned error: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func TestTracedSQLite(t *testing.T) {
+	Run(t, func(t *testing.T) database.Service {
+		return database.Traced(openSQLite(t), "sqlite", sdktrace.NewTracerProvider())
+	})
+}
+
+func TestTracedSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	srv := database.Traced(openSQLite(t), "sqlite", provider)
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	user := CreateUser(t, srv.WithContext(ctx))
+	if err := srv.WithContext(ctx).UpdateLastSeen(user.Id); err != nil {
+		t.Fatalf("UpdateLastSeen() returned error: %v", err)
+	}
+	if _, err := srv.WithContext(ctx).GetUserByUserName("nobody"); err == nil {
+		t.Fatal("GetUserByUserName(nobody) returned no error")
+	}
+	parent.End()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	attributes := func(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+		values := map[attribute.Key]attribute.Value{}
+		for _, kv := range span.Attributes() {
+			values[kv.Key] = kv.Value
+		}
+		return values
+	}
+
+	for _, name := range []string{"database.CreateUser", "database.UpdateLastSeen"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("no %s span among %v", name, spans)
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of the request", name)
+		}
+		values := attributes(span)
+		if got := values["db.system"].AsString(); got != "sqlite" {
+			t.Errorf("%s db.system = %q, want sqlite", name, got)
+		}
+		if got := values["db.rows_affected"].AsInt64(); got != 1 {
+			t.Errorf("%s db.rows_affected = %d, want 1", name, got)
+		}
+	}
+
+	missing, ok := spans["database.GetUserByUserName"]
+	if !ok {
+		t.Fatal("no database.GetUserByUserName span")
+	}
+	if missing.Status().Code == codes.Error {
+		t.Errorf("a missing user marked the span as failed: %v", missing.Status())
+	}
+	if _, ok := attributes(missing)["db.rows_affected"]; ok {
+		t.Error("a query recorded db.rows_affected")
+	}
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Driver opens a new Service for one storage backend that logs to logger.
+type Driver func(logger *slog.Logger) (Service, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver)
+)
+
+// Register makes a storage driver available under the given name. It panics
+// if the name is registered twice or the driver is nil.
+func Register(name string, driver Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if driver == nil {
+		panic("database: Register driver is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("database: Register called twice for driver " + name)
+	}
+	drivers[name] = driver
+}
+
+// Drivers returns the sorted names of the registered storage drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open returns a new, unshared Service from the named driver, logging to
+// logger.
+func Open(name string, logger *slog.Logger) (Service, error) {
+	driversMu.RLock()
+	driver, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown database driver %q (registered: %v)", name, Drivers())
+	}
+	return driver(logger)
+}
+
+// DriverName returns the driver selected by DB_DRIVER, defaulting to mysql.
+func DriverName() string {
+	if name := os.Getenv("DB_DRIVER"); name != "" {
+		return name
+	}
+	return "mysql"
+}
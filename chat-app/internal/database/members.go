@@ -0,0 +1,105 @@
+package database
+
+import (
+	model "chat-app/internal/Models"
+	"fmt"
+	"sort"
+	"time"
+)
+
+func (s *service) AddRoomMember(chatRoomId string, user_id string, role string) error {
+	_, err := s.exec("INSERT INTO room_members (chatroomid, user_id, role, joined_at) VALUES(?, ?, ?, ?)",
+		chatRoomId, user_id, role, time.Now())
+	return err
+}
+
+func (s *service) RemoveRoomMember(chatRoomId string, user_id string) error {
+	result, err := s.exec("DELETE FROM room_members WHERE chatroomid = ? AND user_id = ?", chatRoomId, user_id)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return fmt.Errorf("user %s is not a member of chatroom %s", user_id, chatRoomId)
+	}
+	return nil
+}
+
+func (s *service) GetRoomMembers(chatRoomId string) ([]model.RoomMember, error) {
+	members := []model.RoomMember{}
+	rows, err := s.query("SELECT room_members.chatroomid, room_members.user_id, user.username, room_members.role, room_members.joined_at "+
+		"FROM room_members JOIN user ON user.id = room_members.user_id WHERE room_members.chatroomid = ? "+
+		"ORDER BY room_members.joined_at, room_members.user_id", chatRoomId)
+	if err != nil {
+		return members, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member model.RoomMember
+		if err := rows.Scan(&member.ChatRoomId, &member.UserId, &member.UserName, &member.Role, timestamp{&member.Joined_at}); err != nil {
+			return members, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (s *memoryService) AddRoomMember(chatRoomId string, user_id string, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findChatRoom(chatRoomId) < 0 {
+		return fmt.Errorf("No Chatroom exists with Id: " + chatRoomId)
+	}
+	if s.findUser(user_id) < 0 {
+		return fmt.Errorf("no user exists with Id: %s", user_id)
+	}
+	if _, ok := s.roomMembers[chatRoomId][user_id]; ok {
+		return fmt.Errorf("user %s is already a member of chatroom %s", user_id, chatRoomId)
+	}
+	s.addMember(chatRoomId, user_id, role)
+	return nil
+}
+
+// addMember records a membership. Callers hold s.mu.
+func (s *memoryService) addMember(chatRoomId string, user_id string, role string) {
+	s.lastId["room_members"]++
+	s.roomMembers[chatRoomId][user_id] = memoryRoomMember{role: role, joinedAt: now(), seq: s.lastId["room_members"]}
+}
+
+func (s *memoryService) RemoveRoomMember(chatRoomId string, user_id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roomMembers[chatRoomId][user_id]; !ok {
+		return fmt.Errorf("user %s is not a member of chatroom %s", user_id, chatRoomId)
+	}
+	delete(s.roomMembers[chatRoomId], user_id)
+	return nil
+}
+
+func (s *memoryService) GetRoomMembers(chatRoomId string) ([]model.RoomMember, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := []model.RoomMember{}
+	order := map[string]int64{}
+	for userId, member := range s.roomMembers[chatRoomId] {
+		var userName string
+		if i := s.findUser(userId); i >= 0 {
+			userName = s.users[i].UserName
+		}
+		members = append(members, model.RoomMember{
+			ChatRoomId: chatRoomId,
+			UserId:     userId,
+			UserName:   userName,
+			Role:       member.role,
+			Joined_at:  member.joinedAt,
+		})
+		order[userId] = member.seq
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return order[members[i].UserId] < order[members[j].UserId]
+	})
+	return members, nil
+}
@@ -0,0 +1,505 @@
+package database
+
+import (
+	model "chat-app/internal/Models"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// timeLayout matches how MySQL renders DATETIME columns. Every driver
+// returns timestamps in this format; see timestamp for the SQL drivers.
+const timeLayout = "2006-01-02 15:04:05"
+
+func init() {
+	Register("memory", func(*slog.Logger) (Service, error) {
+		return newMemoryService(), nil
+	})
+}
+
+type memoryRefreshToken struct {
+	userId    string
+	token     string
+	expiresAt time.Time
+	isValid   bool
+}
+
+// memoryService is a process-local Service used for development and tests.
+// All state is lost when the process exits.
+type memoryService struct {
+	mu sync.RWMutex
+
+	lastId map[string]int64
+
+	users         []model.User
+	chatRooms     []model.ChatRoom
+	messages      []model.Message
+	refreshTokens []memoryRefreshToken
+
+	verificationTokens map[string]memoryVerificationToken
+	// roomMembers maps chat room id to user id to membership.
+	roomMembers map[string]map[string]memoryRoomMember
+	// index is the full-text index of messages.
+	index invertedIndex
+	// revisions maps a message id to its earlier contents, oldest first.
+	revisions map[string][]model.MessageRevision
+	reactions []memoryReaction
+	// roomRead and directRead are the read markers, keyed by chat room id
+	// and by peer id.
+	roomRead   readMarkers
+	directRead readMarkers
+}
+
+func newMemoryService() *memoryService {
+	return &memoryService{
+		lastId:             make(map[string]int64),
+		verificationTokens: make(map[string]memoryVerificationToken),
+		roomMembers:        make(map[string]map[string]memoryRoomMember),
+		index:              make(invertedIndex),
+		revisions:          make(map[string][]model.MessageRevision),
+		roomRead:           make(readMarkers),
+		directRead:         make(readMarkers),
+	}
+}
+
+// nextId mimics AUTO_INCREMENT for the given table. Callers hold s.mu.
+func (s *memoryService) nextId(table string) string {
+	s.lastId[table]++
+	return strconv.FormatInt(s.lastId[table], 10)
+}
+
+func now() string {
+	return time.Now().Format(timeLayout)
+}
+
+func (s *memoryService) findUser(Id string) int {
+	for i := range s.users {
+		if s.users[i].Id == Id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryService) findChatRoom(Id string) int {
+	for i := range s.chatRooms {
+		if s.chatRooms[i].ChatRoomId == Id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryService) Health() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return map[string]string{
+		"status":   "up",
+		"message":  "It's healthy",
+		"users":    strconv.Itoa(len(s.users)),
+		"messages": strconv.Itoa(len(s.messages)),
+	}
+}
+
+func (s *memoryService) CreateRefreshToken(user_id string, refreshTokenString string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findUser(user_id) < 0 {
+		return fmt.Errorf("no user exists with Id: %s", user_id)
+	}
+	s.refreshTokens = append(s.refreshTokens, memoryRefreshToken{
+		userId:    user_id,
+		token:     refreshTokenString,
+		expiresAt: time.Now().Add(time.Hour * 24),
+		isValid:   true,
+	})
+	return nil
+}
+
+func (s *memoryService) GetRefreshToken(refreshTokenString string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, token := range s.refreshTokens {
+		if token.token != refreshTokenString || !token.expiresAt.After(time.Now()) {
+			continue
+		}
+		if !token.isValid {
+			return false, fmt.Errorf("refresh token is not valid")
+		}
+		return true, nil
+	}
+	return false, sql.ErrNoRows
+}
+
+func (s *memoryService) UpdateRefreshToken(refreshTokenString string, user_id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.refreshTokens {
+		if s.refreshTokens[i].token == refreshTokenString && s.refreshTokens[i].userId == user_id {
+			s.refreshTokens[i].isValid = false
+		}
+	}
+	return nil
+}
+
+func (s *memoryService) DeleteRefreshToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.refreshTokens[:0]
+	for _, token := range s.refreshTokens {
+		if token.isValid && !token.expiresAt.Before(time.Now()) {
+			kept = append(kept, token)
+		}
+	}
+	totalDeletedRows := len(s.refreshTokens) - len(kept)
+	s.refreshTokens = kept
+
+	return fmt.Sprint("Invalid Refresh Tokens Deleted: ", totalDeletedRows), nil
+}
+
+func (s *memoryService) CreateUser(user model.User) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.users {
+		if existing.UserName == user.UserName {
+			return "", ErrUsernameTaken
+		}
+	}
+
+	if user.Status == "" {
+		user.Status = model.UserStatusActive
+	}
+	if user.Role == "" {
+		user.Role = model.RoleUser
+	}
+	user.Id = s.nextId("user")
+	user.Created_at = now()
+	user.Upated_at = user.Created_at
+	s.users = append(s.users, user)
+
+	return "User is inserted with ID: " + user.Id, nil
+}
+
+func (s *memoryService) GetAllUsers() ([]model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []model.User{}
+	for _, user := range s.users {
+		users = append(users, model.User{UserName: user.UserName, Name: user.Name, Email: user.Email})
+	}
+	return users, nil
+}
+
+func (s *memoryService) GetUserByUserName(userName string) (model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.UserName == userName {
+			return user, nil
+		}
+	}
+	return model.User{}, sql.ErrNoRows
+}
+
+func (s *memoryService) GetAUserv2(Id string) (model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.findUser(Id)
+	if i < 0 {
+		return model.User{}, sql.ErrNoRows
+	}
+	return s.users[i], nil
+}
+
+func (s *memoryService) UpdateUserPassword(Id string, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := s.findUser(Id); i >= 0 {
+		s.users[i].Password = password
+		s.users[i].Upated_at = now()
+	}
+	return nil
+}
+
+func (s *memoryService) UpdateUserDetails(Id string, user model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := s.findUser(Id); i >= 0 {
+		s.users[i].Email = user.Email
+		s.users[i].Name = user.Name
+		s.users[i].Upated_at = now()
+	}
+	return nil
+}
+
+func (s *memoryService) DeleteUser(Id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findUser(Id)
+	if i < 0 {
+		return fmt.Errorf("No User exists with Id: " + Id)
+	}
+	s.users = append(s.users[:i], s.users[i+1:]...)
+
+	// Mirror the ON DELETE CASCADE foreign keys of the SQL schema.
+	s.removeMessages(func(message model.Message) bool {
+		return message.Sender_Id == Id || message.Receiver_Id == Id
+	})
+	s.removeReactions(func(reaction memoryReaction) bool {
+		return reaction.userId == Id
+	})
+	delete(s.roomRead, Id)
+	delete(s.directRead, Id)
+	s.directRead.forget(Id)
+	for _, revisions := range s.revisions {
+		for i := range revisions {
+			if revisions[i].EditedBy == Id {
+				revisions[i].EditedBy = ""
+			}
+		}
+	}
+
+	tokens := s.refreshTokens[:0]
+	for _, token := range s.refreshTokens {
+		if token.userId != Id {
+			tokens = append(tokens, token)
+		}
+	}
+	s.refreshTokens = tokens
+
+	for hash, token := range s.verificationTokens {
+		if token.userId == Id {
+			delete(s.verificationTokens, hash)
+		}
+	}
+	for _, members := range s.roomMembers {
+		delete(members, Id)
+	}
+	return nil
+}
+
+func (s *memoryService) CreateChatRoom(chatRoom model.ChatRoom) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if chatRoom.OwnerId != "" && s.findUser(chatRoom.OwnerId) < 0 {
+		return "", fmt.Errorf("no user exists with Id: %s", chatRoom.OwnerId)
+	}
+
+	chatRoom.ChatRoomId = s.nextId("chatroom")
+	chatRoom.Created_at = now()
+	chatRoom.Upated_at = chatRoom.Created_at
+	s.roomMembers[chatRoom.ChatRoomId] = make(map[string]memoryRoomMember)
+	if chatRoom.OwnerId != "" {
+		s.addMember(chatRoom.ChatRoomId, chatRoom.OwnerId, model.RoomRoleOwner)
+	}
+	// OwnerId is derived from the memberships when the room is read.
+	chatRoom.OwnerId = ""
+	s.chatRooms = append(s.chatRooms, chatRoom)
+
+	return "ChatRoom is created with ID: " + chatRoom.ChatRoomId, nil
+}
+
+func (s *memoryService) DeleteChatRoom(Id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findChatRoom(Id)
+	if i < 0 {
+		return fmt.Errorf("No Chatroom exists with Id: " + Id)
+	}
+	s.chatRooms = append(s.chatRooms[:i], s.chatRooms[i+1:]...)
+	delete(s.roomMembers, Id)
+	s.roomRead.forget(Id)
+
+	s.removeMessages(func(message model.Message) bool {
+		return message.ChatRoomId == Id
+	})
+	return nil
+}
+
+// removeMessages deletes the messages matching remove together with their
+// replies, revisions, reactions and index entries. Replies always follow
+// their parent in s.messages. Callers hold s.mu.
+func (s *memoryService) removeMessages(remove func(model.Message) bool) {
+	removed := make(map[string]bool)
+	messages := s.messages[:0]
+	for _, message := range s.messages {
+		if remove(message) || removed[message.ParentMessageId] {
+			removed[message.MessageId] = true
+			s.index.remove(message)
+			delete(s.revisions, message.MessageId)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	s.messages = messages
+	s.removeReactions(func(reaction memoryReaction) bool {
+		return removed[reaction.messageId]
+	})
+}
+
+func (s *memoryService) GetAllChatRoom() ([]model.ChatRoom, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var chatRooms []model.ChatRoom
+	for _, chatRoom := range s.chatRooms {
+		chatRoom.OwnerId = s.roomOwner(chatRoom.ChatRoomId)
+		chatRooms = append(chatRooms, chatRoom)
+	}
+	return chatRooms, nil
+}
+
+func (s *memoryService) GetChatRoom(Id string) (model.ChatRoom, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.findChatRoom(Id)
+	if i < 0 {
+		return model.ChatRoom{}, sql.ErrNoRows
+	}
+	chatRoom := s.chatRooms[i]
+	chatRoom.OwnerId = s.roomOwner(Id)
+	return chatRoom, nil
+}
+
+func (s *memoryService) CreateMessage(message model.Message) (model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	direct := message.Receiver_Id != "" && message.ChatRoomId == ""
+	room := message.ChatRoomId != "" && message.Receiver_Id == ""
+	if !direct && !room {
+		return model.Message{}, fmt.Errorf("there cannot have both chatroomid and receiver_id in the body")
+	}
+	if s.findUser(message.Sender_Id) < 0 {
+		return model.Message{}, fmt.Errorf("no user exists with Id: %s", message.Sender_Id)
+	}
+	if direct && s.findUser(message.Receiver_Id) < 0 {
+		return model.Message{}, fmt.Errorf("no user exists with Id: %s", message.Receiver_Id)
+	}
+	if room && s.findChatRoom(message.ChatRoomId) < 0 {
+		return model.Message{}, fmt.Errorf("No Chatroom exists with Id: %s", message.ChatRoomId)
+	}
+	if direct && message.ParentMessageId != "" {
+		return model.Message{}, fmt.Errorf("direct messages cannot be replies")
+	}
+	if message.ParentMessageId != "" {
+		i := s.findMessage(message.ParentMessageId)
+		if i < 0 {
+			return model.Message{}, fmt.Errorf("no message exists with Id: %s", message.ParentMessageId)
+		}
+		if err := checkReply(message, s.messages[i]); err != nil {
+			return model.Message{}, err
+		}
+	}
+
+	message.MessageId = s.nextId("message")
+	message.Created_at = now()
+	s.messages = append(s.messages, message)
+	s.index.add(message)
+
+	return message, nil
+}
+
+func (s *memoryService) GetMessagesForChatRoom(chatRoomId string, page model.MessagePage) ([]model.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.messagePage(page, func(message model.Message) bool {
+		return message.ChatRoomId == chatRoomId && message.ParentMessageId == ""
+	})
+}
+
+func (s *memoryService) GetThread(parentId string, page model.MessagePage) ([]model.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.messagePage(page, func(message model.Message) bool {
+		return message.ParentMessageId == parentId
+	})
+}
+
+// summarizeThreads fills in the reply count and last reply time of messages.
+// Callers hold s.mu.
+func (s *memoryService) summarizeThreads(messages []model.Message) {
+	threads := make(map[string]*model.Message, len(messages))
+	for i := range messages {
+		messages[i].ReplyCount, messages[i].Last_reply_at = 0, ""
+		threads[messages[i].MessageId] = &messages[i]
+	}
+	for _, reply := range s.messages {
+		if parent := threads[reply.ParentMessageId]; parent != nil {
+			parent.ReplyCount++
+			parent.Last_reply_at = reply.Created_at
+		}
+	}
+}
+
+func (s *memoryService) GetMessagesforIndividualChat(senderReceiver map[string]string, page model.MessagePage) ([]model.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sender, receiver := senderReceiver["sender_id"], senderReceiver["receiver_id"]
+	return s.messagePage(page, func(message model.Message) bool {
+		return (message.Sender_Id == sender && message.Receiver_Id == receiver) ||
+			(message.Sender_Id == receiver && message.Receiver_Id == sender)
+	})
+}
+
+// messagePage returns the page of the messages matching match. Messages
+// are stored in id order. Callers hold s.mu.
+func (s *memoryService) messagePage(page model.MessagePage, match func(model.Message) bool) ([]model.Message, error) {
+	before, after, err := parseCursors(page)
+	if err != nil {
+		return nil, err
+	}
+	forward := after > 0 && before == 0
+
+	messages := []model.Message{}
+	for n := 0; n < len(s.messages); n++ {
+		if page.Limit > 0 && len(messages) == page.Limit {
+			break
+		}
+		i := len(s.messages) - 1 - n
+		if forward {
+			i = n
+		}
+		message := s.messages[i]
+		id, _ := strconv.ParseInt(message.MessageId, 10, 64)
+		if (before == 0 || id < before) && (after == 0 || id > after) && match(message) {
+			messages = append(messages, message)
+		}
+	}
+	if forward == page.NewestFirst {
+		reverseMessages(messages)
+	}
+	s.summarizeThreads(messages)
+	return messages, nil
+}
+
+func (s *memoryService) Close() error {
+	return nil
+}
+
+// WithContext returns s: calls to the memory store cannot be canceled.
+func (s *memoryService) WithContext(ctx context.Context) Service {
+	return s
+}
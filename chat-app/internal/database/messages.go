@@ -0,0 +1,158 @@
+package database
+
+import (
+	model "chat-app/internal/Models"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrMessageDeleted is returned when changing a message that was deleted.
+var ErrMessageDeleted = errors.New("message has been deleted")
+
+func (s *service) GetMessage(Id string) (model.Message, error) {
+	rows, err := s.query("SELECT "+messageColumns+" FROM message WHERE messageid = ?", Id)
+	if err != nil {
+		return model.Message{}, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return model.Message{}, err
+	}
+	if len(messages) == 0 {
+		return model.Message{}, sql.ErrNoRows
+	}
+	return messages[0], nil
+}
+
+func (s *service) UpdateMessage(Id string, content string, editorId string) (model.Message, error) {
+	return s.reviseMessage(Id, editorId, "content = ?, edited_at = ?", content, time.Now())
+}
+
+func (s *service) DeleteMessage(Id string, editorId string) (model.Message, error) {
+	return s.reviseMessage(Id, editorId, "content = '', deleted_at = ?", time.Now())
+}
+
+// reviseMessage records the current content of a live message as a revision
+// and then applies the assignments in set to it.
+func (s *service) reviseMessage(Id string, editorId string, set string, args ...interface{}) (model.Message, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return model.Message{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := s.txExec(tx, "INSERT INTO message_revisions (messageid, content, edited_by, created_at) "+
+		"SELECT messageid, content, ?, ? FROM message WHERE messageid = ? AND deleted_at IS NULL", editorId, time.Now(), Id)
+	if err != nil {
+		return model.Message{}, err
+	}
+	if revised, _ := result.RowsAffected(); revised == 0 {
+		// Either there is no such message or it is a tombstone.
+		if _, err := s.GetMessage(Id); err != nil {
+			return model.Message{}, err
+		}
+		return model.Message{}, ErrMessageDeleted
+	}
+	if _, err := s.txExec(tx, "UPDATE message SET "+set+" WHERE messageid = ?", append(args, Id)...); err != nil {
+		return model.Message{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.Message{}, err
+	}
+	return s.GetMessage(Id)
+}
+
+func (s *service) GetMessageRevisions(Id string) ([]model.MessageRevision, error) {
+	revisions := []model.MessageRevision{}
+	rows, err := s.query("SELECT messageid, content, edited_by, created_at FROM message_revisions WHERE messageid = ? ORDER BY id", Id)
+	if err != nil {
+		return revisions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var revision model.MessageRevision
+		var editedBy sql.NullString
+		if err := rows.Scan(&revision.MessageId, &revision.Content, &editedBy, timestamp{&revision.Created_at}); err != nil {
+			return revisions, err
+		}
+		revision.EditedBy = editedBy.String
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+// findMessage returns the index of a message in s.messages, or -1. Callers
+// hold s.mu.
+func (s *memoryService) findMessage(Id string) int {
+	for i := range s.messages {
+		if s.messages[i].MessageId == Id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryService) GetMessage(Id string) (model.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.findMessage(Id)
+	if i < 0 {
+		return model.Message{}, sql.ErrNoRows
+	}
+	message := []model.Message{s.messages[i]}
+	s.summarizeThreads(message)
+	return message[0], nil
+}
+
+func (s *memoryService) UpdateMessage(Id string, content string, editorId string) (model.Message, error) {
+	return s.reviseMessage(Id, editorId, func(message *model.Message) {
+		message.Content = content
+		message.Edited_at = now()
+	})
+}
+
+func (s *memoryService) DeleteMessage(Id string, editorId string) (model.Message, error) {
+	return s.reviseMessage(Id, editorId, func(message *model.Message) {
+		message.Content = ""
+		message.Deleted_at = now()
+	})
+}
+
+// reviseMessage records the current content of a live message as a revision
+// and then applies change to it.
+func (s *memoryService) reviseMessage(Id string, editorId string, change func(*model.Message)) (model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findMessage(Id)
+	if i < 0 {
+		return model.Message{}, sql.ErrNoRows
+	}
+	message := &s.messages[i]
+	if message.Deleted_at != "" {
+		return model.Message{}, ErrMessageDeleted
+	}
+	s.revisions[Id] = append(s.revisions[Id], model.MessageRevision{
+		MessageId:  Id,
+		Content:    message.Content,
+		EditedBy:   editorId,
+		Created_at: now(),
+	})
+	s.index.remove(*message)
+	change(message)
+	s.index.add(*message)
+
+	revised := []model.Message{*message}
+	s.summarizeThreads(revised)
+	return revised[0], nil
+}
+
+func (s *memoryService) GetMessageRevisions(Id string) ([]model.MessageRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]model.MessageRevision{}, s.revisions[Id]...), nil
+}
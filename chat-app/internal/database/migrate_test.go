@@ -0,0 +1,18 @@
+package database
+
+import "testing"
+
+func TestSplitStatements(t *testing.T) {
+	script := "-- comment\nCREATE TABLE a (\n  id INT\n);\n\nDROP TABLE b;\n"
+
+	statements := splitStatements(script)
+	if len(statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d: %q", len(statements), statements)
+	}
+	if statements[0] != "CREATE TABLE a (\n  id INT\n)" {
+		t.Fatalf("expected first statement to keep its lines, got %q", statements[0])
+	}
+	if statements[1] != "DROP TABLE b" {
+		t.Fatalf("expected second statement to be 'DROP TABLE b', got %q", statements[1])
+	}
+}
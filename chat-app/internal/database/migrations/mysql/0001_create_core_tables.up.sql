@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS user (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    password_hash VARCHAR(255) NOT NULL,
+    Name VARCHAR(255) NOT NULL DEFAULT '',
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    UNIQUE KEY uq_user_username (username)
+);
+
+CREATE TABLE IF NOT EXISTS chatroom (
+    chatroomid INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS message (
+    messageid INT AUTO_INCREMENT PRIMARY KEY,
+    chatroomid INT NULL,
+    sender_id INT NOT NULL,
+    receiver_id INT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    CONSTRAINT fk_message_chatroom FOREIGN KEY (chatroomid) REFERENCES chatroom (chatroomid) ON DELETE CASCADE,
+    CONSTRAINT fk_message_sender FOREIGN KEY (sender_id) REFERENCES user (id) ON DELETE CASCADE,
+    CONSTRAINT fk_message_receiver FOREIGN KEY (receiver_id) REFERENCES user (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token VARCHAR(1024) CHARACTER SET ascii NOT NULL,
+    expires_at DATETIME NOT NULL,
+    is_valid BOOLEAN NOT NULL DEFAULT TRUE,
+    KEY idx_refresh_tokens_token (token),
+    CONSTRAINT fk_refresh_tokens_user FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+);
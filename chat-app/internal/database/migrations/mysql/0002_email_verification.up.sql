@@ -0,0 +1,9 @@
+ALTER TABLE user ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active';
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    token_hash CHAR(64) CHARACTER SET ascii NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    CONSTRAINT fk_email_verification_tokens_user FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS room_members;
+
+ALTER TABLE user DROP COLUMN role;
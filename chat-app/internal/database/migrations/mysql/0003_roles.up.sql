@@ -0,0 +1,12 @@
+ALTER TABLE user ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'user';
+
+CREATE TABLE IF NOT EXISTS room_members (
+    chatroomid INT NOT NULL,
+    user_id INT NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    joined_at DATETIME NOT NULL,
+    PRIMARY KEY (chatroomid, user_id),
+    KEY idx_room_members_user (user_id),
+    CONSTRAINT fk_room_members_chatroom FOREIGN KEY (chatroomid) REFERENCES chatroom (chatroomid) ON DELETE CASCADE,
+    CONSTRAINT fk_room_members_user FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+);
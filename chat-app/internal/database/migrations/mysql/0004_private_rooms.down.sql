@@ -0,0 +1 @@
+ALTER TABLE chatroom DROP COLUMN is_private;
@@ -0,0 +1,10 @@
+-- MySQL may have dropped the indexes it created for the foreign keys once
+-- the composite indexes covered them, so make sure single-column indexes
+-- exist before dropping the composite ones.
+CREATE INDEX idx_message_chatroomid ON message (chatroomid);
+
+CREATE INDEX idx_message_sender_id ON message (sender_id);
+
+DROP INDEX idx_message_room ON message;
+
+DROP INDEX idx_message_direct ON message;
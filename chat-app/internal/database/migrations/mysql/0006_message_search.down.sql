@@ -0,0 +1 @@
+ALTER TABLE message DROP INDEX ft_message_content;
@@ -0,0 +1 @@
+ALTER TABLE message ADD FULLTEXT INDEX ft_message_content (content);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS message_revisions;
+
+ALTER TABLE message DROP COLUMN deleted_at, DROP COLUMN edited_at;
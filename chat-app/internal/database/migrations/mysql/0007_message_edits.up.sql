@@ -0,0 +1,12 @@
+ALTER TABLE message ADD COLUMN edited_at DATETIME NULL, ADD COLUMN deleted_at DATETIME NULL;
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    messageid INT NOT NULL,
+    content TEXT NOT NULL,
+    edited_by INT NULL,
+    created_at DATETIME NOT NULL,
+    KEY idx_message_revisions_message (messageid, id),
+    CONSTRAINT fk_message_revisions_message FOREIGN KEY (messageid) REFERENCES message (messageid) ON DELETE CASCADE,
+    CONSTRAINT fk_message_revisions_user FOREIGN KEY (edited_by) REFERENCES user (id) ON DELETE SET NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE message DROP FOREIGN KEY fk_message_parent;
+
+ALTER TABLE message DROP INDEX idx_message_thread, DROP COLUMN parent_message_id;
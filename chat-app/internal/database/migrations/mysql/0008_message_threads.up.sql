@@ -0,0 +1,3 @@
+ALTER TABLE message ADD COLUMN parent_message_id INT NULL,
+    ADD INDEX idx_message_thread (parent_message_id, messageid),
+    ADD CONSTRAINT fk_message_parent FOREIGN KEY (parent_message_id) REFERENCES message (messageid) ON DELETE CASCADE;
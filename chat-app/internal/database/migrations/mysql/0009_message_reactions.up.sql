@@ -0,0 +1,13 @@
+-- Compare emoji byte for byte: general collations treat many of them as
+-- equal.
+CREATE TABLE IF NOT EXISTS message_reactions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    messageid INT NOT NULL,
+    user_id INT NOT NULL,
+    emoji VARCHAR(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+    created_at DATETIME NOT NULL,
+    UNIQUE KEY uq_message_reactions (messageid, emoji, user_id),
+    KEY idx_message_reactions_user (user_id),
+    CONSTRAINT fk_message_reactions_message FOREIGN KEY (messageid) REFERENCES message (messageid) ON DELETE CASCADE,
+    CONSTRAINT fk_message_reactions_user FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS direct_read_markers;
+
+DROP TABLE IF EXISTS room_read_markers;
@@ -0,0 +1,21 @@
+-- messageid is the newest message the user has read. It is not a foreign
+-- key: the marker stays valid when that message is deleted.
+CREATE TABLE IF NOT EXISTS room_read_markers (
+    user_id INT NOT NULL,
+    chatroomid INT NOT NULL,
+    messageid INT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, chatroomid),
+    CONSTRAINT fk_room_read_markers_user FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
+    CONSTRAINT fk_room_read_markers_chatroom FOREIGN KEY (chatroomid) REFERENCES chatroom (chatroomid) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS direct_read_markers (
+    user_id INT NOT NULL,
+    peer_id INT NOT NULL,
+    messageid INT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, peer_id),
+    CONSTRAINT fk_direct_read_markers_user FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
+    CONSTRAINT fk_direct_read_markers_peer FOREIGN KEY (peer_id) REFERENCES user (id) ON DELETE CASCADE
+);
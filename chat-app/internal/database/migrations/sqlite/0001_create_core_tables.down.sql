@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS message;
+DROP TABLE IF EXISTS chatroom;
+DROP TABLE IF EXISTS user;
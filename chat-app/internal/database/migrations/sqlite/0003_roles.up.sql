@@ -0,0 +1,11 @@
+ALTER TABLE user ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'user';
+
+CREATE TABLE IF NOT EXISTS room_members (
+    chatroomid INTEGER NOT NULL REFERENCES chatroom (chatroomid) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES user (id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL,
+    joined_at DATETIME NOT NULL,
+    PRIMARY KEY (chatroomid, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_room_members_user ON room_members (user_id);
@@ -0,0 +1 @@
+ALTER TABLE chatroom ADD COLUMN is_private BOOLEAN NOT NULL DEFAULT 0;
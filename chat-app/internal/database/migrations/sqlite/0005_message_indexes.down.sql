@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_message_direct;
+
+DROP INDEX IF EXISTS idx_message_room;
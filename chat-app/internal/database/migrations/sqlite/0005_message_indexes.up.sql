@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS idx_message_room ON message (chatroomid, messageid);
+
+CREATE INDEX IF NOT EXISTS idx_message_direct ON message (sender_id, receiver_id, messageid);
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS message_fts_update;
+
+DROP TRIGGER IF EXISTS message_fts_delete;
+
+DROP TRIGGER IF EXISTS message_fts_insert;
+
+DROP TABLE IF EXISTS message_fts;
@@ -0,0 +1,16 @@
+-- message_fts indexes message.content. The triggers keep it in sync,
+-- including rows removed by ON DELETE CASCADE. Statements end at a line
+-- ending in a semicolon, so trigger bodies keep theirs mid-line.
+CREATE VIRTUAL TABLE IF NOT EXISTS message_fts USING fts5(content, content='message', content_rowid='messageid');
+
+INSERT INTO message_fts (rowid, content) SELECT messageid, content FROM message;
+
+CREATE TRIGGER IF NOT EXISTS message_fts_insert AFTER INSERT ON message BEGIN
+    INSERT INTO message_fts (rowid, content) VALUES (new.messageid, new.content); END;
+
+CREATE TRIGGER IF NOT EXISTS message_fts_delete AFTER DELETE ON message BEGIN
+    INSERT INTO message_fts (message_fts, rowid, content) VALUES ('delete', old.messageid, old.content); END;
+
+CREATE TRIGGER IF NOT EXISTS message_fts_update AFTER UPDATE OF content ON message BEGIN
+    INSERT INTO message_fts (message_fts, rowid, content) VALUES ('delete', old.messageid, old.content); INSERT INTO message_fts (rowid, content)
+    VALUES (new.messageid, new.content); END;
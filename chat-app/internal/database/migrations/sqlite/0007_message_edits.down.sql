@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS message_revisions;
+
+ALTER TABLE message DROP COLUMN deleted_at;
+
+ALTER TABLE message DROP COLUMN edited_at;
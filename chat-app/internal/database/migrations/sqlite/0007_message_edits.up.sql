@@ -0,0 +1,13 @@
+ALTER TABLE message ADD COLUMN edited_at DATETIME NULL;
+
+ALTER TABLE message ADD COLUMN deleted_at DATETIME NULL;
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    messageid INTEGER NOT NULL REFERENCES message (messageid) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    edited_by INTEGER NULL REFERENCES user (id) ON DELETE SET NULL,
+    created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message ON message_revisions (messageid, id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_message_thread;
+
+ALTER TABLE message DROP COLUMN parent_message_id;
@@ -0,0 +1,3 @@
+ALTER TABLE message ADD COLUMN parent_message_id INTEGER NULL REFERENCES message (messageid) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_message_thread ON message (parent_message_id, messageid);
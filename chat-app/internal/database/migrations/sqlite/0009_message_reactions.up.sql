@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS message_reactions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    messageid INTEGER NOT NULL REFERENCES message (messageid) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES user (id) ON DELETE CASCADE,
+    emoji VARCHAR(64) NOT NULL,
+    created_at DATETIME NOT NULL,
+    UNIQUE (messageid, emoji, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_reactions_user ON message_reactions (user_id);
@@ -0,0 +1,17 @@
+-- messageid is the newest message the user has read. It is not a foreign
+-- key: the marker stays valid when that message is deleted.
+CREATE TABLE IF NOT EXISTS room_read_markers (
+    user_id INTEGER NOT NULL REFERENCES user (id) ON DELETE CASCADE,
+    chatroomid INTEGER NOT NULL REFERENCES chatroom (chatroomid) ON DELETE CASCADE,
+    messageid INTEGER NOT NULL,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, chatroomid)
+);
+
+CREATE TABLE IF NOT EXISTS direct_read_markers (
+    user_id INTEGER NOT NULL REFERENCES user (id) ON DELETE CASCADE,
+    peer_id INTEGER NOT NULL REFERENCES user (id) ON DELETE CASCADE,
+    messageid INTEGER NOT NULL,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, peer_id)
+);
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *service) UpdateLastSeen(Id string) error {
+	result, err := s.exec("UPDATE user SET last_seen_at = ? WHERE id = ?", time.Now(), Id)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("no user exists with Id: %s", Id)
+	}
+	return nil
+}
+
+func (s *service) GetLastSeen(Ids []string) (map[string]string, error) {
+	lastSeen := make(map[string]string)
+	if len(Ids) == 0 {
+		return lastSeen, nil
+	}
+
+	args := make([]interface{}, len(Ids))
+	for i, Id := range Ids {
+		args[i] = Id
+	}
+	rows, err := s.query("SELECT id, last_seen_at FROM user WHERE id IN (?"+strings.Repeat(", ?", len(Ids)-1)+")", args...)
+	if err != nil {
+		return lastSeen, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var Id, seen string
+		if err := rows.Scan(&Id, timestamp{&seen}); err != nil {
+			return lastSeen, err
+		}
+		lastSeen[Id] = seen
+	}
+	return lastSeen, rows.Err()
+}
+
+func (s *service) GetContacts(user_id string) ([]string, error) {
+	contacts := []string{}
+	rows, err := s.query("SELECT other.user_id FROM room_members me "+
+		"JOIN room_members other ON other.chatroomid = me.chatroomid WHERE me.user_id = ? AND other.user_id <> ? "+
+		"UNION SELECT receiver_id FROM message WHERE sender_id = ? AND chatroomid IS NULL AND receiver_id <> ? "+
+		"UNION SELECT sender_id FROM message WHERE receiver_id = ? AND chatroomid IS NULL AND sender_id <> ? "+
+		"ORDER BY 1", user_id, user_id, user_id, user_id, user_id, user_id)
+	if err != nil {
+		return contacts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var Id string
+		if err := rows.Scan(&Id); err != nil {
+			return contacts, err
+		}
+		contacts = append(contacts, Id)
+	}
+	return contacts, rows.Err()
+}
+
+func (s *memoryService) UpdateLastSeen(Id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findUser(Id)
+	if i < 0 {
+		return fmt.Errorf("no user exists with Id: %s", Id)
+	}
+	s.users[i].Last_seen_at = now()
+	return nil
+}
+
+func (s *memoryService) GetLastSeen(Ids []string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lastSeen := make(map[string]string)
+	for _, Id := range Ids {
+		if i := s.findUser(Id); i >= 0 {
+			lastSeen[Id] = s.users[i].Last_seen_at
+		}
+	}
+	return lastSeen, nil
+}
+
+func (s *memoryService) GetContacts(user_id string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[string]bool{user_id: true}
+	contacts := []string{}
+	add := func(Id string) {
+		if !seen[Id] {
+			seen[Id] = true
+			contacts = append(contacts, Id)
+		}
+	}
+	for _, members := range s.roomMembers {
+		if _, member := members[user_id]; member {
+			for Id := range members {
+				add(Id)
+			}
+		}
+	}
+	for _, message := range s.messages {
+		if message.ChatRoomId != "" {
+			continue
+		}
+		if message.Sender_Id == user_id {
+			add(message.Receiver_Id)
+		} else if message.Receiver_Id == user_id {
+			add(message.Sender_Id)
+		}
+	}
+	// Ids are numbers, like ORDER BY in SQL.
+	sort.Slice(contacts, func(i, j int) bool {
+		a, _ := strconv.ParseInt(contacts[i], 10, 64)
+		b, _ := strconv.ParseInt(contacts[j], 10, 64)
+		return a < b
+	})
+	return contacts, nil
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	model "chat-app/internal/Models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrReactionExists is returned by AddReaction when the user already reacted
+// to the message with the same emoji.
+var ErrReactionExists = errors.New("reaction already exists")
+
+func (s *service) AddReaction(messageId string, user_id string, emoji string) error {
+	result, err := s.exec("INSERT INTO message_reactions (messageid, user_id, emoji, created_at) SELECT messageid, ?, ?, ? FROM message "+
+		"WHERE messageid = ? AND NOT EXISTS (SELECT 1 FROM message_reactions WHERE messageid = ? AND user_id = ? AND emoji = ?)",
+		user_id, emoji, time.Now(), messageId, messageId, user_id, emoji)
+	if err != nil {
+		return err
+	}
+	if added, _ := result.RowsAffected(); added == 0 {
+		// Either there is no such message or the reaction exists.
+		if _, err := s.GetMessage(messageId); err != nil {
+			return err
+		}
+		return ErrReactionExists
+	}
+	return nil
+}
+
+func (s *service) RemoveReaction(messageId string, user_id string, emoji string) error {
+	result, err := s.exec("DELETE FROM message_reactions WHERE messageid = ? AND user_id = ? AND emoji = ?", messageId, user_id, emoji)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return fmt.Errorf("user %s has not reacted to message %s with %s", user_id, messageId, emoji)
+	}
+	return nil
+}
+
+func (s *service) GetReactions(messageIds []string, user_id string) (map[string][]model.Reaction, error) {
+	reactions := make(map[string][]model.Reaction)
+	if len(messageIds) == 0 {
+		return reactions, nil
+	}
+
+	args := []interface{}{user_id}
+	for _, Id := range messageIds {
+		args = append(args, Id)
+	}
+	rows, err := s.query("SELECT messageid, emoji, COUNT(*), SUM(CASE WHEN user_id = ? THEN 1 ELSE 0 END) FROM message_reactions "+
+		"WHERE messageid IN (?"+strings.Repeat(", ?", len(messageIds)-1)+") GROUP BY messageid, emoji ORDER BY MIN(id)", args...)
+	if err != nil {
+		return reactions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageId string
+		var reaction model.Reaction
+		var mine int
+		if err := rows.Scan(&messageId, &reaction.Emoji, &reaction.Count, &mine); err != nil {
+			return reactions, err
+		}
+		reaction.ReactedByMe = mine > 0
+		reactions[messageId] = append(reactions[messageId], reaction)
+	}
+	return reactions, rows.Err()
+}
+
+type memoryReaction struct {
+	messageId string
+	userId    string
+	emoji     string
+}
+
+func (s *memoryService) AddReaction(messageId string, user_id string, emoji string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findMessage(messageId) < 0 {
+		return sql.ErrNoRows
+	}
+	if s.findUser(user_id) < 0 {
+		return fmt.Errorf("no user exists with Id: %s", user_id)
+	}
+	reaction := memoryReaction{messageId: messageId, userId: user_id, emoji: emoji}
+	for _, existing := range s.reactions {
+		if existing == reaction {
+			return ErrReactionExists
+		}
+	}
+	s.reactions = append(s.reactions, reaction)
+	return nil
+}
+
+func (s *memoryService) RemoveReaction(messageId string, user_id string, emoji string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reaction := memoryReaction{messageId: messageId, userId: user_id, emoji: emoji}
+	for i, existing := range s.reactions {
+		if existing == reaction {
+			s.reactions = append(s.reactions[:i], s.reactions[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("user %s has not reacted to message %s with %s", user_id, messageId, emoji)
+}
+
+func (s *memoryService) GetReactions(messageIds []string, user_id string) (map[string][]model.Reaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	wanted := make(map[string]bool, len(messageIds))
+	for _, Id := range messageIds {
+		wanted[Id] = true
+	}
+	reactions := make(map[string][]model.Reaction)
+	// s.reactions is in the order they were added, like MIN(id) in SQL.
+	for _, reaction := range s.reactions {
+		if !wanted[reaction.messageId] {
+			continue
+		}
+		counts := reactions[reaction.messageId]
+		i := 0
+		for i < len(counts) && counts[i].Emoji != reaction.emoji {
+			i++
+		}
+		if i == len(counts) {
+			counts = append(counts, model.Reaction{Emoji: reaction.emoji})
+		}
+		counts[i].Count++
+		counts[i].ReactedByMe = counts[i].ReactedByMe || reaction.userId == user_id
+		reactions[reaction.messageId] = counts
+	}
+	return reactions, nil
+}
+
+// removeReactions deletes the reactions matching remove. Callers hold s.mu.
+func (s *memoryService) removeReactions(remove func(memoryReaction) bool) {
+	reactions := s.reactions[:0]
+	for _, reaction := range s.reactions {
+		if !remove(reaction) {
+			reactions = append(reactions, reaction)
+		}
+	}
+	s.reactions = reactions
+}
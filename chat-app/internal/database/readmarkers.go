@@ -0,0 +1,173 @@
+package database
+
+import (
+	model "chat-app/internal/Models"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+func (s *service) MarkRoomRead(chatRoomId string, user_id string, messageId string) error {
+	return s.markRead("room_read_markers", "chatroomid", user_id, chatRoomId, messageId)
+}
+
+func (s *service) MarkDirectRead(user_id string, peerId string, messageId string) error {
+	return s.markRead("direct_read_markers", "peer_id", user_id, peerId, messageId)
+}
+
+// markRead moves the marker of user_id for the conversation key forward to
+// messageId, creating it if needed. column names the key in table.
+func (s *service) markRead(table string, column string, user_id string, key string, messageId string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := s.txExec(tx, "UPDATE "+table+" SET messageid = ?, updated_at = ? WHERE user_id = ? AND "+column+" = ? AND messageid < ?",
+		messageId, time.Now(), user_id, key, messageId); err != nil {
+		return err
+	}
+	if _, err := s.txExec(tx, "INSERT INTO "+table+" (user_id, "+column+", messageid, updated_at) SELECT id, ?, ?, ? FROM user "+
+		"WHERE id = ? AND NOT EXISTS (SELECT 1 FROM "+table+" WHERE user_id = ? AND "+column+" = ?)",
+		key, messageId, time.Now(), user_id, user_id, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *service) GetUnreadCounts(user_id string) ([]model.UnreadCount, error) {
+	counts := []model.UnreadCount{}
+
+	rows, err := s.query("SELECT m.chatroomid, COUNT(*) FROM room_members rm "+
+		"JOIN message m ON m.chatroomid = rm.chatroomid "+
+		"LEFT JOIN room_read_markers r ON r.user_id = rm.user_id AND r.chatroomid = rm.chatroomid "+
+		"WHERE rm.user_id = ? AND m.sender_id <> ? AND m.parent_message_id IS NULL AND m.deleted_at IS NULL "+
+		"AND m.messageid > COALESCE(r.messageid, 0) GROUP BY m.chatroomid ORDER BY m.chatroomid", user_id, user_id)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var count model.UnreadCount
+		if err := rows.Scan(&count.ChatRoomId, &count.Unread); err != nil {
+			return counts, err
+		}
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return counts, err
+	}
+
+	rows, err = s.query("SELECT m.sender_id, COUNT(*) FROM message m "+
+		"LEFT JOIN direct_read_markers r ON r.user_id = m.receiver_id AND r.peer_id = m.sender_id "+
+		"WHERE m.receiver_id = ? AND m.chatroomid IS NULL AND m.deleted_at IS NULL "+
+		"AND m.messageid > COALESCE(r.messageid, 0) GROUP BY m.sender_id ORDER BY m.sender_id", user_id)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var count model.UnreadCount
+		if err := rows.Scan(&count.UserId, &count.Unread); err != nil {
+			return counts, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// readMarkers maps a user id to a conversation key to the id of the newest
+// message they have read.
+type readMarkers map[string]map[string]int64
+
+// mark moves a marker forward to messageId.
+func (m readMarkers) mark(user_id string, key string, messageId string) error {
+	Id, err := strconv.ParseInt(messageId, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid message id: %s", messageId)
+	}
+	if m[user_id] == nil {
+		m[user_id] = make(map[string]int64)
+	}
+	m[user_id][key] = max(m[user_id][key], Id)
+	return nil
+}
+
+// unread reports whether message is newer than the marker of user_id for key.
+func (m readMarkers) unread(user_id string, key string, message model.Message) bool {
+	Id, _ := strconv.ParseInt(message.MessageId, 10, 64)
+	return Id > m[user_id][key]
+}
+
+// forget removes every marker for key.
+func (m readMarkers) forget(key string) {
+	for _, markers := range m {
+		delete(markers, key)
+	}
+}
+
+func (s *memoryService) MarkRoomRead(chatRoomId string, user_id string, messageId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findChatRoom(chatRoomId) < 0 {
+		return fmt.Errorf("no chat room exists with Id: %s", chatRoomId)
+	}
+	if s.findUser(user_id) < 0 {
+		return fmt.Errorf("no user exists with Id: %s", user_id)
+	}
+	return s.roomRead.mark(user_id, chatRoomId, messageId)
+}
+
+func (s *memoryService) MarkDirectRead(user_id string, peerId string, messageId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findUser(user_id) < 0 {
+		return fmt.Errorf("no user exists with Id: %s", user_id)
+	}
+	if s.findUser(peerId) < 0 {
+		return fmt.Errorf("no user exists with Id: %s", peerId)
+	}
+	return s.directRead.mark(user_id, peerId, messageId)
+}
+
+func (s *memoryService) GetUnreadCounts(user_id string) ([]model.UnreadCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make(map[string]int)
+	direct := make(map[string]int)
+	for _, message := range s.messages {
+		if message.Sender_Id == user_id || message.ParentMessageId != "" || message.Deleted_at != "" {
+			continue
+		}
+		if message.ChatRoomId != "" {
+			if _, member := s.roomMembers[message.ChatRoomId][user_id]; member && s.roomRead.unread(user_id, message.ChatRoomId, message) {
+				rooms[message.ChatRoomId]++
+			}
+		} else if message.Receiver_Id == user_id && s.directRead.unread(user_id, message.Sender_Id, message) {
+			direct[message.Sender_Id]++
+		}
+	}
+
+	counts := []model.UnreadCount{}
+	for Id, unread := range rooms {
+		counts = append(counts, model.UnreadCount{ChatRoomId: Id, Unread: unread})
+	}
+	for Id, unread := range direct {
+		counts = append(counts, model.UnreadCount{UserId: Id, Unread: unread})
+	}
+	// Rooms first, each group by id like ORDER BY in SQL.
+	sort.Slice(counts, func(i, j int) bool {
+		if (counts[i].ChatRoomId == "") != (counts[j].ChatRoomId == "") {
+			return counts[i].ChatRoomId != ""
+		}
+		a, _ := strconv.ParseInt(counts[i].ChatRoomId+counts[i].UserId, 10, 64)
+		b, _ := strconv.ParseInt(counts[j].ChatRoomId+counts[j].UserId, 10, 64)
+		return a < b
+	})
+	return counts, nil
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	model "chat-app/internal/Models"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ownerIdColumn selects the owner of the chatroom row in scope as a string.
+const ownerIdColumn = "COALESCE((SELECT user_id FROM room_members WHERE room_members.chatroomid = chatroom.chatroomid AND role = 'owner' LIMIT 1), '')"
+
+func (s *service) SetUserRole(Id string, role string) error {
+	result, err := s.exec("UPDATE user SET role = ?, updated_at = ? WHERE id = ?", role, time.Now(), Id)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("No User exists with Id: " + Id)
+	}
+	return nil
+}
+
+func (s *service) GetRoomRole(chatRoomId string, user_id string) (string, error) {
+	var role string
+	err := s.queryRow("SELECT role FROM room_members WHERE chatroomid = ? AND user_id = ?", chatRoomId, user_id).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func (s *service) SetRoomMemberRole(chatRoomId string, user_id string, role string) error {
+	result, err := s.exec("UPDATE room_members SET role = ? WHERE chatroomid = ? AND user_id = ?", role, chatRoomId, user_id)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("user %s is not a member of chatroom %s", user_id, chatRoomId)
+	}
+	return nil
+}
+
+type memoryRoomMember struct {
+	role     string
+	joinedAt string
+	// seq orders members that joined within the same second.
+	seq int64
+}
+
+func (s *memoryService) SetUserRole(Id string, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findUser(Id)
+	if i < 0 {
+		return fmt.Errorf("No User exists with Id: " + Id)
+	}
+	s.users[i].Role = role
+	s.users[i].Upated_at = now()
+	return nil
+}
+
+func (s *memoryService) GetRoomRole(chatRoomId string, user_id string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.roomMembers[chatRoomId][user_id].role, nil
+}
+
+func (s *memoryService) SetRoomMemberRole(chatRoomId string, user_id string, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	member, ok := s.roomMembers[chatRoomId][user_id]
+	if !ok {
+		return fmt.Errorf("user %s is not a member of chatroom %s", user_id, chatRoomId)
+	}
+	member.role = role
+	s.roomMembers[chatRoomId][user_id] = member
+	return nil
+}
+
+// roomOwner returns the owner of a room. Callers hold s.mu.
+func (s *memoryService) roomOwner(chatRoomId string) string {
+	for userId, member := range s.roomMembers[chatRoomId] {
+		if member.role == model.RoomRoleOwner {
+			return userId
+		}
+	}
+	return ""
+}
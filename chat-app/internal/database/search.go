@@ -0,0 +1,299 @@
+package database
+
+import (
+	model "chat-app/internal/Models"
+	"errors"
+	"html"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrNoSearchTerms is returned by SearchMessages for a query without any
+// words to look for.
+var ErrNoSearchTerms = errors.New("search query has no words")
+
+// snippetRadius is how many characters of context a snippet keeps on each
+// side of the first match.
+const snippetRadius = 60
+
+// fullText builds the WHERE condition that keeps the messages containing
+// every term. Each SQL dialect implements it with its own full-text index.
+type fullText func(terms []string) (condition string, args []interface{})
+
+// mysqlFullText uses the FULLTEXT index on message.content. In boolean mode
+// a leading + makes a word required.
+func mysqlFullText(terms []string) (string, []interface{}) {
+	words := make([]string, len(terms))
+	for i, term := range terms {
+		words[i] = `+"` + term + `"`
+	}
+	return "MATCH(content) AGAINST (? IN BOOLEAN MODE)", []interface{}{strings.Join(words, " ")}
+}
+
+// sqliteFullText uses the message_fts table. FTS5 matches rows containing
+// every quoted string of the query.
+func sqliteFullText(terms []string) (string, []interface{}) {
+	words := make([]string, len(terms))
+	for i, term := range terms {
+		words[i] = `"` + term + `"`
+	}
+	return "messageid IN (SELECT rowid FROM message_fts WHERE message_fts MATCH ?)", []interface{}{strings.Join(words, " ")}
+}
+
+func (s *service) SearchMessages(search model.MessageSearch) ([]model.MessageSearchResult, error) {
+	terms := searchTerms(search.Query)
+	if len(terms) == 0 {
+		return nil, ErrNoSearchTerms
+	}
+
+	condition, args := s.fullText(terms)
+	query := "SELECT " + messageColumns + " FROM message WHERE " + condition
+	if search.AllRooms {
+		query += " AND (chatroomid IS NOT NULL"
+	} else {
+		query += " AND (chatroomid IN (SELECT chatroomid FROM room_members WHERE user_id = ?)"
+		args = append(args, search.UserId)
+	}
+	query += " OR (chatroomid IS NULL AND (sender_id = ? OR receiver_id = ?)))"
+	args = append(args, search.UserId, search.UserId)
+
+	if search.SenderId != "" {
+		query += " AND sender_id = ?"
+		args = append(args, search.SenderId)
+	}
+	if search.ChatRoomId != "" {
+		query += " AND chatroomid = ?"
+		args = append(args, search.ChatRoomId)
+	}
+	if !search.From.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, search.From.Local())
+	}
+	if !search.To.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, search.To.Local())
+	}
+	query += " ORDER BY messageid DESC"
+	if search.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, search.Limit)
+	}
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return searchResults(messages, terms), nil
+}
+
+func searchResults(messages []model.Message, terms []string) []model.MessageSearchResult {
+	results := make([]model.MessageSearchResult, len(messages))
+	for i, message := range messages {
+		results[i] = model.MessageSearchResult{Message: message, Snippet: snippet(message.Content, terms)}
+	}
+	return results
+}
+
+// span is the position of one word, in runes.
+type span struct {
+	start, end int
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// words returns the positions of the runs of letters and digits in text.
+func words(text []rune) []span {
+	var spans []span
+	start := -1
+	for i, r := range text {
+		switch {
+		case isWordRune(r) && start < 0:
+			start = i
+		case !isWordRune(r) && start >= 0:
+			spans = append(spans, span{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, span{start, len(text)})
+	}
+	return spans
+}
+
+// searchTerms splits a query into distinct lower-case words. Messages are
+// indexed with the same rules.
+func searchTerms(query string) []string {
+	text := []rune(query)
+	var terms []string
+	seen := make(map[string]bool)
+	for _, word := range words(text) {
+		term := strings.ToLower(string(text[word.start:word.end]))
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// snippet returns an HTML-escaped excerpt of content around its first match
+// with every matched word wrapped in <mark> tags.
+func snippet(content string, terms []string) string {
+	text := []rune(content)
+	isTerm := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		isTerm[term] = true
+	}
+	var matches []span
+	for _, word := range words(text) {
+		if isTerm[strings.ToLower(string(text[word.start:word.end]))] {
+			matches = append(matches, word)
+		}
+	}
+
+	// Keep snippetRadius characters around the first match without cutting
+	// words in half.
+	start, end := 0, len(text)
+	if len(matches) > 0 {
+		start = max(0, matches[0].start-snippetRadius)
+		end = min(len(text), matches[0].end+snippetRadius)
+	} else {
+		end = min(len(text), 2*snippetRadius)
+	}
+	for start > 0 && start < len(text) && isWordRune(text[start-1]) && isWordRune(text[start]) {
+		start++
+	}
+	for end < len(text) && end > 0 && isWordRune(text[end-1]) && isWordRune(text[end]) {
+		end--
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	at := start
+	for _, match := range matches {
+		if match.start < start || match.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(text[at:match.start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(text[match.start:match.end])))
+		b.WriteString("</mark>")
+		at = match.end
+	}
+	b.WriteString(html.EscapeString(string(text[at:end])))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// invertedIndex maps each word to the ids of the messages containing it. It
+// is the in-process full-text index of the memory driver.
+type invertedIndex map[string]map[string]bool
+
+func (x invertedIndex) add(message model.Message) {
+	for _, term := range searchTerms(message.Content) {
+		if x[term] == nil {
+			x[term] = make(map[string]bool)
+		}
+		x[term][message.MessageId] = true
+	}
+}
+
+func (x invertedIndex) remove(message model.Message) {
+	for _, term := range searchTerms(message.Content) {
+		delete(x[term], message.MessageId)
+		if len(x[term]) == 0 {
+			delete(x, term)
+		}
+	}
+}
+
+// lookup returns the ids of the messages containing every term.
+func (x invertedIndex) lookup(terms []string) map[string]bool {
+	ids := make(map[string]bool)
+	// Start from the rarest word so the intersection stays small.
+	rarest := terms[0]
+	for _, term := range terms {
+		if len(x[term]) < len(x[rarest]) {
+			rarest = term
+		}
+	}
+	for id := range x[rarest] {
+		matches := true
+		for _, term := range terms {
+			if !x[term][id] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (s *memoryService) SearchMessages(search model.MessageSearch) ([]model.MessageSearchResult, error) {
+	terms := searchTerms(search.Query)
+	if len(terms) == 0 {
+		return nil, ErrNoSearchTerms
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := s.index.lookup(terms)
+	messages := []model.Message{}
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if search.Limit > 0 && len(messages) == search.Limit {
+			break
+		}
+		message := s.messages[i]
+		if ids[message.MessageId] && s.canSearch(search, message) {
+			messages = append(messages, message)
+		}
+	}
+	s.summarizeThreads(messages)
+	return searchResults(messages, terms), nil
+}
+
+// canSearch reports whether message is visible to the search and passes its
+// filters. Callers hold s.mu.
+func (s *memoryService) canSearch(search model.MessageSearch, message model.Message) bool {
+	if message.ChatRoomId != "" {
+		if _, member := s.roomMembers[message.ChatRoomId][search.UserId]; !member && !search.AllRooms {
+			return false
+		}
+	} else if message.Sender_Id != search.UserId && message.Receiver_Id != search.UserId {
+		return false
+	}
+	if search.SenderId != "" && message.Sender_Id != search.SenderId {
+		return false
+	}
+	if search.ChatRoomId != "" && message.ChatRoomId != search.ChatRoomId {
+		return false
+	}
+	if !search.From.IsZero() || !search.To.IsZero() {
+		created, err := time.ParseInLocation(timeLayout, message.Created_at, time.Local)
+		if err != nil {
+			return false
+		}
+		if !search.From.IsZero() && created.Before(search.From) {
+			return false
+		}
+		if !search.To.IsZero() && !created.Before(search.To) {
+			return false
+		}
+	}
+	return true
+}
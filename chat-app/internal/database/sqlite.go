@@ -0,0 +1,44 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	Register("sqlite", openSQLite)
+}
+
+// sqlitePath returns the database file named by DB_SQLITE_PATH.
+func sqlitePath() string {
+	if path := os.Getenv("DB_SQLITE_PATH"); path != "" {
+		return path
+	}
+	return "chat-app.db"
+}
+
+// sqliteDSN enables foreign keys (needed for ON DELETE CASCADE), waits on
+// locks instead of failing with SQLITE_BUSY and takes the write lock when a
+// transaction begins so concurrent writers cannot deadlock. Times are stored
+// in SQLite's own format, which its date functions understand.
+func sqliteDSN() string {
+	return fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate&_time_format=sqlite",
+		sqlitePath())
+}
+
+func openSQLite(logger *slog.Logger) (Service, error) {
+	db, err := sql.Open("sqlite", sqliteDSN())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := autoMigrate(db, "sqlite", logger); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &service{db: db, name: sqlitePath(), fullText: sqliteFullText, logger: logger}, nil
+}
@@ -0,0 +1,356 @@
+package database
+
+import (
+	model "chat-app/internal/Models"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of the database spans.
+const instrumentationName = "chat-app/internal/database"
+
+// Traced returns a Service that records a span for each call to srv, named
+// after the method and tagged with system, the name of the driver. SQL
+// drivers add the number of rows their statements affected.
+//
+// Spans are created by provider, as children of the span in the context
+// given to WithContext.
+func Traced(srv Service, system string, provider trace.TracerProvider) Service {
+	return &traced{
+		next:   srv,
+		system: system,
+		tracer: provider.Tracer(instrumentationName),
+		ctx:    context.Background(),
+	}
+}
+
+type traced struct {
+	next   Service
+	system string
+	tracer trace.Tracer
+	ctx    context.Context
+}
+
+func (t *traced) WithContext(ctx context.Context) Service {
+	c := *t
+	c.ctx = ctx
+	return &c
+}
+
+// start starts the span of a call and returns the context to make it in.
+func (t *traced) start(operation string) (context.Context, trace.Span) {
+	ctx, span := t.tracer.Start(t.ctx, "database."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", t.system),
+			attribute.String("db.operation.name", operation),
+		))
+	return context.WithValue(ctx, rowsKey{}, &rowsAffected{}), span
+}
+
+// end ends the span of a call that returned err.
+func (t *traced) end(ctx context.Context, span trace.Span, err error) {
+	if rows := ctx.Value(rowsKey{}).(*rowsAffected); rows.counted {
+		span.SetAttributes(attribute.Int64("db.rows_affected", rows.n))
+	}
+	// Missing rows are an answer, not a failure.
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (t *traced) call(operation string, f func(srv Service) error) error {
+	ctx, span := t.start(operation)
+	err := f(t.next.WithContext(ctx))
+	t.end(ctx, span, err)
+	return err
+}
+
+// call traces a call of t that returns a value.
+func call[T any](t *traced, operation string, f func(srv Service) (T, error)) (T, error) {
+	ctx, span := t.start(operation)
+	v, err := f(t.next.WithContext(ctx))
+	t.end(ctx, span, err)
+	return v, err
+}
+
+type rowsKey struct{}
+
+// rowsAffected adds up the rows affected by the statements of a call.
+type rowsAffected struct {
+	n       int64
+	counted bool
+}
+
+// countRows adds n affected rows to the call made in ctx, if it is traced.
+func countRows(ctx context.Context, n int64) {
+	if rows, ok := ctx.Value(rowsKey{}).(*rowsAffected); ok {
+		rows.n += n
+		rows.counted = true
+	}
+}
+
+func (t *traced) Health() map[string]string {
+	ctx, span := t.start("Health")
+	stats := t.next.WithContext(ctx).Health()
+	t.end(ctx, span, nil)
+	return stats
+}
+
+func (t *traced) Close() error {
+	return t.next.Close()
+}
+
+func (t *traced) CreateRefreshToken(user_id string, refreshTokenString string) error {
+	return t.call("CreateRefreshToken", func(srv Service) error {
+		return srv.CreateRefreshToken(user_id, refreshTokenString)
+	})
+}
+
+func (t *traced) GetRefreshToken(refreshTokenString string) (bool, error) {
+	return call(t, "GetRefreshToken", func(srv Service) (bool, error) {
+		return srv.GetRefreshToken(refreshTokenString)
+	})
+}
+
+func (t *traced) UpdateRefreshToken(refreshTokenString string, user_id string) error {
+	return t.call("UpdateRefreshToken", func(srv Service) error {
+		return srv.UpdateRefreshToken(refreshTokenString, user_id)
+	})
+}
+
+func (t *traced) DeleteRefreshToken() (string, error) {
+	return call(t, "DeleteRefreshToken", func(srv Service) (string, error) {
+		return srv.DeleteRefreshToken()
+	})
+}
+
+func (t *traced) CreateUser(user model.User) (string, error) {
+	return call(t, "CreateUser", func(srv Service) (string, error) {
+		return srv.CreateUser(user)
+	})
+}
+
+func (t *traced) GetAllUsers() ([]model.User, error) {
+	return call(t, "GetAllUsers", func(srv Service) ([]model.User, error) {
+		return srv.GetAllUsers()
+	})
+}
+
+func (t *traced) GetUserByUserName(userName string) (model.User, error) {
+	return call(t, "GetUserByUserName", func(srv Service) (model.User, error) {
+		return srv.GetUserByUserName(userName)
+	})
+}
+
+func (t *traced) UpdateUserPassword(Id string, password string) error {
+	return t.call("UpdateUserPassword", func(srv Service) error {
+		return srv.UpdateUserPassword(Id, password)
+	})
+}
+
+func (t *traced) UpdateUserDetails(Id string, user model.User) error {
+	return t.call("UpdateUserDetails", func(srv Service) error {
+		return srv.UpdateUserDetails(Id, user)
+	})
+}
+
+func (t *traced) DeleteUser(Id string) error {
+	return t.call("DeleteUser", func(srv Service) error {
+		return srv.DeleteUser(Id)
+	})
+}
+
+func (t *traced) GetAUserv2(Id string) (model.User, error) {
+	return call(t, "GetAUserv2", func(srv Service) (model.User, error) {
+		return srv.GetAUserv2(Id)
+	})
+}
+
+func (t *traced) CreateVerificationToken(user_id string, tokenHash string, expiresAt time.Time) error {
+	return t.call("CreateVerificationToken", func(srv Service) error {
+		return srv.CreateVerificationToken(user_id, tokenHash, expiresAt)
+	})
+}
+
+func (t *traced) ConsumeVerificationToken(tokenHash string) (string, error) {
+	return call(t, "ConsumeVerificationToken", func(srv Service) (string, error) {
+		return srv.ConsumeVerificationToken(tokenHash)
+	})
+}
+
+func (t *traced) CreateChatRoom(chatRoom model.ChatRoom) (string, error) {
+	return call(t, "CreateChatRoom", func(srv Service) (string, error) {
+		return srv.CreateChatRoom(chatRoom)
+	})
+}
+
+func (t *traced) DeleteChatRoom(Id string) error {
+	return t.call("DeleteChatRoom", func(srv Service) error {
+		return srv.DeleteChatRoom(Id)
+	})
+}
+
+func (t *traced) GetAllChatRoom() ([]model.ChatRoom, error) {
+	return call(t, "GetAllChatRoom", func(srv Service) ([]model.ChatRoom, error) {
+		return srv.GetAllChatRoom()
+	})
+}
+
+func (t *traced) GetChatRoom(Id string) (model.ChatRoom, error) {
+	return call(t, "GetChatRoom", func(srv Service) (model.ChatRoom, error) {
+		return srv.GetChatRoom(Id)
+	})
+}
+
+func (t *traced) SetUserRole(Id string, role string) error {
+	return t.call("SetUserRole", func(srv Service) error {
+		return srv.SetUserRole(Id, role)
+	})
+}
+
+func (t *traced) GetRoomRole(chatRoomId string, user_id string) (string, error) {
+	return call(t, "GetRoomRole", func(srv Service) (string, error) {
+		return srv.GetRoomRole(chatRoomId, user_id)
+	})
+}
+
+func (t *traced) SetRoomMemberRole(chatRoomId string, user_id string, role string) error {
+	return t.call("SetRoomMemberRole", func(srv Service) error {
+		return srv.SetRoomMemberRole(chatRoomId, user_id, role)
+	})
+}
+
+func (t *traced) AddRoomMember(chatRoomId string, user_id string, role string) error {
+	return t.call("AddRoomMember", func(srv Service) error {
+		return srv.AddRoomMember(chatRoomId, user_id, role)
+	})
+}
+
+func (t *traced) RemoveRoomMember(chatRoomId string, user_id string) error {
+	return t.call("RemoveRoomMember", func(srv Service) error {
+		return srv.RemoveRoomMember(chatRoomId, user_id)
+	})
+}
+
+func (t *traced) GetRoomMembers(chatRoomId string) ([]model.RoomMember, error) {
+	return call(t, "GetRoomMembers", func(srv Service) ([]model.RoomMember, error) {
+		return srv.GetRoomMembers(chatRoomId)
+	})
+}
+
+func (t *traced) CreateMessage(message model.Message) (model.Message, error) {
+	return call(t, "CreateMessage", func(srv Service) (model.Message, error) {
+		return srv.CreateMessage(message)
+	})
+}
+
+func (t *traced) GetMessagesForChatRoom(chatRoomId string, page model.MessagePage) ([]model.Message, error) {
+	return call(t, "GetMessagesForChatRoom", func(srv Service) ([]model.Message, error) {
+		return srv.GetMessagesForChatRoom(chatRoomId, page)
+	})
+}
+
+func (t *traced) GetThread(parentId string, page model.MessagePage) ([]model.Message, error) {
+	return call(t, "GetThread", func(srv Service) ([]model.Message, error) {
+		return srv.GetThread(parentId, page)
+	})
+}
+
+func (t *traced) GetMessagesforIndividualChat(senderReceiver map[string]string, page model.MessagePage) ([]model.Message, error) {
+	return call(t, "GetMessagesforIndividualChat", func(srv Service) ([]model.Message, error) {
+		return srv.GetMessagesforIndividualChat(senderReceiver, page)
+	})
+}
+
+func (t *traced) GetMessage(Id string) (model.Message, error) {
+	return call(t, "GetMessage", func(srv Service) (model.Message, error) {
+		return srv.GetMessage(Id)
+	})
+}
+
+func (t *traced) UpdateMessage(Id string, content string, editorId string) (model.Message, error) {
+	return call(t, "UpdateMessage", func(srv Service) (model.Message, error) {
+		return srv.UpdateMessage(Id, content, editorId)
+	})
+}
+
+func (t *traced) DeleteMessage(Id string, editorId string) (model.Message, error) {
+	return call(t, "DeleteMessage", func(srv Service) (model.Message, error) {
+		return srv.DeleteMessage(Id, editorId)
+	})
+}
+
+func (t *traced) GetMessageRevisions(Id string) ([]model.MessageRevision, error) {
+	return call(t, "GetMessageRevisions", func(srv Service) ([]model.MessageRevision, error) {
+		return srv.GetMessageRevisions(Id)
+	})
+}
+
+func (t *traced) AddReaction(messageId string, user_id string, emoji string) error {
+	return t.call("AddReaction", func(srv Service) error {
+		return srv.AddReaction(messageId, user_id, emoji)
+	})
+}
+
+func (t *traced) RemoveReaction(messageId string, user_id string, emoji string) error {
+	return t.call("RemoveReaction", func(srv Service) error {
+		return srv.RemoveReaction(messageId, user_id, emoji)
+	})
+}
+
+func (t *traced) GetReactions(messageIds []string, user_id string) (map[string][]model.Reaction, error) {
+	return call(t, "GetReactions", func(srv Service) (map[string][]model.Reaction, error) {
+		return srv.GetReactions(messageIds, user_id)
+	})
+}
+
+func (t *traced) UpdateLastSeen(Id string) error {
+	return t.call("UpdateLastSeen", func(srv Service) error {
+		return srv.UpdateLastSeen(Id)
+	})
+}
+
+func (t *traced) GetLastSeen(Ids []string) (map[string]string, error) {
+	return call(t, "GetLastSeen", func(srv Service) (map[string]string, error) {
+		return srv.GetLastSeen(Ids)
+	})
+}
+
+func (t *traced) GetContacts(user_id string) ([]string, error) {
+	return call(t, "GetContacts", func(srv Service) ([]string, error) {
+		return srv.GetContacts(user_id)
+	})
+}
+
+func (t *traced) MarkRoomRead(chatRoomId string, user_id string, messageId string) error {
+	return t.call("MarkRoomRead", func(srv Service) error {
+		return srv.MarkRoomRead(chatRoomId, user_id, messageId)
+	})
+}
+
+func (t *traced) MarkDirectRead(user_id string, peerId string, messageId string) error {
+	return t.call("MarkDirectRead", func(srv Service) error {
+		return srv.MarkDirectRead(user_id, peerId, messageId)
+	})
+}
+
+func (t *traced) GetUnreadCounts(user_id string) ([]model.UnreadCount, error) {
+	return call(t, "GetUnreadCounts", func(srv Service) ([]model.UnreadCount, error) {
+		return srv.GetUnreadCounts(user_id)
+	})
+}
+
+func (t *traced) SearchMessages(search model.MessageSearch) ([]model.MessageSearchResult, error) {
+	return call(t, "SearchMessages", func(srv Service) ([]model.MessageSearchResult, error) {
+		return srv.SearchMessages(search)
+	})
+}
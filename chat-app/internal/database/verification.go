@@ -0,0 +1,86 @@
+package database
+
+import (
+	model "chat-app/internal/Models"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+var errInvalidVerificationToken = fmt.Errorf("verification token is invalid or has expired")
+
+func (s *service) CreateVerificationToken(user_id string, tokenHash string, expiresAt time.Time) error {
+	_, err := s.exec("INSERT INTO email_verification_tokens (token_hash, user_id, expires_at, created_at) VALUES(?, ?, ?, ?)",
+		tokenHash, user_id, expiresAt, time.Now())
+	return err
+}
+
+func (s *service) ConsumeVerificationToken(tokenHash string) (string, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userId string
+	err = tx.QueryRowContext(s.context(), "SELECT user_id FROM email_verification_tokens WHERE token_hash = ? AND expires_at > ?",
+		tokenHash, time.Now()).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return "", errInvalidVerificationToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Deleting the row is what makes the token single-use; a concurrent
+	// request that already consumed it sees zero affected rows.
+	result, err := s.txExec(tx, "DELETE FROM email_verification_tokens WHERE token_hash = ?", tokenHash)
+	if err != nil {
+		return "", err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return "", errInvalidVerificationToken
+	}
+
+	_, err = s.txExec(tx, "UPDATE user SET status = ?, updated_at = ? WHERE id = ?", model.UserStatusActive, time.Now(), userId)
+	if err != nil {
+		return "", err
+	}
+	return userId, tx.Commit()
+}
+
+type memoryVerificationToken struct {
+	userId    string
+	expiresAt time.Time
+}
+
+func (s *memoryService) CreateVerificationToken(user_id string, tokenHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findUser(user_id) < 0 {
+		return fmt.Errorf("no user exists with Id: %s", user_id)
+	}
+	if _, exists := s.verificationTokens[tokenHash]; exists {
+		return fmt.Errorf("duplicate verification token")
+	}
+	s.verificationTokens[tokenHash] = memoryVerificationToken{userId: user_id, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *memoryService) ConsumeVerificationToken(tokenHash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.verificationTokens[tokenHash]
+	if !ok || !token.expiresAt.After(time.Now()) {
+		return "", errInvalidVerificationToken
+	}
+	delete(s.verificationTokens, tokenHash)
+
+	if i := s.findUser(token.userId); i >= 0 {
+		s.users[i].Status = model.UserStatusActive
+		s.users[i].Upated_at = now()
+	}
+	return token.userId, nil
+}
@@ -0,0 +1,106 @@
+// Package logging builds the structured logger shared by the server and the
+// database layer and carries request-scoped loggers in contexts. The output
+// is chosen with the LOG_FORMAT and LOG_LEVEL environment variables.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces the value of attributes that hold secrets.
+const Redacted = "[REDACTED]"
+
+// secretKeys are substrings of attribute keys whose values are never
+// written, matched case-insensitively.
+var secretKeys = []string{"password", "token", "secret", "authorization", "cookie"}
+
+// FromEnv returns a logger writing to standard error in LOG_FORMAT:
+//
+//	text (default) one key=value line per record
+//	json one JSON object per record
+//
+// Records below LOG_LEVEL (debug, info, warn or error; info by default) are
+// discarded.
+func FromEnv() (*slog.Logger, error) {
+	var level slog.Level
+	if name := os.Getenv("LOG_LEVEL"); name != "" {
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL %q", name)
+		}
+	}
+	return New(os.Stderr, os.Getenv("LOG_FORMAT"), level)
+}
+
+// New returns a logger writing records of at least level to w, formatted as
+// "text" or "json". Secret attributes are redacted.
+func New(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// Discard returns a logger that writes nothing, for tests.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// redact hides the values of attributes named like secrets, in groups too.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+	key := strings.ToLower(a.Key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+	return a
+}
+
+type contextKey struct{}
+
+// scope holds the logger of a request. Middlewares further down the chain
+// add attributes to it, so they show up in records written further up too.
+type scope struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+// NewContext returns a copy of ctx that carries logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, &scope{logger: logger})
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if s, ok := ctx.Value(contextKey{}).(*scope); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.logger
+	}
+	return slog.Default()
+}
+
+// AddAttrs adds attributes to the logger carried by ctx, for every holder of
+// a context derived from the one passed to NewContext. It does nothing if
+// ctx carries no logger.
+func AddAttrs(ctx context.Context, args ...any) {
+	if s, ok := ctx.Value(contextKey{}).(*scope); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.logger = s.logger.With(args...)
+	}
+}
@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewRedactsSecrets(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(&out, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	logger.Info("login",
+		"user_id", "7",
+		"password", "hunter2",
+		slog.Group("tokens", "Refresh_Token", "r-secret", "kind", "pair"),
+		"Authorization", "Bearer a-secret")
+	logger.Debug("below the level")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("want one JSON record, got %q: %v", out.String(), err)
+	}
+	for _, secret := range []string{"hunter2", "r-secret", "a-secret"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("record leaks %q: %s", secret, out.String())
+		}
+	}
+	if record["user_id"] != "7" || record["password"] != Redacted || record["Authorization"] != Redacted {
+		t.Errorf("unexpected record %v", record)
+	}
+	if group, _ := record["tokens"].(map[string]interface{}); group["kind"] != "pair" || group["Refresh_Token"] != Redacted {
+		t.Errorf("unexpected group %v", record["tokens"])
+	}
+}
+
+func TestNewRejectsUnknownFormat(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", slog.LevelInfo); err == nil {
+		t.Error("want an error for an unknown format")
+	}
+}
+
+func TestAddAttrsReachesEveryHolderOfTheContext(t *testing.T) {
+	var out bytes.Buffer
+	logger, _ := New(&out, "text", slog.LevelInfo)
+
+	ctx := NewContext(context.Background(), logger.With("request_id", "r1"))
+	derived, cancel := context.WithCancel(ctx)
+	defer cancel()
+	AddAttrs(derived, "user_id", "7")
+	FromContext(ctx).Info("done")
+
+	if line := out.String(); !strings.Contains(line, "request_id=r1") || !strings.Contains(line, "user_id=7") {
+		t.Errorf("want request and user ids in %q", line)
+	}
+	if FromContext(context.Background()) != slog.Default() {
+		t.Error("want the default logger for a context without one")
+	}
+}
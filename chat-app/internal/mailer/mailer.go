@@ -0,0 +1,123 @@
+// Package mailer delivers transactional email such as account verification
+// links. The implementation is chosen with the MAILER environment variable.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends a Message. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// FromEnv returns the Mailer selected by MAILER:
+//
+//	log  writes messages, verification links included, to the default
+//	     logger, for local development
+//	file writes one .eml file per message into MAILER_DIR (default "mail")
+//	smtp sends through SMTP_HOST:SMTP_PORT as SMTP_FROM, authenticating
+//	     with SMTP_USERNAME/SMTP_PASSWORD when set
+//
+// There is no default: a deployment that forgot to configure SMTP must not
+// write live verification tokens to its logs.
+func FromEnv() (Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "":
+		return nil, fmt.Errorf("MAILER is not set: use smtp, or log or file for local development")
+	case "log":
+		return LogMailer{}, nil
+	case "file":
+		dir := os.Getenv("MAILER_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return NewFileMailer(dir)
+	case "smtp":
+		return &SMTPMailer{
+			Addr:     os.Getenv("SMTP_HOST") + ":" + os.Getenv("SMTP_PORT"),
+			Host:     os.Getenv("SMTP_HOST"),
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", os.Getenv("MAILER"))
+	}
+}
+
+// LogMailer prints messages instead of sending them. It is meant for local
+// development only: the bodies it logs hold single-use tokens.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, message Message) error {
+	slog.InfoContext(ctx, "Mail", "to", message.To, "subject", message.Subject, "body", message.Body)
+	return nil
+}
+
+// FileMailer writes every message to its own file in Dir so they can be
+// inspected with a mail client or a text editor.
+type FileMailer struct {
+	Dir string
+
+	seq atomic.Int64
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{Dir: dir}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, message Message) error {
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102T150405"), m.seq.Add(1))
+	return os.WriteFile(filepath.Join(m.Dir, name), format("", message), 0o644)
+}
+
+// SMTPMailer sends messages through an SMTP relay.
+type SMTPMailer struct {
+	Addr     string
+	Host     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{message.To}, format(m.From, message))
+}
+
+// headerValue strips line breaks so a value cannot inject extra headers.
+var headerValue = strings.NewReplacer("\r", "", "\n", "")
+
+func format(from string, message Message) []byte {
+	var b strings.Builder
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", headerValue.Replace(from))
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", headerValue.Replace(message.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerValue.Replace(message.Subject))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(message.Body)
+	return []byte(b.String())
+}
@@ -0,0 +1,15 @@
+package mailer
+
+import "testing"
+
+func TestFromEnvRequiresAnExplicitMailer(t *testing.T) {
+	t.Setenv("MAILER", "")
+	if _, err := FromEnv(); err == nil {
+		t.Fatal("expected FromEnv() to fail without MAILER")
+	}
+
+	t.Setenv("MAILER", "log")
+	if m, err := FromEnv(); err != nil || m != (LogMailer{}) {
+		t.Fatalf("FromEnv() with MAILER=log = %v, %v", m, err)
+	}
+}
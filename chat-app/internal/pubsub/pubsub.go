@@ -0,0 +1,198 @@
+// Package pubsub carries events between the replicas of the chat server so
+// that each replica can deliver them to the WebSockets it holds. The
+// implementation is chosen with the PUBSUB environment variable.
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultChannel is the Redis channel or NATS subject used when
+// PUBSUB_CHANNEL is not set.
+const DefaultChannel = "chat-app.hub"
+
+// PubSub broadcasts messages on a single channel to every subscriber, the
+// ones in the publishing process included. Implementations must be safe for
+// concurrent use.
+type PubSub interface {
+	// Publish sends data to every subscriber.
+	Publish(ctx context.Context, data []byte) error
+	// Subscribe calls handle with every message published after it
+	// returns, in the order they were published, until Close.
+	Subscribe(handle func(data []byte)) error
+	Close() error
+}
+
+// FromEnv returns the PubSub selected by PUBSUB:
+//
+//	local (default) delivers within this process; use it with a single
+//	      replica
+//	redis uses Redis pub/sub at REDIS_URL (default redis://localhost:6379/0)
+//	nats  uses the NATS server at NATS_URL (default nats://127.0.0.1:4222)
+//
+// Replicas talk over PUBSUB_CHANNEL, DefaultChannel by default.
+func FromEnv() (PubSub, error) {
+	channel := os.Getenv("PUBSUB_CHANNEL")
+	if channel == "" {
+		channel = DefaultChannel
+	}
+
+	switch os.Getenv("PUBSUB") {
+	case "", "local":
+		return NewLocal(), nil
+	case "redis":
+		url := os.Getenv("REDIS_URL")
+		if url == "" {
+			url = "redis://localhost:6379/0"
+		}
+		return NewRedis(url, channel)
+	case "nats":
+		url := os.Getenv("NATS_URL")
+		if url == "" {
+			url = nats.DefaultURL
+		}
+		return NewNATS(url, channel)
+	default:
+		return nil, fmt.Errorf("unknown pubsub %q", os.Getenv("PUBSUB"))
+	}
+}
+
+// Local delivers messages to the subscribers in this process. Several hubs
+// sharing one Local behave like replicas sharing a broker.
+type Local struct {
+	mu       sync.RWMutex
+	handlers []func(data []byte)
+}
+
+func NewLocal() *Local {
+	return &Local{}
+}
+
+func (l *Local) Publish(ctx context.Context, data []byte) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, handle := range l.handlers {
+		// Handlers may keep the slice, so each gets its own.
+		handle(append([]byte(nil), data...))
+	}
+	return nil
+}
+
+func (l *Local) Subscribe(handle func(data []byte)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.handlers = append(l.handlers, handle)
+	return nil
+}
+
+func (l *Local) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.handlers = nil
+	return nil
+}
+
+// Redis uses Redis pub/sub. Messages published while a replica is
+// disconnected are lost to it.
+type Redis struct {
+	client  *redis.Client
+	channel string
+
+	mu   sync.Mutex
+	subs []*redis.PubSub
+}
+
+// NewRedis connects to the Redis server at url, such as
+// redis://localhost:6379/0.
+func NewRedis(url string, channel string) (*Redis, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	// Fail fast on a bad address instead of on the first message.
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("cannot reach redis at %s: %w", options.Addr, err)
+	}
+	return &Redis{client: client, channel: channel}, nil
+}
+
+func (r *Redis) Publish(ctx context.Context, data []byte) error {
+	return r.client.Publish(ctx, r.channel, data).Err()
+}
+
+func (r *Redis) Subscribe(handle func(data []byte)) error {
+	sub := r.client.Subscribe(context.Background(), r.channel)
+	// Wait for the confirmation so no message published after Subscribe
+	// returns is missed.
+	if _, err := sub.Receive(context.Background()); err != nil {
+		sub.Close()
+		return err
+	}
+	r.mu.Lock()
+	r.subs = append(r.subs, sub)
+	r.mu.Unlock()
+
+	go func() {
+		for message := range sub.Channel() {
+			handle([]byte(message.Payload))
+		}
+	}()
+	return nil
+}
+
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	for _, sub := range r.subs {
+		sub.Close()
+	}
+	r.subs = nil
+	r.mu.Unlock()
+	return r.client.Close()
+}
+
+// NATS uses core NATS publish/subscribe, which like Redis does not keep
+// messages for disconnected replicas.
+type NATS struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATS connects to the NATS server at url, such as
+// nats://127.0.0.1:4222.
+func NewNATS(url string, subject string) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("chat-app"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach nats at %s: %w", url, err)
+	}
+	return &NATS{conn: conn, subject: subject}, nil
+}
+
+func (n *NATS) Publish(ctx context.Context, data []byte) error {
+	return n.conn.Publish(n.subject, data)
+}
+
+func (n *NATS) Subscribe(handle func(data []byte)) error {
+	if _, err := n.conn.Subscribe(n.subject, func(message *nats.Msg) {
+		handle(message.Data)
+	}); err != nil {
+		return err
+	}
+	// Make sure the server registered the subscription before returning.
+	return n.conn.Flush()
+}
+
+func (n *NATS) Close() error {
+	n.conn.Close()
+	return nil
+}
@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+)
+
+// testBroadcast publishes from one replica and checks that every replica,
+// the publisher included, gets all messages in order.
+func testBroadcast(t *testing.T, replicas ...PubSub) {
+	t.Helper()
+	received := make([]chan string, len(replicas))
+	for i, replica := range replicas {
+		ch := make(chan string, 10)
+		received[i] = ch
+		if err := replica.Subscribe(func(data []byte) { ch <- string(data) }); err != nil {
+			t.Fatalf("Subscribe() returned error: %v", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := replicas[0].Publish(context.Background(), []byte(fmt.Sprint("event-", i))); err != nil {
+			t.Fatalf("Publish() returned error: %v", err)
+		}
+	}
+	for r, ch := range received {
+		for i := 0; i < 3; i++ {
+			select {
+			case got := <-ch:
+				if want := fmt.Sprint("event-", i); got != want {
+					t.Fatalf("replica %d got %q, want %q", r, got, want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("replica %d timed out waiting for event-%d", r, i)
+			}
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	local := NewLocal()
+	defer local.Close()
+	testBroadcast(t, local, local)
+}
+
+func TestRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	url := "redis://" + server.Addr() + "/0"
+
+	var replicas []PubSub
+	for i := 0; i < 2; i++ {
+		replica, err := NewRedis(url, DefaultChannel)
+		if err != nil {
+			t.Fatalf("NewRedis() returned error: %v", err)
+		}
+		defer replica.Close()
+		replicas = append(replicas, replica)
+	}
+	testBroadcast(t, replicas...)
+
+	if _, err := NewRedis("redis://127.0.0.1:1/0", DefaultChannel); err == nil {
+		t.Fatal("expected NewRedis to fail without a server")
+	}
+}
+
+func TestNATS(t *testing.T) {
+	server, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("NewServer() returned error: %v", err)
+	}
+	go server.Start()
+	defer server.Shutdown()
+	if !server.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+
+	var replicas []PubSub
+	for i := 0; i < 2; i++ {
+		replica, err := NewNATS(server.ClientURL(), DefaultChannel)
+		if err != nil {
+			t.Fatalf("NewNATS() returned error: %v", err)
+		}
+		defer replica.Close()
+		replicas = append(replicas, replica)
+	}
+	testBroadcast(t, replicas...)
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("PUBSUB", "")
+	if bus, err := FromEnv(); err != nil {
+		t.Fatalf("FromEnv() returned error: %v", err)
+	} else if _, ok := bus.(*Local); !ok {
+		t.Fatalf("FromEnv() = %T, want the local bus by default", bus)
+	}
+	t.Setenv("PUBSUB", "carrier-pigeon")
+	if _, err := FromEnv(); err == nil {
+		t.Fatal("expected an unknown pubsub to be rejected")
+	}
+}
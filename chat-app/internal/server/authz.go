@@ -0,0 +1,147 @@
+package server
+
+import (
+	jwtauth "chat-app/internal/Authentication"
+	model "chat-app/internal/Models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// forbidden writes the response for an authenticated caller that lacks the
+// permission a route requires.
+func forbidden(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, "You are not allowed to perform this action")
+}
+
+// requireAdmin only lets global admins through.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !principalFrom(r).HasRole(model.RoleAdmin) {
+			forbidden(w)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requireSelfOrAdmin lets a user act on the account in the {id} route
+// variable if it is their own, and admins act on any account.
+func (s *Server) requireSelfOrAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFrom(r)
+		if principal.UserId != mux.Vars(r)["id"] && !principal.HasRole(model.RoleAdmin) {
+			forbidden(w)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requireRoomMember lets any member of the chat room in the {id} route
+// variable through, and admins.
+func (s *Server) requireRoomMember(next http.HandlerFunc) http.Handler {
+	return s.requireRoomRole(next, model.RoomRoleOwner, model.RoomRoleModerator, model.RoomRoleMember)
+}
+
+// canAccessRoom reports whether principal may read and post in a chat room.
+func (s *Server) canAccessRoom(ctx context.Context, principal jwtauth.Principal, chatRoomId string) (bool, error) {
+	if principal.HasRole(model.RoleAdmin) {
+		return true, nil
+	}
+	role, err := s.db.WithContext(ctx).GetRoomRole(chatRoomId, principal.UserId)
+	return role != "", err
+}
+
+// requireRoomRole lets members of the chat room in the {id} route variable
+// through if their room role is one of roles. Admins are always let through.
+func (s *Server) requireRoomRole(next http.HandlerFunc, roles ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFrom(r)
+		if principal.HasRole(model.RoleAdmin) {
+			next(w, r)
+			return
+		}
+		role, err := s.db.WithContext(r.Context()).GetRoomRole(mux.Vars(r)["id"], principal.UserId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		for _, allowed := range roles {
+			if role == allowed {
+				next(w, r)
+				return
+			}
+		}
+		forbidden(w)
+	})
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+func (s *Server) setUserRole(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	var request roleRequest
+	_ = json.NewDecoder(r.Body).Decode(&request)
+
+	if request.Role != model.RoleUser && request.Role != model.RoleAdmin {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "role must be %q or %q", model.RoleUser, model.RoleAdmin)
+		return
+	}
+	if err := s.db.WithContext(r.Context()).SetUserRole(params["id"], request.Role); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	user, err := s.db.WithContext(r.Context()).GetAUserv2(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	user.Password = ""
+
+	json.NewEncoder(w).Encode(&user)
+}
+
+// setRoomMemberRole promotes a member to moderator or demotes them again.
+// Ownership cannot be assigned or removed this way.
+func (s *Server) setRoomMemberRole(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	var request roleRequest
+	_ = json.NewDecoder(r.Body).Decode(&request)
+
+	if request.Role != model.RoomRoleModerator && request.Role != model.RoomRoleMember {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "role must be %q or %q", model.RoomRoleModerator, model.RoomRoleMember)
+		return
+	}
+	current, err := s.db.WithContext(r.Context()).GetRoomRole(params["id"], params["userid"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	if current == model.RoomRoleOwner {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "the owner's role cannot be changed")
+		return
+	}
+	if err := s.db.WithContext(r.Context()).SetRoomMemberRole(params["id"], params["userid"], request.Role); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+	fmt.Fprint(w, "User "+params["userid"]+" is now "+request.Role+" of ChatRoom "+params["id"])
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Kinds of bus events.
+const (
+	eventRoom        = "room"
+	eventThread      = "thread"
+	eventUsers       = "users"
+	eventDirect      = "direct"
+	eventTyping      = "typing"
+	eventUnsubscribe = "unsubscribe"
+	eventCloseRoom   = "room.close"
+	eventPresence    = "presence"
+	eventSync        = "sync"
+	eventHeartbeat   = "heartbeat"
+)
+
+// busEvent is a hub operation that the other replicas apply to their own
+// sockets. Frame is the update to deliver, already encoded, and Trace the
+// trace context of the event that caused it.
+type busEvent struct {
+	Replica    string          `json:"replica"`
+	Kind       string          `json:"kind"`
+	ChatRoomId string          `json:"chatroom_id,omitempty"`
+	ParentId   string          `json:"parent_id,omitempty"`
+	UserIds    []string        `json:"user_ids,omitempty"`
+	Typing     *typingPayload  `json:"typing,omitempty"`
+	Status     string          `json:"status,omitempty"`
+	Frame      json.RawMessage `json:"frame,omitempty"`
+	Receipt    json.RawMessage `json:"receipt,omitempty"`
+
+	Trace propagation.MapCarrier `json:"trace,omitempty"`
+}
+
+// encodeFrame encodes an update for the bus. Updates are our own types, so
+// failing to encode one is a programming error.
+func encodeFrame(v interface{}) json.RawMessage {
+	_, v = untrace(v)
+	raw, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Error encoding hub event", "error", err)
+	}
+	return raw
+}
+
+// share publishes an event, with frame as the update to deliver if not nil.
+// It never blocks: when the outbox is full, or closed by stop, the event is
+// dropped.
+func (h *Hub) share(e busEvent, frame interface{}) {
+	e.Replica = h.replica
+	if frame != nil {
+		injectTrace(&e, frame)
+		e.Frame = encodeFrame(frame)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		h.logger.Error("Error encoding hub event", "kind", e.Kind, "error", err)
+		return
+	}
+	h.outboxMu.RLock()
+	defer h.outboxMu.RUnlock()
+	if h.outboxClosed {
+		h.logger.Debug("Dropping hub event, the hub stopped", "kind", e.Kind)
+		return
+	}
+	select {
+	case h.outbox <- data:
+	default:
+		h.dropped.WithLabelValues(dropOutboxFull).Inc()
+		h.logger.Warn("Dropping hub event, the pubsub outbox is full", "kind", e.Kind)
+	}
+}
+
+// publishOutbox publishes the queued events in order until stop closes the
+// outbox.
+func (h *Hub) publishOutbox() {
+	defer close(h.published)
+	for data := range h.outbox {
+		if err := h.bus.Publish(context.Background(), data); err != nil {
+			h.logger.Error("Error publishing hub event", "error", err)
+		}
+	}
+}
+
+// receive hands an event published by another replica to the hub goroutine.
+func (h *Hub) receive(data []byte) {
+	var e busEvent
+	if err := json.Unmarshal(data, &e); err != nil {
+		h.logger.Error("Error decoding hub event", "error", err)
+		return
+	}
+	if e.Replica == h.replica {
+		return
+	}
+	h.run(func() { h.apply(e) })
+}
+
+// apply delivers an event of another replica to the local sockets. Only
+// called on the hub goroutine.
+func (h *Hub) apply(e busEvent) {
+	h.heard[e.Replica] = time.Now()
+	ctx := extractTrace(e)
+	frame := withTrace(ctx, e.Frame)
+	switch e.Kind {
+	case eventRoom:
+		h.deliverToRoom(e.ChatRoomId, frame, nil)
+	case eventThread:
+		h.deliverToThread(e.ParentId, frame, nil)
+	case eventUsers:
+		h.deliverToUsers(frame, nil, e.UserIds...)
+	case eventDirect:
+		if len(e.UserIds) == 2 {
+			h.deliverDirect(frame, nil, e.UserIds[0], e.UserIds[1], withTrace(ctx, e.Receipt))
+		}
+	case eventTyping:
+		if e.Typing != nil {
+			h.deliverTyping(*e.Typing, frame)
+		}
+	case eventUnsubscribe:
+		for _, userId := range e.UserIds {
+			h.removeUserFromRoom(e.ChatRoomId, userId)
+		}
+	case eventCloseRoom:
+		h.removeAllFromRoom(e.ChatRoomId)
+	case eventPresence:
+		for _, userId := range e.UserIds {
+			h.setRemoteStatus(userId, e.Replica, e.Status)
+		}
+	case eventSync:
+		for userId := range h.users {
+			h.share(busEvent{Kind: eventPresence, UserIds: []string{userId}, Status: h.localStatusOf(userId)}, nil)
+		}
+	case eventHeartbeat:
+		// Hearing from the replica is all a heartbeat is for.
+	default:
+		h.logger.Warn("Ignoring hub event of unknown kind", "kind", e.Kind, "replica", e.Replica)
+	}
+}
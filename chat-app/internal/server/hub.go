@@ -0,0 +1,562 @@
+package server
+
+import (
+	"chat-app/internal/pubsub"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// writeWait bounds how long a single write to a socket may take.
+	writeWait = 10 * time.Second
+	// pongWait is how long a socket may stay silent, pongs included, before
+	// it is considered dead.
+	pongWait = 60 * time.Second
+	// pingPeriod must be shorter than pongWait so a healthy peer always
+	// answers in time.
+	pingPeriod = pongWait * 9 / 10
+	// maxFrameSize limits the size of a frame read from a client.
+	maxFrameSize = 64 * 1024
+	// sendBuffer is how many updates may queue for a socket. A socket that
+	// falls further behind is disconnected.
+	sendBuffer = 16
+	// outboxSize is how many events may wait to be published on the bus.
+	outboxSize = 1024
+	// heartbeatPeriod is how often a replica tells the others it is alive.
+	heartbeatPeriod = 10 * time.Second
+	// missedHeartbeats is how many heartbeats a replica may miss before the
+	// others consider it gone, along with the presence it reported.
+	missedHeartbeats = 3
+)
+
+// client is one WebSocket connection of an authenticated user.
+type client struct {
+	conn   *websocket.Conn
+	userId string
+	// send queues updates for writePump. Only the hub closes it, after
+	// setting closeCode to the code of the close frame to send.
+	send      chan interface{}
+	closeCode int
+	// done is closed when writePump returns.
+	done chan struct{}
+	// rooms is the set of chat rooms this connection is subscribed to, and
+	// threads maps the parent message of each followed thread to its chat
+	// room. Both are owned by the hub goroutine.
+	rooms   map[string]bool
+	threads map[string]string
+	// away is set while the client reports its user as idle. Owned by the
+	// hub goroutine.
+	away bool
+	// typingLimit throttles typing frames. Only used by readPump.
+	typingLimit rateLimiter
+	// logger carries the fields of the request that opened the socket.
+	logger *slog.Logger
+	tracer trace.Tracer
+}
+
+func newClient(conn *websocket.Conn, userId string, logger *slog.Logger, tracer trace.Tracer) *client {
+	return &client{
+		conn:    conn,
+		userId:  userId,
+		logger:  logger,
+		tracer:  tracer,
+		send:    make(chan interface{}, sendBuffer),
+		done:    make(chan struct{}),
+		rooms:   make(map[string]bool),
+		threads: make(map[string]string),
+	}
+}
+
+// Hub routes chat updates to the sockets allowed to see them. Every socket
+// receives the direct messages of its user, and the messages of the rooms it
+// subscribed to.
+//
+// All state is owned by the Run goroutine; other goroutines talk to it over
+// channels, so no locking is needed and a slow socket never blocks a
+// broadcast.
+//
+// Every replica of the server runs its own hub. Deliveries reach the local
+// sockets directly and the other replicas through the bus.
+type Hub struct {
+	register   chan *client
+	unregister chan *client
+	// commands run on the hub goroutine, in the order they were sent.
+	commands chan func()
+
+	// users maps a user id to the sockets that user has open.
+	users map[string]map[*client]bool
+	// rooms maps a chat room id to the sockets subscribed to it.
+	rooms map[string]map[*client]bool
+	// threads maps a parent message id to the sockets following its replies.
+	threads map[string]map[*client]bool
+	// typing holds the typing indicators being shown. Nothing about typing
+	// is stored in the database.
+	typing map[typingPayload]*typingState
+
+	// audience returns the users who see the presence of a user. It is
+	// called off the hub goroutine; without it presence is not announced.
+	audience func(userId string) ([]string, error)
+	// announced is the last presence status announced for each user who is
+	// not offline.
+	announced map[string]string
+
+	// bus carries deliveries to the other replicas. replica identifies this
+	// hub on it, and outbox queues events for publishing so the hub
+	// goroutine never waits on the network. outboxClosed is set under
+	// outboxMu once stop closes the outbox, and published is closed when
+	// its last event is published.
+	bus          pubsub.PubSub
+	replica      string
+	outbox       chan []byte
+	outboxMu     sync.RWMutex
+	outboxClosed bool
+	published    chan struct{}
+	// remote holds the presence statuses reported by other replicas, by
+	// user id and replica. shared is the local status last published for
+	// each user with sockets here.
+	remote map[string]map[string]string
+	shared map[string]string
+	// heard is when each other replica last published an event, and
+	// heartbeat how often this one publishes one at least.
+	heard     map[string]time.Time
+	heartbeat time.Duration
+
+	// closing is set once the server shuts down; new sockets are closed
+	// right away.
+	closing bool
+	// stopped is closed by stop to end Run, which closes finished when it
+	// returns. announcing tracks the goroutines looking up presence
+	// audiences.
+	stopped    chan struct{}
+	finished   chan struct{}
+	announcing sync.WaitGroup
+
+	logger *slog.Logger
+	// delivered counts the updates queued to sockets, and dropped those
+	// lost on the way.
+	delivered prometheus.Counter
+	dropped   *prometheus.CounterVec
+}
+
+// NewHub returns a hub that exchanges deliveries with the other replicas
+// over bus and logs to logger.
+func NewHub(audience func(userId string) ([]string, error), bus pubsub.PubSub, logger *slog.Logger) (*Hub, error) {
+	h := &Hub{
+		register:   make(chan *client),
+		unregister: make(chan *client),
+		commands:   make(chan func()),
+		users:      make(map[string]map[*client]bool),
+		rooms:      make(map[string]map[*client]bool),
+		threads:    make(map[string]map[*client]bool),
+		typing:     make(map[typingPayload]*typingState),
+		audience:   audience,
+		announced:  make(map[string]string),
+		bus:        bus,
+		replica:    uuid.NewString(),
+		outbox:     make(chan []byte, outboxSize),
+		published:  make(chan struct{}),
+		remote:     make(map[string]map[string]string),
+		shared:     make(map[string]string),
+		heard:      make(map[string]time.Time),
+		heartbeat:  heartbeatPeriod,
+		stopped:    make(chan struct{}),
+		finished:   make(chan struct{}),
+		logger:     logger,
+	}
+	h.delivered, h.dropped = newHubCounters()
+	if err := bus.Subscribe(h.receive); err != nil {
+		return nil, err
+	}
+	go h.publishOutbox()
+	// Learn who is connected to the replicas that are already running.
+	h.share(busEvent{Kind: eventSync}, nil)
+	return h, nil
+}
+
+// Run processes registrations and deliveries until stop is called. It
+// also publishes the heartbeats of this replica and forgets the presence
+// reported by replicas that stopped publishing theirs.
+func (h *Hub) Run() {
+	defer close(h.finished)
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-h.stopped:
+			return
+		case now := <-heartbeat.C:
+			h.share(busEvent{Kind: eventHeartbeat}, nil)
+			h.expireReplicas(now)
+		case c := <-h.register:
+			if h.closing {
+				c.closeCode = websocket.CloseGoingAway
+				close(c.send)
+				continue
+			}
+			if h.users[c.userId] == nil {
+				h.users[c.userId] = make(map[*client]bool)
+			}
+			h.users[c.userId][c] = true
+			h.updatePresence(c.userId)
+		case c := <-h.unregister:
+			h.drop(c)
+		case command := <-h.commands:
+			command()
+		}
+	}
+}
+
+// run hands f to the hub goroutine. Once the hub stopped, f is discarded
+// and run reports false.
+func (h *Hub) run(f func()) bool {
+	select {
+	case h.commands <- f:
+		return true
+	case <-h.stopped:
+		return false
+	}
+}
+
+// do runs f on the hub goroutine and waits for it to finish. Once the hub
+// stopped, f is discarded.
+func (h *Hub) do(f func()) {
+	done := make(chan struct{})
+	if h.run(func() {
+		f()
+		close(done)
+	}) {
+		<-done
+	}
+}
+
+// add registers a new socket. It reports false if the hub stopped, in which
+// case the caller closes the socket itself.
+func (h *Hub) add(c *client) bool {
+	select {
+	case h.register <- c:
+		return true
+	case <-h.stopped:
+		return false
+	}
+}
+
+// remove unregisters a socket that stopped reading.
+func (h *Hub) remove(c *client) {
+	select {
+	case h.unregister <- c:
+	case <-h.stopped:
+	}
+}
+
+// shutdown closes every socket with a going away frame after the updates
+// queued for it, and refuses new sockets. It returns once every socket is
+// closed or ctx is done.
+func (h *Hub) shutdown(ctx context.Context) {
+	var pumps []chan struct{}
+	h.do(func() {
+		h.closing = true
+		for _, sockets := range h.users {
+			for c := range sockets {
+				c.closeCode = websocket.CloseGoingAway
+				pumps = append(pumps, c.done)
+				h.drop(c)
+			}
+		}
+	})
+	for _, done := range pumps {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stop ends Run once the sockets are gone, waits for the presence lookups
+// still running, and publishes the events left in the outbox. It returns
+// ctx.Err() if ctx is done first.
+func (h *Hub) stop(ctx context.Context) error {
+	close(h.stopped)
+	select {
+	case <-h.finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := waitGroup(ctx, &h.announcing); err != nil {
+		return err
+	}
+
+	h.outboxMu.Lock()
+	h.outboxClosed = true
+	close(h.outbox)
+	h.outboxMu.Unlock()
+	select {
+	case <-h.published:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drop forgets c and closes its queue, which stops its writePump. It is a
+// no-op for clients that were already dropped.
+func (h *Hub) drop(c *client) {
+	if !h.users[c.userId][c] {
+		return
+	}
+	delete(h.users[c.userId], c)
+	for chatRoomId := range c.rooms {
+		h.removeFromRoom(chatRoomId, c)
+	}
+	for parentId := range c.threads {
+		h.removeFromThread(parentId, c)
+	}
+	close(c.send)
+	if len(h.users[c.userId]) == 0 {
+		delete(h.users, c.userId)
+		h.endAllTyping(c.userId)
+	}
+	h.updatePresence(c.userId)
+}
+
+// subscribe adds c to the subscribers of a chat room. Callers check that
+// the user may read the room.
+func (h *Hub) subscribe(c *client, chatRoomId string) {
+	h.run(func() {
+		if !h.users[c.userId][c] {
+			return
+		}
+		if h.rooms[chatRoomId] == nil {
+			h.rooms[chatRoomId] = make(map[*client]bool)
+		}
+		h.rooms[chatRoomId][c] = true
+		c.rooms[chatRoomId] = true
+	})
+}
+
+func (h *Hub) unsubscribe(c *client, chatRoomId string) {
+	h.run(func() {
+		h.removeFromRoom(chatRoomId, c)
+	})
+}
+
+// followThread subscribes c to the replies to a message of a chat room.
+// Callers check that the user may read the room.
+func (h *Hub) followThread(c *client, chatRoomId string, parentId string) {
+	h.run(func() {
+		if !h.users[c.userId][c] {
+			return
+		}
+		if h.threads[parentId] == nil {
+			h.threads[parentId] = make(map[*client]bool)
+		}
+		h.threads[parentId][c] = true
+		c.threads[parentId] = chatRoomId
+	})
+}
+
+func (h *Hub) unfollowThread(c *client, parentId string) {
+	h.run(func() {
+		h.removeFromThread(parentId, c)
+	})
+}
+
+// unsubscribeUser removes every socket of userId from a chat room and its
+// threads, for example after the user left it.
+func (h *Hub) unsubscribeUser(chatRoomId string, userId string) {
+	h.do(func() { h.removeUserFromRoom(chatRoomId, userId) })
+	h.share(busEvent{Kind: eventUnsubscribe, ChatRoomId: chatRoomId, UserIds: []string{userId}}, nil)
+}
+
+// closeRoom drops all subscriptions of a deleted chat room and its threads.
+func (h *Hub) closeRoom(chatRoomId string) {
+	h.do(func() { h.removeAllFromRoom(chatRoomId) })
+	h.share(busEvent{Kind: eventCloseRoom, ChatRoomId: chatRoomId}, nil)
+}
+
+// removeUserFromRoom unsubscribes the sockets of a user from a chat room.
+// Only called on the hub goroutine.
+func (h *Hub) removeUserFromRoom(chatRoomId string, userId string) {
+	for c := range h.users[userId] {
+		h.removeFromRoom(chatRoomId, c)
+	}
+}
+
+// removeAllFromRoom unsubscribes every socket from a chat room. Only called
+// on the hub goroutine.
+func (h *Hub) removeAllFromRoom(chatRoomId string) {
+	for _, sockets := range h.users {
+		for c := range sockets {
+			h.removeFromRoom(chatRoomId, c)
+		}
+	}
+}
+
+// removeFromRoom unsubscribes c from a chat room and the threads it follows
+// there. Only called on the hub goroutine.
+func (h *Hub) removeFromRoom(chatRoomId string, c *client) {
+	delete(h.rooms[chatRoomId], c)
+	if len(h.rooms[chatRoomId]) == 0 {
+		delete(h.rooms, chatRoomId)
+	}
+	delete(c.rooms, chatRoomId)
+	for parentId, threadRoomId := range c.threads {
+		if threadRoomId == chatRoomId {
+			h.removeFromThread(parentId, c)
+		}
+	}
+}
+
+// removeFromThread unfollows a thread. Only called on the hub goroutine.
+func (h *Hub) removeFromThread(parentId string, c *client) {
+	delete(h.threads[parentId], c)
+	if len(h.threads[parentId]) == 0 {
+		delete(h.threads, parentId)
+	}
+	delete(c.threads, parentId)
+}
+
+// sendToClient delivers v to a single socket.
+func (h *Hub) sendToClient(c *client, v interface{}) {
+	h.run(func() {
+		if h.users[c.userId][c] {
+			h.queue(c, v)
+		}
+	})
+}
+
+// sendToRoom delivers v to every socket subscribed to a chat room except
+// the optional origin socket.
+func (h *Hub) sendToRoom(chatRoomId string, v interface{}, except *client) {
+	h.run(func() { h.deliverToRoom(chatRoomId, v, except) })
+	h.share(busEvent{Kind: eventRoom, ChatRoomId: chatRoomId}, v)
+}
+
+// sendToThread delivers v to every socket following a thread except the
+// optional origin socket.
+func (h *Hub) sendToThread(parentId string, v interface{}, except *client) {
+	h.run(func() { h.deliverToThread(parentId, v, except) })
+	h.share(busEvent{Kind: eventThread, ParentId: parentId}, v)
+}
+
+// sendToUsers delivers v to every socket of the given users except the
+// optional origin socket.
+func (h *Hub) sendToUsers(v interface{}, except *client, userIds ...string) {
+	h.run(func() { h.deliverToUsers(v, except, userIds...) })
+	h.share(busEvent{Kind: eventUsers, UserIds: userIds}, v)
+}
+
+// sendDirect delivers a new direct message v to both participants like
+// sendToUsers. Every replica where the receiver has a socket open sends
+// receipt to the sockets of the sender.
+func (h *Hub) sendDirect(v interface{}, except *client, senderId string, receiverId string, receipt interface{}) {
+	h.run(func() { h.deliverDirect(v, except, senderId, receiverId, receipt) })
+	h.share(busEvent{Kind: eventDirect, UserIds: []string{senderId, receiverId}, Receipt: encodeFrame(receipt)}, v)
+}
+
+func (h *Hub) deliverToRoom(chatRoomId string, v interface{}, except *client) {
+	for c := range h.rooms[chatRoomId] {
+		if c != except {
+			h.queue(c, v)
+		}
+	}
+}
+
+func (h *Hub) deliverToThread(parentId string, v interface{}, except *client) {
+	for c := range h.threads[parentId] {
+		if c != except {
+			h.queue(c, v)
+		}
+	}
+}
+
+func (h *Hub) deliverToUsers(v interface{}, except *client, userIds ...string) {
+	seen := make(map[string]bool)
+	for _, userId := range userIds {
+		if seen[userId] {
+			continue
+		}
+		seen[userId] = true
+		for c := range h.users[userId] {
+			if c != except {
+				h.queue(c, v)
+			}
+		}
+	}
+}
+
+func (h *Hub) deliverDirect(v interface{}, except *client, senderId string, receiverId string, receipt interface{}) {
+	delivered := len(h.users[receiverId]) > 0
+	h.deliverToUsers(v, except, receiverId, senderId)
+	if delivered && senderId != receiverId {
+		h.deliverToUsers(receipt, nil, senderId)
+		h.share(busEvent{Kind: eventUsers, UserIds: []string{senderId}}, receipt)
+	}
+}
+
+// queue hands v to c's writePump without waiting. A socket whose queue is
+// full is too slow to keep up and is disconnected rather than holding up
+// everyone else.
+func (h *Hub) queue(c *client, v interface{}) {
+	select {
+	case c.send <- v:
+		h.delivered.Inc()
+	default:
+		h.dropped.WithLabelValues(dropSlowSocket).Inc()
+		h.logger.Warn("Disconnecting slow WebSocket client", "user_id", c.userId)
+		h.drop(c)
+	}
+}
+
+// writePump is the only goroutine that writes to c.conn. It also pings the
+// peer so readPump notices dead connections.
+func (c *client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		close(c.done)
+	}()
+
+	for {
+		select {
+		case v, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub dropped this client.
+				code := c.closeCode
+				if code == 0 {
+					code = websocket.CloseNormalClosure
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+				return
+			}
+			if err := c.write(v); err != nil {
+				c.logger.Warn("Error writing to WebSocket", "error", err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// prepareRead sets the read limits and keepalive deadline of c.conn. Each
+// pong from the peer extends the deadline.
+func (c *client) prepareRead() {
+	c.conn.SetReadLimit(maxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
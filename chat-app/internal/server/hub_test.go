@@ -0,0 +1,960 @@
+package server
+
+import (
+	model "chat-app/internal/Models"
+	"chat-app/internal/database"
+	"chat-app/internal/database/databasetest"
+	"chat-app/internal/logging"
+	"chat-app/internal/pubsub"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialAs opens a WebSocket to server as user.
+func dialAs(t *testing.T, server *httptest.Server, user model.User) *websocket.Conn {
+	t.Helper()
+	token := strings.TrimPrefix(authHeader(t, user), "Bearer ")
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?access_token=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() returned error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// send writes one protocol frame to conn.
+func send(t *testing.T, conn *websocket.Conn, frameType string, id string, payload interface{}) {
+	t.Helper()
+	if err := conn.WriteJSON(newEnvelope(frameType, id, payload)); err != nil {
+		t.Fatalf("WriteJSON() returned error: %v", err)
+	}
+}
+
+// receive reads frames from conn until one of the given type arrives, or
+// returns false if none arrives within wait.
+func receive(t *testing.T, conn *websocket.Conn, frameType string, wait time.Duration) (envelope, bool) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		var frame envelope
+		if err := conn.ReadJSON(&frame); err != nil {
+			return frame, false
+		}
+		if frame.Type == frameType {
+			return frame, true
+		}
+	}
+}
+
+// payloadOf decodes the payload of frame into v.
+func payloadOf(t *testing.T, frame envelope, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(frame.Payload, v); err != nil {
+		t.Fatalf("cannot decode %s payload %s: %v", frame.Type, frame.Payload, err)
+	}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (h *Hub) subscribers(chatRoomId string) (n int) {
+	h.do(func() { n = len(h.rooms[chatRoomId]) })
+	return n
+}
+
+func (h *Hub) connections(userId string) (n int) {
+	h.do(func() { n = len(h.users[userId]) })
+	return n
+}
+
+func TestHubDeliversDirectMessagesToParticipantsOnly(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+	carol := databasetest.CreateUser(t, s.db)
+
+	aliceConn := dialAs(t, server, alice)
+	bobConn := dialAs(t, server, bob)
+	carolConn := dialAs(t, server, carol)
+	waitFor(t, "carol to connect", func() bool { return s.hub.connections(carol.Id) == 1 })
+
+	send(t, aliceConn, typeMessageSend, "client-1", model.Message{Receiver_Id: bob.Id, Content: "hi bob"})
+
+	ack, ok := receive(t, aliceConn, typeMessageAck, 2*time.Second)
+	if !ok || ack.Id != "client-1" {
+		t.Fatalf("expected the sender to get an ack for client-1, got %+v", ack)
+	}
+	var acked model.Message
+	payloadOf(t, ack, &acked)
+	if acked.MessageId == "" || acked.Created_at == "" || acked.Sender_Id != alice.Id {
+		t.Fatalf("expected the ack to carry the stored message, got %+v", acked)
+	}
+
+	update, ok := receive(t, bobConn, typeMessageNew, 2*time.Second)
+	if !ok {
+		t.Fatalf("expected the receiver to get the new message")
+	}
+	var received model.Message
+	payloadOf(t, update, &received)
+	if received.MessageId != acked.MessageId || received.Content != "hi bob" {
+		t.Fatalf("expected the receiver to get message %s, got %+v", acked.MessageId, received)
+	}
+
+	if update, ok := receive(t, carolConn, typeMessageNew, 200*time.Millisecond); ok {
+		t.Fatalf("expected a bystander to receive nothing, got %+v", update)
+	}
+	if update, ok := receive(t, aliceConn, typeMessageNew, 200*time.Millisecond); ok {
+		t.Fatalf("expected the sending socket to get only the ack, got %+v", update)
+	}
+}
+
+func TestHubDeliversRoomMessagesToSubscribedMembers(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	owner := databasetest.CreateUser(t, s.db)
+	member := databasetest.CreateUser(t, s.db)
+	outsider := databasetest.CreateUser(t, s.db)
+	roomId := databasetest.CreateOwnedChatRoom(t, s.db, owner.Id)
+	if err := s.db.AddRoomMember(roomId, member.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+
+	ownerConn := dialAs(t, server, owner)
+	memberConn := dialAs(t, server, member)
+	outsiderConn := dialAs(t, server, outsider)
+
+	send(t, memberConn, typeRoomJoin, "", roomPayload{ChatRoomId: roomId})
+	send(t, outsiderConn, typeRoomJoin, "join-1", roomPayload{ChatRoomId: roomId})
+	rejected, ok := receive(t, outsiderConn, typeError, 2*time.Second)
+	var failure errorPayload
+	payloadOf(t, rejected, &failure)
+	if !ok || rejected.Id != "join-1" || failure.Code != errorForbidden {
+		t.Fatalf("expected a forbidden error for join-1, got %+v", rejected)
+	}
+	waitFor(t, "the member to subscribe", func() bool { return s.hub.subscribers(roomId) == 1 })
+
+	send(t, ownerConn, typeMessageSend, "", model.Message{ChatRoomId: roomId, Content: "welcome"})
+	update, ok := receive(t, memberConn, typeMessageNew, 2*time.Second)
+	var received model.Message
+	payloadOf(t, update, &received)
+	if !ok || received.Content != "welcome" {
+		t.Fatalf("expected the member to receive the new message, got %+v", update)
+	}
+	if update, ok := receive(t, outsiderConn, typeMessageNew, 200*time.Millisecond); ok {
+		t.Fatalf("expected a non-member to receive nothing, got %+v", update)
+	}
+
+	// Leaving the room ends the subscription.
+	if code := doAs(t, member, http.MethodPost, server.URL+"/chatroom/"+roomId+"/leave", ""); code != http.StatusOK {
+		t.Fatalf("expected the member to leave; got %d", code)
+	}
+	if n := s.hub.subscribers(roomId); n != 1 {
+		t.Fatalf("expected only the owner to stay subscribed, got %d subscribers", n)
+	}
+
+	memberConn.Close()
+	waitFor(t, "the member to disconnect", func() bool { return s.hub.connections(member.Id) == 0 })
+}
+
+func TestProtocolErrorsTypingAndPresence(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+	// Presence only reaches users who share a room or conversation.
+	roomId := databasetest.CreateOwnedChatRoom(t, s.db, alice.Id)
+	if err := s.db.AddRoomMember(roomId, bob.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+
+	bobConn := dialAs(t, server, bob)
+	waitFor(t, "bob to connect", func() bool { return s.hub.connections(bob.Id) == 1 })
+	aliceConn := dialAs(t, server, alice)
+
+	online, ok := receive(t, bobConn, typePresence, 2*time.Second)
+	var presence presencePayload
+	payloadOf(t, online, &presence)
+	if !ok || presence.UserId != alice.Id || presence.Status != model.PresenceOnline {
+		t.Fatalf("expected bob to see alice come online, got %+v", online)
+	}
+
+	errorsFor := map[string]string{}
+	send(t, aliceConn, "message.unknown", "frame-1", nil)
+	errorsFor["frame-1"] = errorUnknownType
+	send(t, aliceConn, typeMessageSend, "frame-2", model.Message{Content: "to nobody"})
+	errorsFor["frame-2"] = errorBadRequest
+	if err := aliceConn.WriteJSON(envelope{V: 2, Type: typeTypingStart, Id: "frame-3"}); err != nil {
+		t.Fatalf("WriteJSON() returned error: %v", err)
+	}
+	errorsFor["frame-3"] = errorUnsupportedVersion
+	for range errorsFor {
+		frame, ok := receive(t, aliceConn, typeError, 2*time.Second)
+		if !ok {
+			t.Fatalf("expected an error frame")
+		}
+		var failure errorPayload
+		payloadOf(t, frame, &failure)
+		if errorsFor[frame.Id] != failure.Code {
+			t.Errorf("frame %s failed with %q, want %q", frame.Id, failure.Code, errorsFor[frame.Id])
+		}
+	}
+
+	send(t, aliceConn, typeTypingStart, "", typingPayload{ReceiverId: bob.Id})
+	typing, ok := receive(t, bobConn, typeTypingStart, 2*time.Second)
+	var indicator typingPayload
+	payloadOf(t, typing, &indicator)
+	if !ok || indicator.UserId != alice.Id || indicator.ReceiverId != bob.Id {
+		t.Fatalf("expected bob to see alice typing, got %+v", typing)
+	}
+
+	aliceConn.Close()
+	offline, ok := receive(t, bobConn, typePresence, 2*time.Second)
+	payloadOf(t, offline, &presence)
+	if !ok || presence.UserId != alice.Id || presence.Status != model.PresenceOffline {
+		t.Fatalf("expected bob to see alice go offline, got %+v", offline)
+	}
+}
+
+func TestHubDisconnectsSlowClients(t *testing.T) {
+	hub, err := NewHub(nil, pubsub.NewLocal(), logging.Discard())
+	if err != nil {
+		t.Fatalf("NewHub() returned error: %v", err)
+	}
+	go hub.Run()
+
+	slow := &client{userId: "1", send: make(chan interface{}, 1), rooms: make(map[string]bool)}
+	hub.register <- slow
+	hub.sendToUsers("first", nil, "1")
+	hub.sendToUsers("second", nil, "1")
+
+	if n := hub.connections("1"); n != 0 {
+		t.Fatalf("expected the slow client to be dropped, got %d connections", n)
+	}
+	if v := <-slow.send; v != "first" {
+		t.Fatalf("expected the queued update to be kept, got %v", v)
+	}
+	if _, ok := <-slow.send; ok {
+		t.Fatalf("expected the queue of a dropped client to be closed")
+	}
+
+	// Unregistering a dropped client must not close its queue twice.
+	hub.unregister <- slow
+	hub.connections("1")
+}
+
+func TestMessageEditsAndDeletionsArePushed(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	owner := databasetest.CreateUser(t, s.db)
+	moderator := databasetest.CreateUser(t, s.db)
+	author := databasetest.CreateUser(t, s.db)
+	reader := databasetest.CreateUser(t, s.db)
+	roomId := databasetest.CreateOwnedChatRoom(t, s.db, owner.Id)
+	for user, role := range map[string]string{moderator.Id: model.RoomRoleModerator, author.Id: model.RoomRoleMember, reader.Id: model.RoomRoleMember} {
+		if err := s.db.AddRoomMember(roomId, user, role); err != nil {
+			t.Fatalf("AddRoomMember() returned error: %v", err)
+		}
+	}
+	created, err := s.db.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: author.Id, Content: "helo"})
+	if err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+	messageURL := server.URL + "/message/" + created.MessageId
+
+	readerConn := dialAs(t, server, reader)
+	send(t, readerConn, typeRoomJoin, "", roomPayload{ChatRoomId: roomId})
+	waitFor(t, "the reader to subscribe", func() bool { return s.hub.subscribers(roomId) == 1 })
+
+	if code := doAs(t, reader, http.MethodPut, messageURL, `{"Content":"hacked"}`); code != http.StatusForbidden {
+		t.Fatalf("expected other members not to edit; got %d", code)
+	}
+	if code := doAs(t, author, http.MethodPut, messageURL, `{"Content":""}`); code != http.StatusBadRequest {
+		t.Fatalf("expected empty edits to be rejected; got %d", code)
+	}
+	if code := doAs(t, author, http.MethodPut, messageURL, `{"Content":"hello"}`); code != http.StatusOK {
+		t.Fatalf("expected the author to edit; got %d", code)
+	}
+	update, ok := receive(t, readerConn, typeMessageEdited, 2*time.Second)
+	var edited model.Message
+	payloadOf(t, update, &edited)
+	if !ok || edited.Content != "hello" || edited.Edited_at == "" {
+		t.Fatalf("expected subscribers to receive the edit, got %+v", update)
+	}
+
+	if code := doAs(t, author, http.MethodGet, messageURL+"/revisions", ""); code != http.StatusForbidden {
+		t.Fatalf("expected authors not to read the revision history; got %d", code)
+	}
+	if code := doAs(t, moderator, http.MethodDelete, messageURL, ""); code != http.StatusOK {
+		t.Fatalf("expected moderators to delete; got %d", code)
+	}
+	update, ok = receive(t, readerConn, typeMessageDeleted, 2*time.Second)
+	var deleted model.Message
+	payloadOf(t, update, &deleted)
+	if !ok || deleted.MessageId != created.MessageId || deleted.Content != "" || deleted.Deleted_at == "" {
+		t.Fatalf("expected subscribers to receive the tombstone, got %+v", update)
+	}
+	if code := doAs(t, moderator, http.MethodGet, messageURL+"/revisions", ""); code != http.StatusOK {
+		t.Fatalf("expected moderators to read the revision history; got %d", code)
+	}
+	if code := doAs(t, author, http.MethodPut, messageURL, `{"Content":"undo"}`); code != http.StatusConflict {
+		t.Fatalf("expected edits of deleted messages to conflict; got %d", code)
+	}
+	if code := doAs(t, owner, http.MethodDelete, server.URL+"/message/999999", ""); code != http.StatusNotFound {
+		t.Fatalf("expected missing messages to be not found; got %d", code)
+	}
+}
+
+func TestThreadRepliesReachFollowers(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	owner := databasetest.CreateUser(t, s.db)
+	member := databasetest.CreateUser(t, s.db)
+	follower := databasetest.CreateUser(t, s.db)
+	outsider := databasetest.CreateUser(t, s.db)
+	roomId := databasetest.CreateOwnedChatRoom(t, s.db, owner.Id)
+	for _, user := range []model.User{member, follower} {
+		if err := s.db.AddRoomMember(roomId, user.Id, model.RoomRoleMember); err != nil {
+			t.Fatalf("AddRoomMember() returned error: %v", err)
+		}
+	}
+	parent, err := s.db.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: member.Id, Content: "lunch?"})
+	if err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+
+	memberConn := dialAs(t, server, member)
+	followerConn := dialAs(t, server, follower)
+	outsiderConn := dialAs(t, server, outsider)
+	send(t, memberConn, typeRoomJoin, "", roomPayload{ChatRoomId: roomId})
+	send(t, followerConn, typeThreadFollow, "", threadPayload{MessageId: parent.MessageId})
+	send(t, outsiderConn, typeThreadFollow, "follow-1", threadPayload{MessageId: parent.MessageId})
+	rejected, ok := receive(t, outsiderConn, typeError, 2*time.Second)
+	var failure errorPayload
+	payloadOf(t, rejected, &failure)
+	if !ok || rejected.Id != "follow-1" || failure.Code != errorForbidden {
+		t.Fatalf("expected a forbidden error for follow-1, got %+v", rejected)
+	}
+	waitFor(t, "the follower to follow", func() bool {
+		var n int
+		s.hub.do(func() { n = len(s.hub.threads[parent.MessageId]) })
+		return n == 1
+	})
+
+	// A reply only needs to name its parent.
+	reply := `{"ParentMessageId":"` + parent.MessageId + `","Content":"sure"}`
+	if code := doAs(t, owner, http.MethodPost, server.URL+"/message", reply); code != http.StatusCreated {
+		t.Fatalf("expected the reply to be created; got %d", code)
+	}
+	update, ok := receive(t, followerConn, typeMessageNew, 2*time.Second)
+	var received model.Message
+	payloadOf(t, update, &received)
+	if !ok || received.Content != "sure" || received.ParentMessageId != parent.MessageId || received.ChatRoomId != roomId {
+		t.Fatalf("expected the follower to receive the reply, got %+v", update)
+	}
+	update, ok = receive(t, memberConn, typeThreadUpdated, 2*time.Second)
+	var summary model.Message
+	payloadOf(t, update, &summary)
+	if !ok || summary.MessageId != parent.MessageId || summary.ReplyCount != 1 || summary.Last_reply_at != received.Created_at {
+		t.Fatalf("expected room subscribers to get the thread summary, got %+v", update)
+	}
+	if update, ok := receive(t, memberConn, typeMessageNew, 200*time.Millisecond); ok {
+		t.Fatalf("expected replies not to reach the whole room, got %+v", update)
+	}
+
+	threadURL := server.URL + "/message/" + parent.MessageId + "/thread"
+	if code := doAs(t, member, http.MethodGet, threadURL, ""); code != http.StatusOK {
+		t.Fatalf("expected members to read the thread; got %d", code)
+	}
+	if code := doAs(t, outsider, http.MethodGet, threadURL, ""); code != http.StatusForbidden {
+		t.Fatalf("expected non-members not to read the thread; got %d", code)
+	}
+	if code := doAs(t, member, http.MethodGet, server.URL+"/message/"+received.MessageId+"/thread", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected replies not to have threads; got %d", code)
+	}
+	if code := doAs(t, outsider, http.MethodPost, server.URL+"/message", reply); code != http.StatusForbidden {
+		t.Fatalf("expected non-members not to reply; got %d", code)
+	}
+}
+
+func TestReactionsAreCountedAndPushed(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	owner := databasetest.CreateUser(t, s.db)
+	member := databasetest.CreateUser(t, s.db)
+	outsider := databasetest.CreateUser(t, s.db)
+	roomId := databasetest.CreateOwnedChatRoom(t, s.db, owner.Id)
+	if err := s.db.AddRoomMember(roomId, member.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+	message, err := s.db.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: owner.Id, Content: "shipped!"})
+	if err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+	reactionURL := server.URL + "/message/" + message.MessageId + "/reactions/" + url.PathEscape("👍")
+
+	memberConn := dialAs(t, server, member)
+	send(t, memberConn, typeRoomJoin, "", roomPayload{ChatRoomId: roomId})
+	waitFor(t, "the member to subscribe", func() bool { return s.hub.subscribers(roomId) == 1 })
+
+	if code := doAs(t, owner, http.MethodPost, reactionURL, ""); code != http.StatusCreated {
+		t.Fatalf("expected the reaction to be added; got %d", code)
+	}
+	update, ok := receive(t, memberConn, typeReactionAdded, 2*time.Second)
+	var added reactionPayload
+	payloadOf(t, update, &added)
+	if !ok || added.MessageId != message.MessageId || added.UserId != owner.Id || added.Emoji != "👍" {
+		t.Fatalf("expected subscribers to receive the reaction, got %+v", update)
+	}
+	if code := doAs(t, owner, http.MethodPost, reactionURL, ""); code != http.StatusConflict {
+		t.Fatalf("expected reacting twice to conflict; got %d", code)
+	}
+	if code := doAs(t, outsider, http.MethodPost, reactionURL, ""); code != http.StatusForbidden {
+		t.Fatalf("expected non-members not to react; got %d", code)
+	}
+	if code := doAs(t, member, http.MethodPost, server.URL+"/message/"+message.MessageId+"/reactions/yes", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected words to be rejected as reactions; got %d", code)
+	}
+
+	history := func(user model.User) []model.Reaction {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/messages/"+roomId, nil)
+		req.Header.Set("Authorization", authHeader(t, user))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		defer resp.Body.Close()
+		var page messagePageResponse
+		json.NewDecoder(resp.Body).Decode(&page)
+		if len(page.Messages) != 1 {
+			t.Fatalf("expected one message in the history, got %+v", page)
+		}
+		return page.Messages[0].Reactions
+	}
+	if got := history(member); len(got) != 1 || got[0] != (model.Reaction{Emoji: "👍", Count: 1}) {
+		t.Fatalf("member sees reactions %+v", got)
+	}
+	if got := history(owner); len(got) != 1 || !got[0].ReactedByMe {
+		t.Fatalf("owner sees reactions %+v, want their own marked", got)
+	}
+
+	if code := doAs(t, owner, http.MethodDelete, reactionURL, ""); code != http.StatusOK {
+		t.Fatalf("expected the reaction to be removed; got %d", code)
+	}
+	if _, ok := receive(t, memberConn, typeReactionRemoved, 2*time.Second); !ok {
+		t.Fatalf("expected subscribers to learn about the removal")
+	}
+	if code := doAs(t, owner, http.MethodDelete, reactionURL, ""); code != http.StatusNotFound {
+		t.Fatalf("expected removing a missing reaction to be not found; got %d", code)
+	}
+}
+
+func TestReadReceiptsAndUnreadCounts(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+	outsider := databasetest.CreateUser(t, s.db)
+	roomId := databasetest.CreateOwnedChatRoom(t, s.db, alice.Id)
+	if err := s.db.AddRoomMember(roomId, bob.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+	if _, err := s.db.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: alice.Id, Content: "welcome"}); err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+
+	if _, err := s.db.CreateMessage(model.Message{Receiver_Id: bob.Id, Sender_Id: alice.Id, Content: "are you there?"}); err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+
+	aliceConn := dialAs(t, server, alice)
+	bobConn := dialAs(t, server, bob)
+	waitFor(t, "bob to connect", func() bool { return s.hub.connections(bob.Id) == 1 })
+	send(t, aliceConn, typeMessageSend, "online", model.Message{Receiver_Id: bob.Id, Content: "hello"})
+	ack, _ := receive(t, aliceConn, typeMessageAck, 2*time.Second)
+	var sent model.Message
+	payloadOf(t, ack, &sent)
+	frame, ok := receive(t, aliceConn, typeReceipt, 2*time.Second)
+	var receipt receiptPayload
+	payloadOf(t, frame, &receipt)
+	if !ok || receipt != (receiptPayload{MessageId: sent.MessageId, UserId: bob.Id, Status: receiptDelivered}) {
+		t.Fatalf("expected a delivery receipt for message %s, got %+v", sent.MessageId, frame)
+	}
+	receive(t, bobConn, typeMessageNew, 2*time.Second)
+
+	unread := func(user model.User) unreadSummary {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/me/unread", nil)
+		req.Header.Set("Authorization", authHeader(t, user))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		defer resp.Body.Close()
+		var summary unreadSummary
+		json.NewDecoder(resp.Body).Decode(&summary)
+		return summary
+	}
+	if summary := unread(bob); summary.Total != 3 || len(summary.Conversations) != 2 ||
+		summary.Conversations[0] != (model.UnreadCount{ChatRoomId: roomId, Unread: 1}) ||
+		summary.Conversations[1] != (model.UnreadCount{UserId: alice.Id, Unread: 2}) {
+		t.Fatalf("unexpected unread summary for bob: %+v", summary)
+	}
+
+	if code := doAs(t, bob, http.MethodPost, server.URL+"/messages/direct/"+alice.Id+"/read", ""); code != http.StatusOK {
+		t.Fatalf("expected bob to mark the conversation read; got %d", code)
+	}
+	frame, ok = receive(t, aliceConn, typeReceipt, 2*time.Second)
+	payloadOf(t, frame, &receipt)
+	if !ok || receipt != (receiptPayload{MessageId: sent.MessageId, UserId: bob.Id, Status: receiptRead}) {
+		t.Fatalf("expected a read receipt up to message %s, got %+v", sent.MessageId, frame)
+	}
+
+	if code := doAs(t, outsider, http.MethodPost, server.URL+"/chatroom/"+roomId+"/read", ""); code != http.StatusForbidden {
+		t.Fatalf("expected non-members not to mark the room read; got %d", code)
+	}
+	if code := doAs(t, bob, http.MethodPost, server.URL+"/chatroom/"+roomId+"/read", `{"message_id":"`+sent.MessageId+`"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected a message of another conversation to be rejected; got %d", code)
+	}
+	if code := doAs(t, bob, http.MethodPost, server.URL+"/chatroom/"+roomId+"/read", ""); code != http.StatusOK {
+		t.Fatalf("expected bob to mark the room read; got %d", code)
+	}
+	if summary := unread(bob); summary.Total != 0 || len(summary.Conversations) != 0 {
+		t.Fatalf("expected bob to have read everything, got %+v", summary)
+	}
+
+	bobConn.Close()
+	waitFor(t, "bob to disconnect", func() bool { return s.hub.connections(bob.Id) == 0 })
+	send(t, aliceConn, typeMessageSend, "offline", model.Message{Receiver_Id: bob.Id, Content: "bye"})
+	if frame, ok := receive(t, aliceConn, typeReceipt, 200*time.Millisecond); ok {
+		t.Fatalf("expected no delivery receipt while the receiver is offline, got %+v", frame)
+	}
+}
+
+func TestReadingYourOwnMessageSendsNoReceipt(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+	if _, err := s.db.CreateMessage(model.Message{Receiver_Id: alice.Id, Sender_Id: bob.Id, Content: "ping"}); err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+	if _, err := s.db.CreateMessage(model.Message{Receiver_Id: bob.Id, Sender_Id: alice.Id, Content: "pong"}); err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+
+	bobConn := dialAs(t, server, bob)
+	waitFor(t, "bob to connect", func() bool { return s.hub.connections(bob.Id) == 1 })
+	// The newest message in the conversation is alice's own reply.
+	if code := doAs(t, alice, http.MethodPost, server.URL+"/messages/direct/"+bob.Id+"/read", ""); code != http.StatusOK {
+		t.Fatalf("expected alice to mark the conversation read; got %d", code)
+	}
+	if frame, ok := receive(t, bobConn, typeReceipt, 200*time.Millisecond); ok {
+		t.Fatalf("expected no read receipt for alice's own message, got %+v", frame)
+	}
+}
+
+func TestTypingIndicatorsExpireAndAreRateLimited(t *testing.T) {
+	defer func(timeout time.Duration) { typingTimeout = timeout }(typingTimeout)
+	typingTimeout = 200 * time.Millisecond
+
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+	roomId := databasetest.CreateOwnedChatRoom(t, s.db, alice.Id)
+	if err := s.db.AddRoomMember(roomId, bob.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+
+	aliceConn := dialAs(t, server, alice)
+	aliceOther := dialAs(t, server, alice)
+	bobConn := dialAs(t, server, bob)
+	for _, conn := range []*websocket.Conn{aliceConn, aliceOther, bobConn} {
+		send(t, conn, typeRoomJoin, "", roomPayload{ChatRoomId: roomId})
+	}
+	waitFor(t, "everyone to subscribe", func() bool { return s.hub.subscribers(roomId) == 3 })
+	inRoom := typingPayload{ChatRoomId: roomId}
+
+	// Repeated starts are relayed once, and the indicator expires on its own.
+	send(t, aliceConn, typeTypingStart, "", inRoom)
+	send(t, aliceConn, typeTypingStart, "", inRoom)
+	frame, ok := receive(t, bobConn, typeTypingStart, 2*time.Second)
+	var typing typingPayload
+	payloadOf(t, frame, &typing)
+	if !ok || typing != (typingPayload{UserId: alice.Id, ChatRoomId: roomId}) {
+		t.Fatalf("expected bob to see alice typing, got %+v", frame)
+	}
+	bobConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var next envelope
+	if err := bobConn.ReadJSON(&next); err != nil || next.Type != typeTypingStop {
+		t.Fatalf("expected the indicator to expire without another start, got %+v, %v", next, err)
+	}
+
+	send(t, aliceConn, typeTypingStart, "", inRoom)
+	send(t, aliceConn, typeTypingStop, "", inRoom)
+	if _, ok := receive(t, bobConn, typeTypingStop, 2*time.Second); !ok {
+		t.Fatalf("expected bob to see alice stop typing")
+	}
+
+	// Sending a message ends the indicator.
+	send(t, aliceOther, typeTypingStart, "", inRoom)
+	receive(t, bobConn, typeTypingStart, 2*time.Second)
+	send(t, aliceOther, typeMessageSend, "", model.Message{ChatRoomId: roomId, Content: "done"})
+	if _, ok := receive(t, bobConn, typeMessageNew, 2*time.Second); !ok {
+		t.Fatalf("expected bob to get the message")
+	}
+	if _, ok := receive(t, bobConn, typeTypingStop, 2*time.Second); !ok {
+		t.Fatalf("expected the message to end alice's indicator")
+	}
+
+	for i := 0; i <= typingBurst; i++ {
+		send(t, aliceConn, typeTypingStart, "", inRoom)
+	}
+	frame, ok = receive(t, aliceConn, typeError, 2*time.Second)
+	var failure errorPayload
+	payloadOf(t, frame, &failure)
+	if !ok || failure.Code != errorRateLimited {
+		t.Fatalf("expected a burst of typing frames to be rate limited, got %+v", frame)
+	}
+
+	if frame, ok := receive(t, aliceOther, typeTypingStart, 200*time.Millisecond); ok {
+		t.Fatalf("expected the typing user's own sockets to get nothing, got %+v", frame)
+	}
+}
+
+func TestPresenceReachesContactsOnly(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+	carol := databasetest.CreateUser(t, s.db)
+	roomId := databasetest.CreateOwnedChatRoom(t, s.db, alice.Id)
+	if err := s.db.AddRoomMember(roomId, bob.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+
+	bobConn := dialAs(t, server, bob)
+	carolConn := dialAs(t, server, carol)
+	waitFor(t, "bob and carol to connect", func() bool {
+		return s.hub.connections(bob.Id) == 1 && s.hub.connections(carol.Id) == 1
+	})
+	aliceConn := dialAs(t, server, alice)
+	aliceOther := dialAs(t, server, alice)
+	waitFor(t, "alice to connect", func() bool { return s.hub.connections(alice.Id) == 2 })
+
+	expect := func(status string) {
+		t.Helper()
+		frame, ok := receive(t, bobConn, typePresence, 2*time.Second)
+		var presence presencePayload
+		payloadOf(t, frame, &presence)
+		if !ok || presence != (presencePayload{UserId: alice.Id, Status: status}) {
+			t.Fatalf("expected bob to see alice %s, got %+v", status, frame)
+		}
+	}
+	expect(model.PresenceOnline)
+
+	// Alice is away once all of her sockets are.
+	send(t, aliceConn, typePresenceSet, "", presencePayload{Status: model.PresenceAway})
+	send(t, aliceOther, typePresenceSet, "", presencePayload{Status: model.PresenceAway})
+	expect(model.PresenceAway)
+
+	getPresence := func(user model.User, ids ...string) []model.Presence {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/presence?ids="+strings.Join(ids, ","), nil)
+		req.Header.Set("Authorization", authHeader(t, user))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		var presences []model.Presence
+		json.NewDecoder(resp.Body).Decode(&presences)
+		resp.Body.Close()
+		return presences
+	}
+	// Carol shares nothing with bob, so her presence is left out like an
+	// unknown user's.
+	presences := getPresence(bob, alice.Id, carol.Id, bob.Id, "999999999")
+	if len(presences) != 2 || presences[0].UserId != alice.Id || presences[0].Status != model.PresenceAway ||
+		presences[0].Last_seen_at == "" || presences[1].UserId != bob.Id || presences[1].Status != model.PresenceOnline {
+		t.Fatalf("unexpected presence of alice and bob: %+v", presences)
+	}
+	admin := databasetest.CreateUser(t, s.db)
+	admin.Role = model.RoleAdmin
+	if err := s.db.SetUserRole(admin.Id, model.RoleAdmin); err != nil {
+		t.Fatalf("SetUserRole() returned error: %v", err)
+	}
+	if presences := getPresence(admin, carol.Id); len(presences) != 1 || presences[0].Status != model.PresenceOnline {
+		t.Fatalf("expected admins to see anyone's presence, got %+v", presences)
+	}
+	if code := doAs(t, bob, http.MethodGet, server.URL+"/presence", ""); code != http.StatusBadRequest {
+		t.Fatalf("expected a presence query without ids to be rejected; got %d", code)
+	}
+
+	send(t, aliceConn, typePresenceSet, "", presencePayload{Status: model.PresenceOnline})
+	expect(model.PresenceOnline)
+	aliceConn.Close()
+	aliceOther.Close()
+	expect(model.PresenceOffline)
+
+	if frame, ok := receive(t, carolConn, typePresence, 200*time.Millisecond); ok {
+		t.Fatalf("expected a stranger not to see alice's presence, got %+v", frame)
+	}
+}
+
+// newReplica returns another server on the same database and bus as s, like
+// a second replica behind a load balancer.
+func newReplica(t *testing.T, s *Server) *Server {
+	t.Helper()
+	hub, err := NewHub(s.db.GetContacts, s.hub.bus, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewHub() returned error: %v", err)
+	}
+	go hub.Run()
+	return &Server{logger: s.logger, db: s.db, passwords: s.passwords, mailer: s.mailer, baseURL: s.baseURL, hub: hub, bus: s.bus,
+		metrics: newMetrics(hub, s.db), tracerProvider: s.tracerProvider, tracer: s.tracer}
+}
+
+func TestReplicasShareDeliveriesOverTheBus(t *testing.T) {
+	first, _ := newTestServer(t)
+	second := newReplica(t, first)
+	firstServer := httptest.NewServer(first.RegisterRoutes())
+	defer firstServer.Close()
+	secondServer := httptest.NewServer(second.RegisterRoutes())
+	defer secondServer.Close()
+
+	alice := databasetest.CreateUser(t, first.db)
+	bob := databasetest.CreateUser(t, first.db)
+	roomId := databasetest.CreateOwnedChatRoom(t, first.db, alice.Id)
+	if err := first.db.AddRoomMember(roomId, bob.Id, model.RoomRoleMember); err != nil {
+		t.Fatalf("AddRoomMember() returned error: %v", err)
+	}
+
+	bobConn := dialAs(t, secondServer, bob)
+	waitFor(t, "bob to connect", func() bool { return second.hub.connections(bob.Id) == 1 })
+	aliceConn := dialAs(t, firstServer, alice)
+	frame, ok := receive(t, bobConn, typePresence, 2*time.Second)
+	var presence presencePayload
+	payloadOf(t, frame, &presence)
+	if !ok || presence != (presencePayload{UserId: alice.Id, Status: model.PresenceOnline}) {
+		t.Fatalf("expected bob to see alice come online on the other replica, got %+v", frame)
+	}
+	if statuses := second.hub.statuses([]string{alice.Id}); statuses[alice.Id] != model.PresenceOnline {
+		t.Fatalf("expected the second replica to know alice is online, got %v", statuses)
+	}
+
+	send(t, aliceConn, typeRoomJoin, "", roomPayload{ChatRoomId: roomId})
+	send(t, bobConn, typeRoomJoin, "", roomPayload{ChatRoomId: roomId})
+	waitFor(t, "both to subscribe", func() bool {
+		return first.hub.subscribers(roomId) == 1 && second.hub.subscribers(roomId) == 1
+	})
+
+	send(t, aliceConn, typeMessageSend, "", model.Message{ChatRoomId: roomId, Content: "hello everyone"})
+	frame, ok = receive(t, bobConn, typeMessageNew, 2*time.Second)
+	var message model.Message
+	payloadOf(t, frame, &message)
+	if !ok || message.Content != "hello everyone" {
+		t.Fatalf("expected bob to get the room message across replicas, got %+v", frame)
+	}
+
+	send(t, aliceConn, typeMessageSend, "", model.Message{Receiver_Id: bob.Id, Content: "psst"})
+	if frame, ok := receive(t, bobConn, typeMessageNew, 2*time.Second); !ok {
+		t.Fatalf("expected bob to get the direct message across replicas, got %+v", frame)
+	}
+	frame, ok = receive(t, aliceConn, typeReceipt, 2*time.Second)
+	var receipt receiptPayload
+	payloadOf(t, frame, &receipt)
+	if !ok || receipt.UserId != bob.Id || receipt.Status != receiptDelivered {
+		t.Fatalf("expected alice to get a delivery receipt from the other replica, got %+v", frame)
+	}
+
+	send(t, bobConn, typeTypingStart, "", typingPayload{ChatRoomId: roomId})
+	if frame, ok := receive(t, aliceConn, typeTypingStart, 2*time.Second); !ok {
+		t.Fatalf("expected alice to see bob typing on the other replica, got %+v", frame)
+	}
+
+	// Leaving through one replica unsubscribes the sockets on the other.
+	if code := doAs(t, bob, http.MethodPost, firstServer.URL+"/chatroom/"+roomId+"/leave", ""); code != http.StatusOK {
+		t.Fatalf("expected bob to leave the room; got %d", code)
+	}
+	waitFor(t, "bob to be unsubscribed", func() bool { return second.hub.subscribers(roomId) == 0 })
+
+	aliceConn.Close()
+	frame, ok = receive(t, bobConn, typePresence, 2*time.Second)
+	payloadOf(t, frame, &presence)
+	if !ok || presence != (presencePayload{UserId: alice.Id, Status: model.PresenceOffline}) {
+		t.Fatalf("expected bob to see alice go offline on the other replica, got %+v", frame)
+	}
+}
+
+// closeTrackingDB is a slow database that fails the test when it is used
+// after Close.
+type closeTrackingDB struct {
+	database.Service
+	t *testing.T
+
+	mu       sync.Mutex
+	closed   bool
+	lastSeen int
+}
+
+func (db *closeTrackingDB) WithContext(ctx context.Context) database.Service { return db }
+
+func (db *closeTrackingDB) use(method string) {
+	time.Sleep(50 * time.Millisecond)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		db.t.Errorf("%s called after Close", method)
+	}
+}
+
+func (db *closeTrackingDB) UpdateLastSeen(Id string) error {
+	db.use("UpdateLastSeen")
+	db.mu.Lock()
+	db.lastSeen++
+	db.mu.Unlock()
+	return db.Service.UpdateLastSeen(Id)
+}
+
+func (db *closeTrackingDB) GetContacts(user_id string) ([]string, error) {
+	db.use("GetContacts")
+	return db.Service.GetContacts(user_id)
+}
+
+func (db *closeTrackingDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+	return db.Service.Close()
+}
+
+func TestPresenceOfACrashedReplicaExpires(t *testing.T) {
+	bus := pubsub.NewLocal()
+	newHub := func() *Hub {
+		hub, err := NewHub(nil, bus, logging.Discard())
+		if err != nil {
+			t.Fatalf("NewHub() returned error: %v", err)
+		}
+		hub.heartbeat = 20 * time.Millisecond
+		go hub.Run()
+		return hub
+	}
+	alive := newHub()
+	crashing := newHub()
+
+	crashing.register <- newClient(nil, "alice", logging.Discard(), nil)
+	waitFor(t, "alice to be online on the other replica", func() bool {
+		return alive.statuses([]string{"alice"})["alice"] == model.PresenceOnline
+	})
+	// Heartbeats keep the status while the replica runs.
+	time.Sleep(10 * alive.heartbeat)
+	if status := alive.statuses([]string{"alice"})["alice"]; status != model.PresenceOnline {
+		t.Fatalf("expected alice to stay online while her replica runs, got %s", status)
+	}
+
+	// Stopping the hub without shutdown neither drops alice nor says so.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := crashing.stop(ctx); err != nil {
+		t.Fatalf("stop() returned error: %v", err)
+	}
+	waitFor(t, "alice to go offline", func() bool {
+		return alive.statuses([]string{"alice"})["alice"] == model.PresenceOffline
+	})
+}
+
+func TestShutdownDrainsSocketsWithGoingAway(t *testing.T) {
+	s, _ := newTestServer(t)
+	db := &closeTrackingDB{Service: s.db, t: t}
+	s.db = db
+	s.hub.do(func() { s.hub.audience = db.GetContacts })
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+	s.http = server.Config
+
+	alice := databasetest.CreateUser(t, s.db)
+	aliceConn := dialAs(t, server, alice)
+	waitFor(t, "alice to connect", func() bool { return s.hub.connections(alice.Id) == 1 })
+
+	// Updates queued before the shutdown are still written.
+	s.hub.sendToUsers(newEnvelope(typeMessageNew, "", model.Message{Content: "last words"}), nil, alice.Id)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() returned error: %v", err)
+	}
+
+	aliceConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var frame envelope
+	if err := aliceConn.ReadJSON(&frame); err != nil || frame.Type != typeMessageNew {
+		t.Fatalf("expected the queued update before the close frame, got %+v, %v", frame, err)
+	}
+	if err := aliceConn.ReadJSON(&frame); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected a going away close frame, got %+v, %v", frame, err)
+	}
+	if n := s.hub.connections(alice.Id); n != 0 {
+		t.Fatalf("expected no sockets after shutdown, got %d", n)
+	}
+	// The disconnection was recorded before the database closed.
+	db.mu.Lock()
+	lastSeen := db.lastSeen
+	db.mu.Unlock()
+	if lastSeen != 2 {
+		t.Errorf("expected last_seen_at to be recorded on connect and disconnect, got %d updates", lastSeen)
+	}
+	select {
+	case <-s.hub.finished:
+	default:
+		t.Error("expected the hub to stop")
+	}
+	select {
+	case <-s.hub.published:
+	default:
+		t.Error("expected the outbox to be drained")
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	if conn, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		conn.Close()
+		t.Fatal("expected no new connections after shutdown")
+	}
+}
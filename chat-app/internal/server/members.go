@@ -0,0 +1,115 @@
+package server
+
+import (
+	model "chat-app/internal/Models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func (s *Server) joinChatRoom(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	principal := principalFrom(r)
+
+	chatRoom, err := s.db.WithContext(r.Context()).GetChatRoom(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "No Chatroom exists with Id: "+params["id"])
+		return
+	}
+	if chatRoom.IsPrivate {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Private chat rooms can only be joined by invitation")
+		return
+	}
+	s.addRoomMember(r.Context(), w, chatRoom.ChatRoomId, principal.UserId)
+}
+
+func (s *Server) inviteToChatRoom(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	var invite struct {
+		UserId string `json:"user_id"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&invite)
+
+	if _, err := s.db.WithContext(r.Context()).GetChatRoom(params["id"]); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "No Chatroom exists with Id: "+params["id"])
+		return
+	}
+	if invite.UserId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "user_id is required")
+		return
+	}
+	if _, err := s.db.WithContext(r.Context()).GetAUserv2(invite.UserId); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "No User exists with Id: "+invite.UserId)
+		return
+	}
+	s.addRoomMember(r.Context(), w, params["id"], invite.UserId)
+}
+
+// addRoomMember adds user_id to a room as a plain member and writes the
+// response for the join and invite handlers.
+func (s *Server) addRoomMember(ctx context.Context, w http.ResponseWriter, chatRoomId string, user_id string) {
+	role, err := s.db.WithContext(ctx).GetRoomRole(chatRoomId, user_id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	if role != "" {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "User "+user_id+" is already a member of ChatRoom "+chatRoomId)
+		return
+	}
+	if err := s.db.WithContext(ctx).AddRoomMember(chatRoomId, user_id, model.RoomRoleMember); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	fmt.Fprint(w, "User "+user_id+" joined ChatRoom "+chatRoomId)
+}
+
+func (s *Server) leaveChatRoom(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	principal := principalFrom(r)
+
+	role, err := s.db.WithContext(r.Context()).GetRoomRole(params["id"], principal.UserId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	if role == model.RoomRoleOwner {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "The owner cannot leave a chat room, delete it instead")
+		return
+	}
+	if err := s.db.WithContext(r.Context()).RemoveRoomMember(params["id"], principal.UserId); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+	s.hub.unsubscribeUser(params["id"], principal.UserId)
+	fmt.Fprint(w, "User "+principal.UserId+" left ChatRoom "+params["id"])
+}
+
+func (s *Server) getChatRoomMembers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	members, err := s.db.WithContext(r.Context()).GetRoomMembers(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(members)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	jwtauth "chat-app/internal/Authentication"
+	model "chat-app/internal/Models"
+	"chat-app/internal/database"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// canModerate reports whether principal may change and review other users'
+// messages: admins anywhere, room owners and moderators in their rooms.
+func (s *Server) canModerate(ctx context.Context, principal jwtauth.Principal, message model.Message) (bool, error) {
+	if principal.HasRole(model.RoleAdmin) {
+		return true, nil
+	}
+	if message.ChatRoomId == "" {
+		return false, nil
+	}
+	role, err := s.db.WithContext(ctx).GetRoomRole(message.ChatRoomId, principal.UserId)
+	return role == model.RoomRoleOwner || role == model.RoomRoleModerator, err
+}
+
+// editableMessage loads the message in the {id} route variable and checks
+// that the caller wrote it or moderates it. It writes the error response and
+// returns false otherwise.
+func (s *Server) editableMessage(w http.ResponseWriter, r *http.Request) (model.Message, bool) {
+	params := mux.Vars(r)
+	principal := principalFrom(r)
+
+	message, err := s.db.WithContext(r.Context()).GetMessage(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "No Message exists with Id: "+params["id"])
+		return message, false
+	}
+	if message.Sender_Id == principal.UserId {
+		return message, true
+	}
+	ok, err := s.canModerate(r.Context(), principal, message)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return message, false
+	}
+	if !ok {
+		forbidden(w)
+	}
+	return message, ok
+}
+
+// writeRevised writes the result of an edit or deletion and announces it to
+// everyone who can see the message.
+func (s *Server) writeRevised(w http.ResponseWriter, r *http.Request, frameType string, message model.Message, err error) {
+	if err == database.ErrMessageDeleted {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	s.publish(r.Context(), frameType, message, nil)
+	json.NewEncoder(w).Encode(&message)
+}
+
+func (s *Server) updateMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	message, ok := s.editableMessage(w, r)
+	if !ok {
+		return
+	}
+	var edit model.Message
+	_ = json.NewDecoder(r.Body).Decode(&edit)
+	if edit.Content == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Content is required")
+		return
+	}
+
+	edited, err := s.db.WithContext(r.Context()).UpdateMessage(message.MessageId, edit.Content, principalFrom(r).UserId)
+	s.writeRevised(w, r, typeMessageEdited, edited, err)
+}
+
+func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	message, ok := s.editableMessage(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := s.db.WithContext(r.Context()).DeleteMessage(message.MessageId, principalFrom(r).UserId)
+	s.writeRevised(w, r, typeMessageDeleted, deleted, err)
+}
+
+// getMessageRevisions shows the edit history of a message to moderators.
+func (s *Server) getMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+
+	message, err := s.db.WithContext(r.Context()).GetMessage(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "No Message exists with Id: "+params["id"])
+		return
+	}
+	ok, err := s.canModerate(r.Context(), principalFrom(r), message)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	if !ok {
+		forbidden(w)
+		return
+	}
+
+	revisions, err := s.db.WithContext(r.Context()).GetMessageRevisions(message.MessageId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// getMessageThread pages through the replies to a room message.
+func (s *Server) getMessageThread(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+
+	parent, err := s.db.WithContext(r.Context()).GetMessage(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "No Message exists with Id: "+params["id"])
+		return
+	}
+	if parent.ChatRoomId == "" || parent.ParentMessageId != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Message "+params["id"]+" does not start a thread")
+		return
+	}
+	if ok, err := s.canAccessRoom(r.Context(), principalFrom(r), parent.ChatRoomId); err != nil || !ok {
+		forbidden(w)
+		return
+	}
+	s.writeMessagePage(w, r, func(page model.MessagePage) ([]model.Message, error) {
+		return s.db.WithContext(r.Context()).GetThread(parent.MessageId, page)
+	})
+}
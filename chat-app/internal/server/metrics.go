@@ -0,0 +1,158 @@
+package server
+
+import (
+	"chat-app/internal/database"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Causes of dropped hub deliveries.
+const (
+	dropSlowSocket = "slow_socket"
+	dropOutboxFull = "outbox_full"
+)
+
+// metrics are served in the Prometheus format on /metrics. Each server has
+// its own registry.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	messages prometheus.Counter
+}
+
+// newMetrics registers the server's metrics with those of the hub, of the
+// database connection pool if db has one, and of the Go runtime.
+func newMetrics(hub *Hub, db database.Service) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_http_requests_total",
+			Help: "HTTP requests served, by route template, method and status code.",
+		}, []string{"route", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "chat_http_request_duration_seconds",
+			Help:    "Time taken to serve HTTP requests, by route template and method. WebSocket connections are left out.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		messages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "chat_messages_sent_total",
+			Help: "Messages sent through this replica, over HTTP or WebSockets.",
+		}),
+	}
+	m.registry.MustRegister(m.requests, m.latency, m.messages, hub,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if pool, ok := db.(database.Pool); ok {
+		m.registry.MustRegister(poolCollector{pool})
+	}
+	return m
+}
+
+// handler serves the metrics.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observe records a request served by a route. WebSocket connections last
+// as long as the socket, so only their count is recorded.
+func (m *metrics) observe(route string, method string, status int, elapsed time.Duration) {
+	m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	if status != http.StatusSwitchingProtocols {
+		m.latency.WithLabelValues(route, method).Observe(elapsed.Seconds())
+	}
+}
+
+var (
+	socketsDesc = prometheus.NewDesc("chat_websocket_connections",
+		"WebSocket connections open on this replica.", nil, nil)
+	queueDesc = prometheus.NewDesc("chat_hub_queue_depth",
+		`Updates waiting to be written to WebSockets (queue="sockets") or published on the pubsub bus (queue="bus").`,
+		[]string{"queue"}, nil)
+)
+
+// newHubCounters returns the counters updated by the hub as it delivers.
+func newHubCounters() (delivered prometheus.Counter, dropped *prometheus.CounterVec) {
+	delivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chat_hub_deliveries_total",
+		Help: "Updates, such as new messages, receipts and typing events, queued to WebSockets.",
+	})
+	dropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_hub_dropped_total",
+		Help: "Updates dropped because a WebSocket could not keep up or the pubsub outbox was full.",
+	}, []string{"reason"})
+	return delivered, dropped
+}
+
+// Describe implements prometheus.Collector.
+func (h *Hub) Describe(ch chan<- *prometheus.Desc) {
+	ch <- socketsDesc
+	ch <- queueDesc
+	h.delivered.Describe(ch)
+	h.dropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector. It reads the sockets on the hub
+// goroutine.
+func (h *Hub) Collect(ch chan<- prometheus.Metric) {
+	var sockets, queued int
+	h.do(func() {
+		for _, userSockets := range h.users {
+			for c := range userSockets {
+				sockets++
+				queued += len(c.send)
+			}
+		}
+	})
+	ch <- prometheus.MustNewConstMetric(socketsDesc, prometheus.GaugeValue, float64(sockets))
+	ch <- prometheus.MustNewConstMetric(queueDesc, prometheus.GaugeValue, float64(queued), "sockets")
+	ch <- prometheus.MustNewConstMetric(queueDesc, prometheus.GaugeValue, float64(len(h.outbox)), "bus")
+	h.delivered.Collect(ch)
+	h.dropped.Collect(ch)
+}
+
+var (
+	poolOpenDesc = prometheus.NewDesc("chat_db_open_connections",
+		"Connections to the database, in use or idle.", nil, nil)
+	poolMaxOpenDesc = prometheus.NewDesc("chat_db_max_open_connections",
+		"Maximum number of open connections to the database.", nil, nil)
+	poolInUseDesc = prometheus.NewDesc("chat_db_in_use_connections",
+		"Connections currently in use.", nil, nil)
+	poolIdleDesc = prometheus.NewDesc("chat_db_idle_connections",
+		"Idle connections.", nil, nil)
+	poolWaitsDesc = prometheus.NewDesc("chat_db_waits_total",
+		"Times a query waited for a free connection.", nil, nil)
+	poolWaitDurationDesc = prometheus.NewDesc("chat_db_wait_duration_seconds_total",
+		"Time spent waiting for a free connection.", nil, nil)
+	poolClosedDesc = prometheus.NewDesc("chat_db_closed_connections_total",
+		`Connections closed by the pool, because of SetMaxIdleConns (reason="max_idle"), SetConnMaxIdleTime (reason="max_idle_time") or SetConnMaxLifetime (reason="max_lifetime").`,
+		[]string{"reason"}, nil)
+)
+
+// poolCollector exports the statistics of a database connection pool.
+type poolCollector struct {
+	pool database.Pool
+}
+
+func (p poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(p, ch)
+}
+
+func (p poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := p.pool.Stats()
+	ch <- prometheus.MustNewConstMetric(poolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(poolMaxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(poolWaitsDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(poolClosedDesc, prometheus.CounterValue, float64(stats.MaxIdleClosed), "max_idle")
+	ch <- prometheus.MustNewConstMetric(poolClosedDesc, prometheus.CounterValue, float64(stats.MaxIdleTimeClosed), "max_idle_time")
+	ch <- prometheus.MustNewConstMetric(poolClosedDesc, prometheus.CounterValue, float64(stats.MaxLifetimeClosed), "max_lifetime")
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bufio"
+	jwtauth "chat-app/internal/Authentication"
+	"chat-app/internal/logging"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIdHeader carries the id of a request, both ways. Clients and
+// proxies may set it to correlate their logs with ours.
+const requestIdHeader = "X-Request-Id"
+
+// maxRequestIdLength bounds the request ids accepted from clients.
+const maxRequestIdLength = 64
+
+// observeRequests gives every request an id, echoed in the X-Request-Id
+// response header, and a logger carrying the id, route and trace id for the
+// handlers below it. It logs and measures each request once it has been
+// served.
+func (s *Server) observeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestId := r.Header.Get(requestIdHeader)
+		if !validRequestId(requestId) {
+			requestId = uuid.NewString()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		logger := s.logger.With("request_id", requestId, "method", r.Method, "route", route)
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			logger = logger.With("trace_id", span.TraceID().String())
+		}
+		ctx := logging.NewContext(r.Context(), logger)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		elapsed := time.Since(start)
+		s.metrics.observe(route, r.Method, recorder.status, elapsed)
+		logging.FromContext(ctx).Info("Served request",
+			"status", recorder.status, "duration", elapsed)
+	})
+}
+
+// validRequestId reports whether a client supplied request id is short and
+// printable enough to be logged.
+func validRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range requestId {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack lets WebSocket upgrades take over the connection, which they
+// report as 101 Switching Protocols.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer cannot be hijacked")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// authenticate rejects requests without a valid access token and stores the
+// caller's principal in the request context for the handlers below it.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := jwtauth.VerifyToken(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, err)
+			return
+		}
+		logging.AddAttrs(r.Context(), "user_id", principal.UserId)
+		next.ServeHTTP(w, r.WithContext(jwtauth.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// principalFrom returns the caller of a request that passed authenticate.
+func principalFrom(r *http.Request) jwtauth.Principal {
+	principal, _ := jwtauth.PrincipalFromContext(r.Context())
+	return principal
+}
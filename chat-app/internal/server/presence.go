@@ -0,0 +1,237 @@
+package server
+
+import (
+	jwtauth "chat-app/internal/Authentication"
+	model "chat-app/internal/Models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxPresenceIds bounds the users a single GET /presence may ask about.
+const maxPresenceIds = 100
+
+// presenceRank orders statuses from least to most available.
+var presenceRank = map[string]int{model.PresenceOffline: 0, model.PresenceAway: 1, model.PresenceOnline: 2}
+
+// localStatusOf derives the presence of a user from their sockets on this
+// replica. Only called on the hub goroutine.
+func (h *Hub) localStatusOf(userId string) string {
+	status := model.PresenceOffline
+	for c := range h.users[userId] {
+		if !c.away {
+			return model.PresenceOnline
+		}
+		status = model.PresenceAway
+	}
+	return status
+}
+
+// statusOf is the most available of the statuses of a user on every
+// replica. Only called on the hub goroutine.
+func (h *Hub) statusOf(userId string) string {
+	status := h.localStatusOf(userId)
+	for _, remote := range h.remote[userId] {
+		if presenceRank[remote] > presenceRank[status] {
+			status = remote
+		}
+	}
+	return status
+}
+
+// setRemoteStatus records the status of a user on another replica. Only
+// called on the hub goroutine.
+func (h *Hub) setRemoteStatus(userId string, replica string, status string) {
+	if status == model.PresenceOffline {
+		delete(h.remote[userId], replica)
+		if len(h.remote[userId]) == 0 {
+			delete(h.remote, userId)
+		}
+	} else {
+		if h.remote[userId] == nil {
+			h.remote[userId] = make(map[string]string)
+		}
+		h.remote[userId][replica] = status
+	}
+	h.updatePresence(userId)
+}
+
+// expireReplicas forgets the presence reported by replicas that missed
+// missedHeartbeats heartbeats, such as replicas that crashed without
+// announcing their users offline. Only called on the hub goroutine.
+func (h *Hub) expireReplicas(now time.Time) {
+	for replica, heard := range h.heard {
+		if now.Sub(heard) < missedHeartbeats*h.heartbeat {
+			continue
+		}
+		delete(h.heard, replica)
+		h.logger.Warn("Forgetting the presence reported by a silent replica", "replica", replica)
+		for userId, statuses := range h.remote {
+			if _, ok := statuses[replica]; ok {
+				h.setRemoteStatus(userId, replica, model.PresenceOffline)
+			}
+		}
+	}
+}
+
+// setAway marks a socket idle or active again.
+func (h *Hub) setAway(c *client, away bool) {
+	h.run(func() {
+		if !h.users[c.userId][c] {
+			return
+		}
+		c.away = away
+		h.updatePresence(c.userId)
+	})
+}
+
+// statuses returns the presence status of each of the given users.
+func (h *Hub) statuses(userIds []string) map[string]string {
+	statuses := make(map[string]string, len(userIds))
+	h.do(func() {
+		for _, userId := range userIds {
+			statuses[userId] = h.statusOf(userId)
+		}
+	})
+	return statuses
+}
+
+// updatePresence tells the other replicas about a changed local status and
+// announces the status of a user to the local sockets of their contacts if
+// it changed. Looking up the audience hits the database, so it happens on
+// its own goroutine; the announcement is dropped if the status changed
+// again in the meantime. Only called on the hub goroutine.
+func (h *Hub) updatePresence(userId string) {
+	if local := h.localStatusOf(userId); local != h.sharedStatus(userId) {
+		if local == model.PresenceOffline {
+			delete(h.shared, userId)
+		} else {
+			h.shared[userId] = local
+		}
+		h.share(busEvent{Kind: eventPresence, UserIds: []string{userId}, Status: local}, nil)
+	}
+
+	status := h.statusOf(userId)
+	previous, ok := h.announced[userId]
+	if !ok {
+		previous = model.PresenceOffline
+	}
+	if status == previous {
+		return
+	}
+	if status == model.PresenceOffline {
+		delete(h.announced, userId)
+	} else {
+		h.announced[userId] = status
+	}
+	if h.audience == nil {
+		return
+	}
+
+	h.announcing.Add(1)
+	go func() {
+		defer h.announcing.Done()
+		audience, err := h.audience(userId)
+		if err != nil {
+			h.logger.Error("Error loading presence audience", "user_id", userId, "error", err)
+			return
+		}
+		update := newEnvelope(typePresence, "", presencePayload{UserId: userId, Status: status})
+		h.run(func() {
+			if h.statusOf(userId) != status {
+				return
+			}
+			for _, contactId := range audience {
+				for c := range h.users[contactId] {
+					h.queue(c, update)
+				}
+			}
+		})
+	}()
+}
+
+// sharedStatus is the local status of a user last published on the bus.
+// Only called on the hub goroutine.
+func (h *Hub) sharedStatus(userId string) string {
+	if status, ok := h.shared[userId]; ok {
+		return status
+	}
+	return model.PresenceOffline
+}
+
+// getPresence reports the status and last seen time of the users listed in
+// the ids query parameter, separated by commas. Like the presence frames, it
+// only reveals the caller and the users who share a room or a direct
+// conversation with them, except to admins; other and unknown users are left
+// out.
+func (s *Server) getPresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, Id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if Id = strings.TrimSpace(Id); Id != "" && !seen[Id] {
+			seen[Id] = true
+			ids = append(ids, Id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxPresenceIds {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "ids must list between 1 and %d user ids", maxPresenceIds)
+		return
+	}
+	ids, err := s.visiblePresence(r.Context(), principalFrom(r), ids)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	lastSeen, err := s.db.WithContext(r.Context()).GetLastSeen(ids)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	statuses := s.hub.statuses(ids)
+	presences := []model.Presence{}
+	for _, Id := range ids {
+		if seenAt, ok := lastSeen[Id]; ok {
+			presences = append(presences, model.Presence{UserId: Id, Status: statuses[Id], Last_seen_at: seenAt})
+		}
+	}
+	json.NewEncoder(w).Encode(presences)
+}
+
+// visiblePresence keeps the ids of the users whose presence principal may
+// see: their own and their contacts', or everyone's for admins.
+func (s *Server) visiblePresence(ctx context.Context, principal jwtauth.Principal, ids []string) ([]string, error) {
+	if principal.HasRole(model.RoleAdmin) {
+		return ids, nil
+	}
+	contacts, err := s.db.WithContext(ctx).GetContacts(principal.UserId)
+	if err != nil {
+		return nil, err
+	}
+	visible := map[string]bool{principal.UserId: true}
+	for _, contactId := range contacts {
+		visible[contactId] = true
+	}
+	var allowed []string
+	for _, Id := range ids {
+		if visible[Id] {
+			allowed = append(allowed, Id)
+		}
+	}
+	return allowed, nil
+}
+
+// touchLastSeen records that a user connected or disconnected a socket.
+func (s *Server) touchLastSeen(ctx context.Context, userId string) {
+	if err := s.db.WithContext(ctx).UpdateLastSeen(userId); err != nil {
+		s.logger.Error("Error updating last seen time", "user_id", userId, "error", err)
+	}
+}
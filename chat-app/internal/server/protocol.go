@@ -0,0 +1,273 @@
+package server
+
+import (
+	jwtauth "chat-app/internal/Authentication"
+	model "chat-app/internal/Models"
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// protocolVersion is the version of the WebSocket protocol spoken by this
+// server. Clients may omit it from their frames.
+const protocolVersion = 1
+
+// Frame types of the WebSocket protocol.
+const (
+	// Sent by clients.
+	typeMessageSend    = "message.send"
+	typeRoomJoin       = "room.join"
+	typeRoomLeave      = "room.leave"
+	typeThreadFollow   = "thread.follow"
+	typeThreadUnfollow = "thread.unfollow"
+	typePresenceSet    = "presence.set"
+
+	// Sent by the server.
+	typeMessageNew      = "message.new"
+	typeMessageEdited   = "message.edited"
+	typeMessageDeleted  = "message.deleted"
+	typeMessageAck      = "message.ack"
+	typeThreadUpdated   = "thread.updated"
+	typeReactionAdded   = "reaction.added"
+	typeReactionRemoved = "reaction.removed"
+	typeReceipt         = "receipt"
+	typeError           = "error"
+	typePresence        = "presence"
+
+	// Sent by clients and relayed by the server.
+	typeTypingStart = "typing.start"
+	typeTypingStop  = "typing.stop"
+)
+
+// Error codes carried by error frames.
+const (
+	errorBadRequest         = "bad_request"
+	errorForbidden          = "forbidden"
+	errorInternal           = "internal"
+	errorRateLimited        = "rate_limited"
+	errorUnknownType        = "unknown_type"
+	errorUnsupportedVersion = "unsupported_version"
+)
+
+// envelope is one frame of the WebSocket protocol, in either direction. Id
+// is chosen by the client and echoed in the ack or error for that frame.
+type envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// roomPayload is the payload of room.join and room.leave.
+type roomPayload struct {
+	ChatRoomId string `json:"chatroom_id"`
+}
+
+// threadPayload is the payload of thread.follow and thread.unfollow.
+type threadPayload struct {
+	MessageId string `json:"message_id"`
+}
+
+// reactionPayload announces that a user added or removed a reaction.
+type reactionPayload struct {
+	MessageId  string `json:"message_id"`
+	ChatRoomId string `json:"chatroom_id,omitempty"`
+	UserId     string `json:"user_id"`
+	Emoji      string `json:"emoji"`
+}
+
+// receiptPayload tells the sender of direct messages that UserId received
+// MessageId, or read it and every message before it.
+type receiptPayload struct {
+	MessageId string `json:"message_id"`
+	UserId    string `json:"user_id"`
+	Status    string `json:"status"`
+}
+
+// Receipt statuses.
+const (
+	receiptDelivered = "delivered"
+	receiptRead      = "read"
+)
+
+// typingPayload is the payload of typing.start and typing.stop frames.
+// Exactly one of ChatRoomId and ReceiverId is set; the server fills in
+// UserId. The hub also uses it as the key of a typing indicator.
+type typingPayload struct {
+	UserId     string `json:"user_id,omitempty"`
+	ChatRoomId string `json:"chatroom_id,omitempty"`
+	ReceiverId string `json:"receiver_id,omitempty"`
+}
+
+// presencePayload announces the new presence status of a user. Clients
+// send it without UserId in presence.set to report that they are online or
+// away.
+type presencePayload struct {
+	UserId string `json:"user_id,omitempty"`
+	Status string `json:"status"`
+}
+
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newEnvelope builds a server frame.
+func newEnvelope(frameType string, id string, payload interface{}) envelope {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		// Payloads are our own types, so this is a programming error.
+		slog.Error("Error encoding WebSocket payload", "type", frameType, "error", err)
+	}
+	return envelope{V: protocolVersion, Type: frameType, Id: id, Payload: raw}
+}
+
+func errorEnvelope(id string, code string, message string) envelope {
+	return newEnvelope(typeError, id, errorPayload{Code: code, Message: message})
+}
+
+// readPump reads frames from c until the connection fails and handles them
+// in order. ctx is the context of the request that opened the socket.
+func (s *Server) readPump(ctx context.Context, c *client, principal jwtauth.Principal) {
+	for {
+		var frame envelope
+		if err := c.conn.ReadJSON(&frame); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				s.hub.sendToClient(c, errorEnvelope("", errorBadRequest, "frames must be JSON envelopes"))
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger.Warn("Error reading from WebSocket", "error", err)
+			}
+			return
+		}
+		if frame.V != 0 && frame.V != protocolVersion {
+			s.hub.sendToClient(c, errorEnvelope(frame.Id, errorUnsupportedVersion, "this server speaks protocol version 1"))
+			continue
+		}
+		frameCtx, span := s.startFrame(ctx, c, frame)
+		s.handleFrame(frameCtx, c, principal, frame)
+		span.End()
+	}
+}
+
+func (s *Server) handleFrame(ctx context.Context, c *client, principal jwtauth.Principal, frame envelope) {
+	reject := func(code string, message string) {
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, code)
+		s.hub.sendToClient(c, withTrace(ctx, errorEnvelope(frame.Id, code, message)))
+	}
+	// member checks that the caller may use a chat room and rejects the
+	// frame if not.
+	member := func(chatRoomId string) bool {
+		ok, err := s.canAccessRoom(ctx, principal, chatRoomId)
+		if err != nil {
+			c.logger.Error("Error checking chat room membership", "chatroom_id", chatRoomId, "error", err)
+			reject(errorInternal, "could not check chat room membership")
+			return false
+		}
+		if !ok {
+			reject(errorForbidden, "you are not a member of chat room "+chatRoomId)
+		}
+		return ok
+	}
+
+	switch frame.Type {
+	case typeMessageSend:
+		var message model.Message
+		if err := json.Unmarshal(frame.Payload, &message); err != nil {
+			reject(errorBadRequest, "invalid message payload")
+			return
+		}
+		message.Sender_Id = principal.UserId
+		s.threadRoom(ctx, &message)
+		if message.ChatRoomId != "" && !member(message.ChatRoomId) {
+			return
+		}
+		created, err := s.db.WithContext(ctx).CreateMessage(message)
+		if err != nil {
+			c.logger.Warn("Error inserting message", "error", err)
+			reject(errorBadRequest, err.Error())
+			return
+		}
+		// Posting to a room or thread implies following it.
+		if created.ParentMessageId != "" {
+			s.hub.followThread(c, created.ChatRoomId, created.ParentMessageId)
+		} else if created.ChatRoomId != "" {
+			s.hub.subscribe(c, created.ChatRoomId)
+		}
+		s.hub.sendToClient(c, withTrace(ctx, newEnvelope(typeMessageAck, frame.Id, created)))
+		s.publish(ctx, typeMessageNew, created, c)
+
+	case typeRoomJoin, typeRoomLeave:
+		var room roomPayload
+		if err := json.Unmarshal(frame.Payload, &room); err != nil || room.ChatRoomId == "" {
+			reject(errorBadRequest, "chatroom_id is required")
+			return
+		}
+		if frame.Type == typeRoomLeave {
+			s.hub.unsubscribe(c, room.ChatRoomId)
+			return
+		}
+		if !member(room.ChatRoomId) {
+			return
+		}
+		s.hub.subscribe(c, room.ChatRoomId)
+
+	case typeThreadFollow, typeThreadUnfollow:
+		var thread threadPayload
+		if err := json.Unmarshal(frame.Payload, &thread); err != nil || thread.MessageId == "" {
+			reject(errorBadRequest, "message_id is required")
+			return
+		}
+		if frame.Type == typeThreadUnfollow {
+			s.hub.unfollowThread(c, thread.MessageId)
+			return
+		}
+		parent, err := s.db.WithContext(ctx).GetMessage(thread.MessageId)
+		if err != nil || parent.ChatRoomId == "" || parent.ParentMessageId != "" {
+			reject(errorBadRequest, "message "+thread.MessageId+" does not start a thread")
+			return
+		}
+		if !member(parent.ChatRoomId) {
+			return
+		}
+		s.hub.followThread(c, parent.ChatRoomId, parent.MessageId)
+
+	case typeTypingStart, typeTypingStop:
+		if !c.typingLimit.allow(typingBurst, typingRate) {
+			reject(errorRateLimited, "too many typing frames")
+			return
+		}
+		var typing typingPayload
+		if err := json.Unmarshal(frame.Payload, &typing); err != nil || (typing.ChatRoomId == "") == (typing.ReceiverId == "") {
+			reject(errorBadRequest, "exactly one of chatroom_id and receiver_id is required")
+			return
+		}
+		typing.UserId = principal.UserId
+		if frame.Type == typeTypingStop {
+			s.hub.stopTyping(typing)
+			return
+		}
+		if typing.ChatRoomId != "" && !member(typing.ChatRoomId) {
+			return
+		}
+		s.hub.startTyping(typing)
+
+	case typePresenceSet:
+		var presence presencePayload
+		if err := json.Unmarshal(frame.Payload, &presence); err != nil ||
+			(presence.Status != model.PresenceOnline && presence.Status != model.PresenceAway) {
+			reject(errorBadRequest, "status must be online or away")
+			return
+		}
+		s.hub.setAway(c, presence.Status == model.PresenceAway)
+
+	default:
+		reject(errorUnknownType, "unknown frame type "+frame.Type)
+	}
+}
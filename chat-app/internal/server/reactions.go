@@ -0,0 +1,149 @@
+package server
+
+import (
+	jwtauth "chat-app/internal/Authentication"
+	model "chat-app/internal/Models"
+	"chat-app/internal/database"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// maxEmojiLength bounds a reaction in bytes. Emoji built from several code
+// points, such as flags and families, stay well below it.
+const maxEmojiLength = 64
+
+// validEmoji accepts short strings built around a pictographic symbol, such
+// as "👍", "❤️" or "1️⃣", and rejects words and whitespace.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return false
+	}
+	symbol := false
+	for _, r := range emoji {
+		if unicode.IsLetter(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+		symbol = symbol || unicode.Is(unicode.So, r) || unicode.Is(unicode.Me, r)
+	}
+	return symbol
+}
+
+// addReactions fills in the reactions of messages as seen by user_id.
+func (s *Server) addReactions(ctx context.Context, messages []model.Message, user_id string) error {
+	ids := make([]string, len(messages))
+	for i, message := range messages {
+		ids[i] = message.MessageId
+	}
+	reactions, err := s.db.WithContext(ctx).GetReactions(ids, user_id)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].MessageId]
+		if messages[i].Reactions == nil {
+			messages[i].Reactions = []model.Reaction{}
+		}
+	}
+	return nil
+}
+
+// canReadMessage reports whether principal may see a message: room messages
+// by the members of the room, direct messages by their participants.
+func (s *Server) canReadMessage(ctx context.Context, principal jwtauth.Principal, message model.Message) (bool, error) {
+	if message.ChatRoomId != "" {
+		return s.canAccessRoom(ctx, principal, message.ChatRoomId)
+	}
+	return message.Sender_Id == principal.UserId || message.Receiver_Id == principal.UserId, nil
+}
+
+// reactionTarget loads the message in the {id} route variable and checks
+// that the caller can see it and that {emoji} is an emoji. It writes the
+// error response and returns false otherwise.
+func (s *Server) reactionTarget(w http.ResponseWriter, r *http.Request) (model.Message, string, bool) {
+	params := mux.Vars(r)
+
+	message, err := s.db.WithContext(r.Context()).GetMessage(params["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "No Message exists with Id: "+params["id"])
+		return message, "", false
+	}
+	if ok, err := s.canReadMessage(r.Context(), principalFrom(r), message); err != nil || !ok {
+		forbidden(w)
+		return message, "", false
+	}
+	if !validEmoji(params["emoji"]) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Reactions must be a single emoji")
+		return message, "", false
+	}
+	return message, params["emoji"], true
+}
+
+func (s *Server) addReaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	message, emoji, ok := s.reactionTarget(w, r)
+	if !ok {
+		return
+	}
+	if message.Deleted_at != "" {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, database.ErrMessageDeleted)
+		return
+	}
+
+	err := s.db.WithContext(r.Context()).AddReaction(message.MessageId, principalFrom(r).UserId, emoji)
+	if err == database.ErrReactionExists {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	s.writeReactions(w, r, typeReactionAdded, message, emoji, http.StatusCreated)
+}
+
+func (s *Server) removeReaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	message, emoji, ok := s.reactionTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.db.WithContext(r.Context()).RemoveReaction(message.MessageId, principalFrom(r).UserId, emoji); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+	s.writeReactions(w, r, typeReactionRemoved, message, emoji, http.StatusOK)
+}
+
+// writeReactions announces a changed reaction and responds with the
+// reactions the message has now.
+func (s *Server) writeReactions(w http.ResponseWriter, r *http.Request, frameType string, message model.Message, emoji string, code int) {
+	principal := principalFrom(r)
+	s.deliver(r.Context(), message, newEnvelope(frameType, "", reactionPayload{
+		MessageId:  message.MessageId,
+		ChatRoomId: message.ChatRoomId,
+		UserId:     principal.UserId,
+		Emoji:      emoji,
+	}), nil)
+
+	messages := []model.Message{message}
+	if err := s.addReactions(r.Context(), messages, principal.UserId); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(messages[0].Reactions)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	model "chat-app/internal/Models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// readMarker is the body of the read endpoints and their response. An
+// empty MessageId in a request stands for the newest message.
+type readMarker struct {
+	MessageId string `json:"message_id"`
+}
+
+// unreadSummary is the response of GET /me/unread.
+type unreadSummary struct {
+	Total         int                 `json:"total"`
+	Conversations []model.UnreadCount `json:"conversations"`
+}
+
+// readMarkerFrom decodes the optional body of a read endpoint. It writes
+// the error response and returns false if the body is not valid JSON.
+func readMarkerFrom(w http.ResponseWriter, r *http.Request) (readMarker, bool) {
+	var marker readMarker
+	if err := json.NewDecoder(r.Body).Decode(&marker); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid read marker: ", err)
+		return marker, false
+	}
+	return marker, true
+}
+
+// readUpTo resolves the message a read endpoint marks as read: the one in
+// marker, which must belong to the conversation, or else the newest one
+// returned by newest. It returns a message with an empty id for an empty
+// conversation and writes the error response and returns false on failure.
+func (s *Server) readUpTo(ctx context.Context, w http.ResponseWriter, marker readMarker, inConversation func(model.Message) bool, newest func() ([]model.Message, error)) (model.Message, bool) {
+	if marker.MessageId == "" {
+		messages, err := newest()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return model.Message{}, false
+		}
+		if len(messages) == 0 {
+			return model.Message{}, true
+		}
+		return messages[len(messages)-1], true
+	}
+	message, err := s.db.WithContext(ctx).GetMessage(marker.MessageId)
+	if err != nil || !inConversation(message) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Message "+marker.MessageId+" is not part of this conversation")
+		return model.Message{}, false
+	}
+	return message, true
+}
+
+func (s *Server) markChatRoomRead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	chatRoomId := mux.Vars(r)["id"]
+	marker, ok := readMarkerFrom(w, r)
+	if !ok {
+		return
+	}
+
+	message, ok := s.readUpTo(r.Context(), w, marker, func(message model.Message) bool {
+		return message.ChatRoomId == chatRoomId
+	}, func() ([]model.Message, error) {
+		return s.db.WithContext(r.Context()).GetMessagesForChatRoom(chatRoomId, model.MessagePage{Limit: 1})
+	})
+	if !ok {
+		return
+	}
+	if message.MessageId != "" {
+		if err := s.db.WithContext(r.Context()).MarkRoomRead(chatRoomId, principalFrom(r).UserId, message.MessageId); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(readMarker{MessageId: message.MessageId})
+}
+
+// markDirectRead marks the direct conversation with {userid} as read and,
+// when the marked message is theirs, sends that user a read receipt.
+func (s *Server) markDirectRead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userId := principalFrom(r).UserId
+	peerId := mux.Vars(r)["userid"]
+	marker, ok := readMarkerFrom(w, r)
+	if !ok {
+		return
+	}
+
+	message, ok := s.readUpTo(r.Context(), w, marker, func(message model.Message) bool {
+		return message.ChatRoomId == "" &&
+			(message.Sender_Id == userId && message.Receiver_Id == peerId ||
+				message.Sender_Id == peerId && message.Receiver_Id == userId)
+	}, func() ([]model.Message, error) {
+		return s.db.WithContext(r.Context()).GetMessagesforIndividualChat(map[string]string{"sender_id": userId, "receiver_id": peerId}, model.MessagePage{Limit: 1})
+	})
+	if !ok {
+		return
+	}
+	if message.MessageId != "" {
+		if err := s.db.WithContext(r.Context()).MarkDirectRead(userId, peerId, message.MessageId); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		// Reading up to your own reply says nothing new to the peer.
+		if message.Sender_Id == peerId {
+			s.hub.sendToUsers(newEnvelope(typeReceipt, "", receiptPayload{
+				MessageId: message.MessageId,
+				UserId:    userId,
+				Status:    receiptRead,
+			}), nil, peerId)
+		}
+	}
+	json.NewEncoder(w).Encode(readMarker{MessageId: message.MessageId})
+}
+
+func (s *Server) getUnreadCounts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	counts, err := s.db.WithContext(r.Context()).GetUnreadCounts(principalFrom(r).UserId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	summary := unreadSummary{Conversations: counts}
+	for _, count := range counts {
+		summary.Total += count.Unread
+	}
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	model "chat-app/internal/Models"
+	"chat-app/internal/database"
+	"chat-app/internal/logging"
+	"chat-app/internal/mailer"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+const (
+	verificationTokenTTL = 24 * time.Hour
+	minPasswordLength    = 8
+)
+
+// newVerificationToken returns a random token for the email link and the
+// hash that is stored in the database.
+func newVerificationToken() (token string, tokenHash string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashVerificationToken(token), nil
+}
+
+func hashVerificationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateRegistration(registration model.Registration) error {
+	if registration.UserName == "" {
+		return fmt.Errorf("username is required")
+	}
+	if len(registration.Password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	address, err := mail.ParseAddress(registration.Email)
+	if err != nil || address.Address != registration.Email {
+		return fmt.Errorf("a valid email address is required")
+	}
+	return nil
+}
+
+// register creates a pending account and emails a verification link. The
+// account cannot log in until the link is opened.
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var registration model.Registration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err := validateRegistration(registration); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	_, err := s.db.WithContext(r.Context()).GetUserByUserName(registration.UserName)
+	if err == nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, database.ErrUsernameTaken)
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	hash, err := s.passwords.Hash(registration.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	_, err = s.db.WithContext(r.Context()).CreateUser(model.User{
+		UserName: registration.UserName,
+		Password: hash,
+		Name:     registration.Name,
+		Email:    registration.Email,
+		Status:   model.UserStatusPending,
+	})
+	// A concurrent registration can take the name after the check above.
+	if errors.Is(err, database.ErrUsernameTaken) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	user, err := s.db.WithContext(r.Context()).GetUserByUserName(registration.UserName)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := s.sendVerificationEmail(r, user); err != nil {
+		logger := logging.FromContext(r.Context())
+		logger.Error("Error sending verification email", "user_id", user.Id, "error", err)
+		// Remove the account so the person can simply register again.
+		if err := s.db.WithContext(r.Context()).DeleteUser(user.Id); err != nil {
+			logger.Error("Error removing unverifiable user", "user_id", user.Id, "error", err)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "could not send the verification email, please try again")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":      user.Id,
+		"status":  user.Status,
+		"message": "Check your email to verify your account.",
+	})
+}
+
+func (s *Server) sendVerificationEmail(r *http.Request, user model.User) error {
+	token, tokenHash, err := newVerificationToken()
+	if err != nil {
+		return err
+	}
+	if err := s.db.WithContext(r.Context()).CreateVerificationToken(user.Id, tokenHash, time.Now().Add(verificationTokenTTL)); err != nil {
+		return err
+	}
+
+	link := s.baseURL + "/verify?token=" + url.QueryEscape(token)
+	return s.mailer.Send(r.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your chat-app account",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen the link below within %s to activate your account:\n\n%s\n",
+			user.UserName, verificationTokenTTL, link),
+	})
+}
+
+// verifyEmail activates the account that owns the token in the query string.
+func (s *Server) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "missing verification token")
+		return
+	}
+
+	userId, err := s.db.WithContext(r.Context()).ConsumeVerificationToken(hashVerificationToken(token))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":      userId,
+		"status":  model.UserStatusActive,
+		"message": "Your account is verified, you can now log in.",
+	})
+}
@@ -3,40 +3,72 @@ package server
 import (
 	jwtauth "chat-app/internal/Authentication"
 	model "chat-app/internal/Models"
+	"chat-app/internal/logging"
+	"chat-app/internal/tracing"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
 func (s *Server) RegisterRoutes() http.Handler {
 	r := mux.NewRouter()
+	r.Use(otelmux.Middleware(tracing.ServiceName, otelmux.WithTracerProvider(s.tracerProvider)), s.observeRequests)
 
 	r.HandleFunc("/", s.HelloWorldHandler)
 	r.HandleFunc("/health", s.healthHandler)
+	r.Handle("/metrics", s.metrics.handler()).Methods("GET")
+	r.HandleFunc("/.well-known/jwks.json", s.jwksHandler).Methods("GET")
+	r.HandleFunc("/register", s.register).Methods("POST")
+	r.HandleFunc("/verify", s.verifyEmail).Methods("GET")
 	r.HandleFunc("/login", s.authenticateUser).Methods("POST")
 	r.HandleFunc("/refresh", s.refreshAccessToken).Methods("GET")
-	r.HandleFunc("/refresh_token/invalid", s.deleteRefreshToken).Methods("DELETE")
 
-	r.HandleFunc("/user", s.createUser).Methods("POST")
-	r.HandleFunc("/users", s.getAllUsers).Methods("GET")
-	r.HandleFunc("/user/{id}", s.GetAUser).Methods("GET")
-	r.HandleFunc("/userpassword/{id}&{password}", s.updateUserPassword).Methods("PUT")
-	r.HandleFunc("/user/{id}", s.updateUserDetails).Methods("PUT")
-	r.HandleFunc("/user/{id}", s.deleteUser).Methods("DELETE")
-
-	r.HandleFunc("/chatroom", s.createChatRoom).Methods("POST")
-	r.HandleFunc("/chatrooms", s.getAllChatRooms).Methods("GET")
-	r.HandleFunc("/chatroom/{id}", s.getChatRoom).Methods("GET")
-	r.HandleFunc("/chatroom/{id}", s.deleteChatRoom).Methods("DELETE")
-
-	r.HandleFunc("/message", s.createMessage).Methods("POST")
-	r.HandleFunc("/messages/{chatroomid}", s.getMessagesForChatroom).Methods("GET")
-	r.HandleFunc("/messages", s.getMessagesforIndividualChat).Methods("POST")
-
-	r.HandleFunc("/ws", s.handleConnections)
+	// Everything below requires a valid access token.
+	api := r.NewRoute().Subrouter()
+	api.Use(s.authenticate)
+
+	api.Handle("/refresh_token/invalid", s.requireAdmin(s.deleteRefreshToken)).Methods("DELETE")
+
+	api.Handle("/user", s.requireAdmin(s.createUser)).Methods("POST")
+	api.HandleFunc("/users", s.getAllUsers).Methods("GET")
+	api.HandleFunc("/user/{id}", s.GetAUser).Methods("GET")
+	api.Handle("/user/{id}/password", s.requireSelfOrAdmin(s.updateUserPassword)).Methods("PUT")
+	api.Handle("/user/{id}", s.requireSelfOrAdmin(s.updateUserDetails)).Methods("PUT")
+	api.Handle("/user/{id}", s.requireSelfOrAdmin(s.deleteUser)).Methods("DELETE")
+	api.Handle("/user/{id}/role", s.requireAdmin(s.setUserRole)).Methods("PUT")
+
+	api.HandleFunc("/chatroom", s.createChatRoom).Methods("POST")
+	api.HandleFunc("/chatrooms", s.getAllChatRooms).Methods("GET")
+	api.HandleFunc("/chatroom/{id}", s.getChatRoom).Methods("GET")
+	api.Handle("/chatroom/{id}", s.requireRoomRole(s.deleteChatRoom, model.RoomRoleOwner)).Methods("DELETE")
+	api.Handle("/chatroom/{id}/members/{userid}/role", s.requireRoomRole(s.setRoomMemberRole, model.RoomRoleOwner)).Methods("PUT")
+	api.HandleFunc("/chatroom/{id}/join", s.joinChatRoom).Methods("POST")
+	api.Handle("/chatroom/{id}/leave", s.requireRoomMember(s.leaveChatRoom)).Methods("POST")
+	api.Handle("/chatroom/{id}/invite", s.requireRoomRole(s.inviteToChatRoom, model.RoomRoleOwner, model.RoomRoleModerator)).Methods("POST")
+	api.Handle("/chatroom/{id}/members", s.requireRoomMember(s.getChatRoomMembers)).Methods("GET")
+	api.Handle("/chatroom/{id}/read", s.requireRoomMember(s.markChatRoomRead)).Methods("POST")
+
+	api.HandleFunc("/message", s.createMessage).Methods("POST")
+	api.Handle("/messages/{id}", s.requireRoomMember(s.getMessagesForChatroom)).Methods("GET")
+	api.HandleFunc("/message/{id}", s.updateMessage).Methods("PUT")
+	api.HandleFunc("/message/{id}", s.deleteMessage).Methods("DELETE")
+	api.HandleFunc("/message/{id}/revisions", s.getMessageRevisions).Methods("GET")
+	api.HandleFunc("/message/{id}/thread", s.getMessageThread).Methods("GET")
+	api.HandleFunc("/message/{id}/reactions/{emoji}", s.addReaction).Methods("POST")
+	api.HandleFunc("/message/{id}/reactions/{emoji}", s.removeReaction).Methods("DELETE")
+	api.HandleFunc("/messages", s.getMessagesforIndividualChat).Methods("POST")
+	api.HandleFunc("/messages/direct/{userid}", s.getMessagesforIndividualChat).Methods("GET")
+	api.HandleFunc("/messages/direct/{userid}/read", s.markDirectRead).Methods("POST")
+	api.HandleFunc("/me/unread", s.getUnreadCounts).Methods("GET")
+	api.HandleFunc("/presence", s.getPresence).Methods("GET")
+	api.HandleFunc("/search/messages", s.searchMessages).Methods("GET")
+
+	api.HandleFunc("/ws", s.handleConnections)
 
 	return r
 }
@@ -47,41 +79,77 @@ func (s *Server) HelloWorldHandler(w http.ResponseWriter, r *http.Request) {
 
 	jsonResp, err := json.Marshal(resp)
 	if err != nil {
-		log.Fatalf("error handling JSON marshal. Err: %v", err)
+		logging.FromContext(r.Context()).Error("Error encoding response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	_, _ = w.Write(jsonResp)
 }
 
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
-	jsonResp, err := json.Marshal(s.db.Health())
+	jsonResp, err := json.Marshal(s.db.WithContext(r.Context()).Health())
 
 	if err != nil {
-		log.Fatalf("error handling JSON marshal. Err: %v", err)
+		logging.FromContext(r.Context()).Error("Error encoding response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	_, _ = w.Write(jsonResp)
 }
 
+// jwksHandler publishes the public signing keys so other services can
+// validate tokens issued by this server.
+func (s *Server) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	keys, err := jwtauth.DefaultKeyring()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(keys.JWKS())
+}
+
 func (s *Server) authenticateUser(w http.ResponseWriter, r *http.Request) {
 	var userCreds model.UserAuth
 
 	_ = json.NewDecoder(r.Body).Decode(&userCreds)
 
-	user, err := s.db.GetAUser(userCreds.UserName, userCreds.Password)
+	user, err := s.db.WithContext(r.Context()).GetUserByUserName(userCreds.UserName)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Authentication failed, Invalid Credentials")
+		return
+	}
+	needsRehash, err := s.passwords.Verify(userCreds.Password, user.Password)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprint(w, "Authentication failed, Invalid Credentials")
 		return
 	}
-	tokenPair, err := jwtauth.CreateToken(user.Id)
+	if user.Status != model.UserStatusActive {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Authentication failed, please verify your email address first")
+		return
+	}
+	if needsRehash {
+		// Upgrade plaintext or outdated hashes now that we know the password.
+		if hash, err := s.passwords.Hash(userCreds.Password); err == nil {
+			if err := s.db.WithContext(r.Context()).UpdateUserPassword(user.Id, hash); err != nil {
+				logging.FromContext(r.Context()).Error("Error upgrading password hash", "user_id", user.Id, "error", err)
+			}
+		}
+	}
+	tokenPair, err := jwtauth.CreateToken(user.Id, user.Role)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
 		return
 	}
-	fmt.Println("tokenPair:", tokenPair)
-	err = s.db.CreateRefreshToken(user.Id, tokenPair["refresh_token"])
+	err = s.db.WithContext(r.Context()).CreateRefreshToken(user.Id, tokenPair["refresh_token"])
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
@@ -97,51 +165,59 @@ func (s *Server) refreshAccessToken(w http.ResponseWriter, r *http.Request) {
 	if refreshTokenString == "" || len(refreshTokenString) <= len("Bearer ") {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprint(w, fmt.Errorf("missing refresh token"))
+		return
 	}
 	refreshTokenString = refreshTokenString[len("Bearer "):]
 
-	isValid, err := s.db.GetRefreshToken(refreshTokenString)
+	isValid, err := s.db.WithContext(r.Context()).GetRefreshToken(refreshTokenString)
 	if !isValid || err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
 		return
 	}
 
-	tokenPair, err := jwtauth.RefreshAccessToken(refreshTokenString)
+	principal, err := jwtauth.ParseRefreshToken(refreshTokenString)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	// Re-read the user so role changes take effect on the next refresh.
+	user, err := s.db.WithContext(r.Context()).GetAUserv2(principal.UserId)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	tokenPair, err := jwtauth.CreateToken(user.Id, user.Role)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
 		return
 	}
 
-	err = s.db.CreateRefreshToken(tokenPair["user_id"], tokenPair["refresh_token"])
+	err = s.db.WithContext(r.Context()).CreateRefreshToken(user.Id, tokenPair["refresh_token"])
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
 		return
 	}
 
-	err = s.db.UpdateRefreshToken(refreshTokenString, tokenPair["user_id"])
+	err = s.db.WithContext(r.Context()).UpdateRefreshToken(refreshTokenString, user.Id)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
 		return
 	}
-	delete(tokenPair, "user_id")
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(tokenPair)
 }
 
 func (s *Server) deleteRefreshToken(w http.ResponseWriter, r *http.Request) {
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
-	response, err := s.db.DeleteRefreshToken()
+	response, err := s.db.WithContext(r.Context()).DeleteRefreshToken()
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprint(w, err)
@@ -152,20 +228,18 @@ func (s *Server) deleteRefreshToken(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
-	fmt.Println("r.Body:", r.Body)
 	var userData model.User
 	_ = json.NewDecoder(r.Body).Decode(&userData)
 
-	fmt.Println("userData:", userData)
+	hash, err := s.passwords.Hash(userData.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	userData.Password = hash
 
-	userCreation, err := s.db.CreateUser(userData)
+	userCreation, err := s.db.WithContext(r.Context()).CreateUser(userData)
 	if err != nil {
 		fmt.Fprint(w, err)
 		return
@@ -176,14 +250,7 @@ func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) getAllUsers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
-	usersData, err := s.db.GetAllUsers()
+	usersData, err := s.db.WithContext(r.Context()).GetAllUsers()
 	if err != nil {
 		fmt.Fprint(w, err)
 		return
@@ -193,89 +260,81 @@ func (s *Server) getAllUsers(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) GetAUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
 	params := mux.Vars(r)
-	user, err := s.db.GetAUserv2(params["id"])
+	user, err := s.db.WithContext(r.Context()).GetAUserv2(params["id"])
 	if err != nil {
 		fmt.Fprint(w, err)
 		return
 	}
+	user.Password = ""
 
 	json.NewEncoder(w).Encode(user)
 }
 
+// updateUserPassword sets the password in a {"password": "..."} body. It is
+// never part of the URL, which ends up in logs and traces.
 func (s *Server) updateUserPassword(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
+	params := mux.Vars(r)
+	var request struct {
+		Password string `json:"password"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&request)
+	if len(request.Password) < minPasswordLength {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "password must be at least %d characters", minPasswordLength)
 		return
 	}
-
-	params := mux.Vars(r)
-	err := s.db.UpdateUserPassword(params["id"], params["password"])
+	hash, err := s.passwords.Hash(request.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	err = s.db.WithContext(r.Context()).UpdateUserPassword(params["id"], hash)
 	if err != nil {
 		fmt.Fprint(w, err)
 		return
 	}
 
-	updateUser, err := s.db.GetAUserv2(params["id"])
+	updateUser, err := s.db.WithContext(r.Context()).GetAUserv2(params["id"])
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprint(w, err)
 		return
 	}
+	updateUser.Password = ""
 
 	json.NewEncoder(w).Encode(&updateUser)
 }
 
 func (s *Server) updateUserDetails(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
 	params := mux.Vars(r)
 	var user model.User
 	_ = json.NewDecoder(r.Body).Decode(&user)
 
-	err := s.db.UpdateUserDetails(params["id"], user)
+	err := s.db.WithContext(r.Context()).UpdateUserDetails(params["id"], user)
 	if err != nil {
 		fmt.Fprint(w, err)
 		return
 	}
 
-	updateUser, err := s.db.GetAUserv2(params["id"])
+	updateUser, err := s.db.WithContext(r.Context()).GetAUserv2(params["id"])
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprint(w, err)
 		return
 	}
+	updateUser.Password = ""
 
 	json.NewEncoder(w).Encode(&updateUser)
 }
 
 func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
 	params := mux.Vars(r)
-	err := s.db.DeleteUser(params["id"])
+	err := s.db.WithContext(r.Context()).DeleteUser(params["id"])
 	if err != nil {
 		fmt.Fprint(w, err)
 		return
@@ -286,17 +345,12 @@ func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
 // ChatRoom
 func (s *Server) createChatRoom(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
 	var chatroom model.ChatRoom
 	_ = json.NewDecoder(r.Body).Decode(&chatroom)
+	// Whoever creates a room owns it.
+	chatroom.OwnerId = principalFrom(r).UserId
 
-	response, err := s.db.CreateChatRoom(chatroom)
+	response, err := s.db.WithContext(r.Context()).CreateChatRoom(chatroom)
 	if err != nil {
 		fmt.Fprint(w, err)
 		return
@@ -306,159 +360,221 @@ func (s *Server) createChatRoom(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) deleteChatRoom(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
 	params := mux.Vars(r)
-	err := s.db.DeleteChatRoom(params["id"])
+	err := s.db.WithContext(r.Context()).DeleteChatRoom(params["id"])
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
 		return
 	}
+	s.hub.closeRoom(params["id"])
 	fmt.Fprint(w, "ChatRoom with Id "+params["id"]+" is deleted.")
 }
 
 func (s *Server) getAllChatRooms(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
-	chatRooms, err := s.db.GetAllChatRoom()
+	chatRooms, err := s.db.WithContext(r.Context()).GetAllChatRoom()
 	if err != nil {
 		fmt.Fprint(w, err)
 		return
 	}
-	json.NewEncoder(w).Encode(chatRooms)
+
+	// Private rooms are only listed for their members.
+	principal := principalFrom(r)
+	visible := []model.ChatRoom{}
+	for _, chatRoom := range chatRooms {
+		if chatRoom.IsPrivate {
+			if ok, err := s.canAccessRoom(r.Context(), principal, chatRoom.ChatRoomId); err != nil || !ok {
+				continue
+			}
+		}
+		visible = append(visible, chatRoom)
+	}
+	json.NewEncoder(w).Encode(visible)
 }
 
 func (s *Server) getChatRoom(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
 	params := mux.Vars(r)
-	chatRoom, err := s.db.GetChatRoom(params["id"])
+	chatRoom, err := s.db.WithContext(r.Context()).GetChatRoom(params["id"])
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
 		return
 	}
+	if chatRoom.IsPrivate {
+		// Do not reveal that a private room exists to non-members.
+		if ok, err := s.canAccessRoom(r.Context(), principalFrom(r), chatRoom.ChatRoomId); err != nil || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "No Chatroom exists with Id: "+params["id"])
+			return
+		}
+	}
 	json.NewEncoder(w).Encode(chatRoom)
 }
 
 func (s *Server) createMessage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
 	var message model.Message
 	_ = json.NewDecoder(r.Body).Decode(&message)
-	responseMessage, err := s.db.CreateMessage(message)
+	// The sender is always the caller, never a client-supplied id.
+	message.Sender_Id = principalFrom(r).UserId
+	s.threadRoom(r.Context(), &message)
+	if message.ChatRoomId != "" {
+		if ok, err := s.canAccessRoom(r.Context(), principalFrom(r), message.ChatRoomId); err != nil || !ok {
+			forbidden(w)
+			return
+		}
+	}
+	created, err := s.db.WithContext(r.Context()).CreateMessage(message)
 	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, err)
+		return
 	}
+	s.publish(r.Context(), typeMessageNew, created, nil)
 
-	fmt.Fprint(w, responseMessage)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&created)
 }
 
-func (s *Server) getMessagesForChatroom(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
+// Message history is paginated by message id. Without cursors the newest
+// page is returned; next_cursor then continues towards older messages with
+// ?before=, or towards newer ones when paging forward with ?after=.
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 200
+)
+
+// messagePageResponse is the body of the message history endpoints.
+type messagePageResponse struct {
+	Messages   []model.Message `json:"messages"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// messagePageFrom reads the before, after, limit and order query parameters
+// of r.
+func messagePageFrom(r *http.Request) (model.MessagePage, error) {
+	query := r.URL.Query()
+	page := model.MessagePage{Before: query.Get("before"), After: query.Get("after"), Limit: defaultMessagePageSize}
+	for name, cursor := range map[string]string{"before": page.Before, "after": page.After} {
+		if cursor == "" {
+			continue
+		}
+		if id, err := strconv.ParseInt(cursor, 10, 64); err != nil || id <= 0 {
+			return page, fmt.Errorf("%s must be a message id", name)
+		}
 	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxMessagePageSize {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxMessagePageSize)
+		}
+		page.Limit = n
+	}
+	switch query.Get("order") {
+	case "", "oldest":
+	case "newest":
+		page.NewestFirst = true
+	default:
+		return page, fmt.Errorf("order must be oldest or newest")
+	}
+	return page, nil
+}
 
-	params := mux.Vars(r)
-	messages, err := s.db.GetMessagesForChatRoom(params["chatroomid"])
+// writeMessagePage fetches one page of history plus one message to learn
+// whether another page follows, and writes it with its next_cursor and the
+// reactions of each message.
+func (s *Server) writeMessagePage(w http.ResponseWriter, r *http.Request, fetch func(model.MessagePage) ([]model.Message, error)) {
+	page, err := messagePageFrom(r)
 	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, err)
 		return
 	}
+	limit := page.Limit
+	page.Limit++
+	messages, err := fetch(page)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	response := messagePageResponse{Messages: messages}
+	if len(messages) > limit {
+		// The extra message is the one furthest in the paging direction.
+		forward := page.After != "" && page.Before == ""
+		if forward == page.NewestFirst {
+			response.Messages = messages[1:]
+			response.NextCursor = response.Messages[0].MessageId
+		} else {
+			response.Messages = messages[:limit]
+			response.NextCursor = response.Messages[limit-1].MessageId
+		}
+	}
+	if err := s.addReactions(r.Context(), response.Messages, principalFrom(r).UserId); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(&response)
+}
 
-	json.NewEncoder(w).Encode(&messages)
+func (s *Server) getMessagesForChatroom(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	s.writeMessagePage(w, r, func(page model.MessagePage) ([]model.Message, error) {
+		return s.db.WithContext(r.Context()).GetMessagesForChatRoom(params["id"], page)
+	})
 }
 
 func (s *Server) getMessagesforIndividualChat(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, errMessage)
-		return
-	}
-
 	senderReceiver := make(map[string]string)
 
-	_ = json.NewDecoder(r.Body).Decode(&senderReceiver)
-
-	messages, err := s.db.GetMessagesforIndividualChat(senderReceiver)
-	if err != nil {
-		fmt.Fprint(w, err)
-		return
+	if r.Method == http.MethodGet {
+		senderReceiver["receiver_id"] = mux.Vars(r)["userid"]
+	} else {
+		_ = json.NewDecoder(r.Body).Decode(&senderReceiver)
 	}
+	senderReceiver["sender_id"] = principalFrom(r).UserId
 
-	json.NewEncoder(w).Encode(&messages)
+	s.writeMessagePage(w, r, func(page model.MessagePage) ([]model.Message, error) {
+		return s.db.WithContext(r.Context()).GetMessagesforIndividualChat(senderReceiver, page)
+	})
 }
 
 func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	errMessage := jwtauth.VerifyToken(r)
-	if errMessage != nil {
-		log.Println("Error in authentication:", errMessage)
-		return
-	}
+	principal := principalFrom(r)
 
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Println("Error upgrading connection:", err)
-		return
-	}
-	defer conn.Close()
-
-	clients[conn] = true
-
-	//var messageJSON string
-	var message model.Message
-	for {
-		err := conn.ReadJSON(&message)
-		//_, messageBytes, err := conn.ReadMessage()
-		if err != nil {
-			log.Println("Error reading message:", err)
-			delete(clients, conn)
-			break
-		}
-		log.Println("Message Received:", message)
-
-		responseMessage, err := s.db.CreateMessage(message)
-		if err != nil {
-			log.Println("Error Inserting Message:", err)
-			continue
-		}
-		log.Println("response:", responseMessage)
-
-		err = s.sendChatHistory(message)
-		if err != nil {
-			log.Println("Error fetching the chat History:", err)
-			continue
-		}
-	}
+		// The upgrader has already written the error response.
+		logger.Debug("Error upgrading connection", "error", err)
+		return
+	}
+
+	// The hub closes the connection once writePump stops.
+	client := newClient(conn, principal.UserId, logger, s.tracer)
+	if !s.hub.add(client) {
+		conn.Close()
+		return
+	}
+	// Shutdown waits for the handler to record the disconnection before it
+	// closes the database.
+	s.sockets.Add(1)
+	defer s.sockets.Done()
+	s.touchLastSeen(ctx, principal.UserId)
+	defer func() {
+		s.hub.remove(client)
+		// Record the disconnection even if the request was canceled.
+		s.touchLastSeen(context.WithoutCancel(ctx), principal.UserId)
+	}()
+	go client.writePump()
+	client.prepareRead()
+	s.readPump(ctx, client, principal)
 }
@@ -1,10 +1,35 @@
 package server
 
 import (
+	jwtauth "chat-app/internal/Authentication"
+	"chat-app/internal/Authentication/password"
+	model "chat-app/internal/Models"
+	"chat-app/internal/database"
+	"chat-app/internal/database/databasetest"
+	"chat-app/internal/logging"
+	"chat-app/internal/mailer"
+	"chat-app/internal/pubsub"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func TestHandler(t *testing.T) {
@@ -29,3 +54,803 @@ func TestHandler(t *testing.T) {
 		t.Errorf("expected response body to be %v; got %v", expected, string(body))
 	}
 }
+
+type captureMailer struct {
+	messages []mailer.Message
+}
+
+func (m *captureMailer) Send(ctx context.Context, message mailer.Message) error {
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func newTestServer(t *testing.T) (*Server, *captureMailer) {
+	t.Helper()
+	db, err := database.Open("memory", logging.Discard())
+	if err != nil {
+		t.Fatalf("Open(memory) returned error: %v", err)
+	}
+	params := password.DefaultParams()
+	params.Argon2Memory = 1024
+	passwords, err := password.NewHasher(params)
+	if err != nil {
+		t.Fatalf("NewHasher() returned error: %v", err)
+	}
+	mail := &captureMailer{}
+	bus := pubsub.NewLocal()
+	hub, err := NewHub(db.GetContacts, bus, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewHub() returned error: %v", err)
+	}
+	go hub.Run()
+	tracerProvider := noop.NewTracerProvider()
+	return &Server{logger: logging.Discard(), db: db, passwords: passwords, mailer: mail, baseURL: "http://chat.test", hub: hub, bus: bus,
+		metrics: newMetrics(hub, db), tracerProvider: tracerProvider, tracer: tracerProvider.Tracer(instrumentationName)}, mail
+}
+
+func TestRegisterAndVerify(t *testing.T) {
+	s, mail := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	login := func() int {
+		resp, err := http.Post(server.URL+"/login", "application/json",
+			strings.NewReader(`{"UserName":"newuser","Password":"long-enough"}`))
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	resp, err := http.Post(server.URL+"/register", "application/json",
+		strings.NewReader(`{"username":"newuser","password":"long-enough","name":"New User","email":"new@example.com"}`))
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status Created; got %v", resp.Status)
+	}
+
+	if status := login(); status != http.StatusForbidden {
+		t.Fatalf("expected unverified login to be Forbidden; got %d", status)
+	}
+
+	if len(mail.messages) != 1 {
+		t.Fatalf("expected one verification email, got %d", len(mail.messages))
+	}
+	link := regexp.MustCompile(`http://chat\.test(/verify\?token=\S+)`).FindStringSubmatch(mail.messages[0].Body)
+	if link == nil {
+		t.Fatalf("verification email does not contain a link: %q", mail.messages[0].Body)
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusBadRequest} {
+		resp, err := http.Get(server.URL + link[1])
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("verify attempt %d: expected status %d; got %v", i+1, want, resp.Status)
+		}
+	}
+
+	if status := login(); status != http.StatusOK {
+		t.Fatalf("expected verified login to succeed; got %d", status)
+	}
+}
+
+func TestRegisterRejectsInvalidInput(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	bodies := []string{
+		`{"username":"","password":"long-enough","email":"a@example.com"}`,
+		`{"username":"short","password":"short","email":"a@example.com"}`,
+		`{"username":"bademail","password":"long-enough","email":"not-an-email"}`,
+	}
+	for _, body := range bodies {
+		resp, err := http.Post(server.URL+"/register", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected with Bad Request; got %v", body, resp.Status)
+		}
+	}
+}
+
+// lookupFailingDB answers every username lookup with err, as a lookup that
+// races a concurrent registration or loses the database connection would.
+type lookupFailingDB struct {
+	database.Service
+	err error
+}
+
+func (db *lookupFailingDB) WithContext(ctx context.Context) database.Service { return db }
+
+func (db *lookupFailingDB) GetUserByUserName(userName string) (model.User, error) {
+	return model.User{}, db.err
+}
+
+func TestRegisterUsernameChecks(t *testing.T) {
+	cases := []struct {
+		name      string
+		lookupErr error
+		want      int
+	}{
+		// The check found the name free but a concurrent registration
+		// inserted it first.
+		{"lost race", sql.ErrNoRows, http.StatusConflict},
+		{"lookup failure", errors.New("connection refused"), http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, mail := newTestServer(t)
+			existing := databasetest.CreateUser(t, s.db)
+			s.db = &lookupFailingDB{Service: s.db, err: tc.lookupErr}
+			server := httptest.NewServer(s.RegisterRoutes())
+			defer server.Close()
+
+			resp, err := http.Post(server.URL+"/register", "application/json",
+				strings.NewReader(`{"username":"`+existing.UserName+`","password":"long-enough","email":"taken@example.com"}`))
+			if err != nil {
+				t.Fatalf("error making request to server. Err: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Fatalf("expected status %d; got %v: %s", tc.want, resp.Status, body)
+			}
+			if tc.want == http.StatusConflict && string(body) != "username is already taken" {
+				t.Errorf("expected the conflict to be explained; got %q", body)
+			}
+			if len(mail.messages) != 0 {
+				t.Errorf("expected no verification email, got %d", len(mail.messages))
+			}
+		})
+	}
+}
+
+// authHeader logs in as user and returns the Authorization header value.
+func authHeader(t *testing.T, user model.User) string {
+	t.Helper()
+	tokenPair, err := jwtauth.CreateToken(user.Id, user.Role)
+	if err != nil {
+		t.Fatalf("CreateToken() returned error: %v", err)
+	}
+	return "Bearer " + tokenPair["access_token"]
+}
+
+// doAs sends an authenticated request as user and returns the status code.
+func doAs(t *testing.T, user model.User, method string, url string, body string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", authHeader(t, user))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRoutesRequireAuthentication(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/users")
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status Unauthorized; got %v", resp.Status)
+	}
+
+	// Refresh tokens must not be accepted as access tokens.
+	tokenPair, err := jwtauth.CreateToken("1")
+	if err != nil {
+		t.Fatalf("CreateToken() returned error: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/users", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenPair["refresh_token"])
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a refresh token to be rejected; got %v", resp.Status)
+	}
+}
+
+func TestCreateMessageUsesAuthenticatedSender(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+
+	body := `{"Sender_Id":"` + bob.Id + `","Receiver_Id":"` + bob.Id + `","Content":"spoofed"}`
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/message", strings.NewReader(body))
+	req.Header.Set("Authorization", authHeader(t, alice))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+
+	messages, err := s.db.GetMessagesforIndividualChat(map[string]string{"sender_id": alice.Id, "receiver_id": bob.Id}, model.MessagePage{})
+	if err != nil {
+		t.Fatalf("GetMessagesforIndividualChat() returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Sender_Id != alice.Id {
+		t.Fatalf("expected one message sent by %s, got %+v", alice.Id, messages)
+	}
+}
+
+func TestAccountChangesRequireOwnerOrAdmin(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+	admin := databasetest.CreateUser(t, s.db)
+	if err := s.db.SetUserRole(admin.Id, model.RoleAdmin); err != nil {
+		t.Fatalf("SetUserRole() returned error: %v", err)
+	}
+	admin.Role = model.RoleAdmin
+
+	if code := doAs(t, alice, http.MethodDelete, server.URL+"/user/"+bob.Id, ""); code != http.StatusForbidden {
+		t.Fatalf("expected deleting another user to be forbidden; got %d", code)
+	}
+	if code := doAs(t, alice, http.MethodPut, server.URL+"/user/"+bob.Id+"/password", `{"password":"hijacked!"}`); code != http.StatusForbidden {
+		t.Fatalf("expected changing another user's password to be forbidden; got %d", code)
+	}
+	if code := doAs(t, alice, http.MethodDelete, server.URL+"/refresh_token/invalid", ""); code != http.StatusForbidden {
+		t.Fatalf("expected admin endpoints to be forbidden for users; got %d", code)
+	}
+	if code := doAs(t, alice, http.MethodPut, server.URL+"/user/"+alice.Id+"/role", `{"role":"admin"}`); code != http.StatusForbidden {
+		t.Fatalf("expected users not to be able to promote themselves; got %d", code)
+	}
+
+	if code := doAs(t, alice, http.MethodPut, server.URL+"/user/"+alice.Id, `{"Name":"Alice"}`); code != http.StatusOK {
+		t.Fatalf("expected users to update their own account; got %d", code)
+	}
+	if code := doAs(t, admin, http.MethodPut, server.URL+"/user/"+bob.Id+"/role", `{"role":"admin"}`); code != http.StatusOK {
+		t.Fatalf("expected admins to change roles; got %d", code)
+	}
+	if code := doAs(t, admin, http.MethodDelete, server.URL+"/user/"+alice.Id, ""); code != http.StatusOK {
+		t.Fatalf("expected admins to delete any user; got %d", code)
+	}
+	if _, err := s.db.GetAUserv2(alice.Id); err == nil {
+		t.Fatalf("expected %s to be deleted", alice.Id)
+	}
+}
+
+func TestDeleteChatRoomRequiresOwnerOrAdmin(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	owner := databasetest.CreateUser(t, s.db)
+	other := databasetest.CreateUser(t, s.db)
+	admin := databasetest.CreateUser(t, s.db)
+	admin.Role = model.RoleAdmin
+
+	if code := doAs(t, owner, http.MethodPost, server.URL+"/chatroom", `{"Name":"general"}`); code != http.StatusOK {
+		t.Fatalf("expected chat room to be created; got %d", code)
+	}
+	rooms, err := s.db.GetAllChatRoom()
+	if err != nil || len(rooms) != 1 {
+		t.Fatalf("GetAllChatRoom() = %+v, %v", rooms, err)
+	}
+	if rooms[0].OwnerId != owner.Id {
+		t.Fatalf("expected the creator %s to own the room, got %q", owner.Id, rooms[0].OwnerId)
+	}
+	roomURL := server.URL + "/chatroom/" + rooms[0].ChatRoomId
+
+	if code := doAs(t, other, http.MethodDelete, roomURL, ""); code != http.StatusForbidden {
+		t.Fatalf("expected non-owners to be forbidden; got %d", code)
+	}
+	if code := doAs(t, owner, http.MethodDelete, roomURL, ""); code != http.StatusOK {
+		t.Fatalf("expected the owner to delete the room; got %d", code)
+	}
+
+	secondId := databasetest.CreateOwnedChatRoom(t, s.db, owner.Id)
+	if code := doAs(t, admin, http.MethodDelete, server.URL+"/chatroom/"+secondId, ""); code != http.StatusOK {
+		t.Fatalf("expected admins to delete any room; got %d", code)
+	}
+}
+
+func TestRoomMembership(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	owner := databasetest.CreateUser(t, s.db)
+	guest := databasetest.CreateUser(t, s.db)
+	outsider := databasetest.CreateUser(t, s.db)
+
+	response, err := s.db.CreateChatRoom(model.ChatRoom{Name: "secret", OwnerId: owner.Id, IsPrivate: true})
+	if err != nil {
+		t.Fatalf("CreateChatRoom() returned error: %v", err)
+	}
+	roomId := response[strings.LastIndex(response, " ")+1:]
+	roomURL := server.URL + "/chatroom/" + roomId
+
+	if code := doAs(t, guest, http.MethodPost, roomURL+"/join", ""); code != http.StatusForbidden {
+		t.Fatalf("expected joining a private room to be forbidden; got %d", code)
+	}
+	if code := doAs(t, guest, http.MethodGet, roomURL, ""); code != http.StatusNotFound {
+		t.Fatalf("expected private rooms to be hidden from non-members; got %d", code)
+	}
+	if code := doAs(t, guest, http.MethodPost, roomURL+"/invite", `{"user_id":"`+outsider.Id+`"}`); code != http.StatusForbidden {
+		t.Fatalf("expected non-members not to invite; got %d", code)
+	}
+	if code := doAs(t, owner, http.MethodPost, roomURL+"/invite", `{"user_id":"`+guest.Id+`"}`); code != http.StatusOK {
+		t.Fatalf("expected the owner to invite; got %d", code)
+	}
+	if code := doAs(t, owner, http.MethodPost, roomURL+"/invite", `{"user_id":"`+guest.Id+`"}`); code != http.StatusConflict {
+		t.Fatalf("expected inviting a member twice to conflict; got %d", code)
+	}
+
+	message := `{"ChatRoomId":"` + roomId + `","Content":"hello"}`
+	if code := doAs(t, guest, http.MethodPost, server.URL+"/message", message); code != http.StatusCreated {
+		t.Fatalf("expected members to post; got %d", code)
+	}
+	if code := doAs(t, outsider, http.MethodPost, server.URL+"/message", message); code != http.StatusForbidden {
+		t.Fatalf("expected non-members not to post; got %d", code)
+	}
+	if code := doAs(t, guest, http.MethodGet, server.URL+"/messages/"+roomId, ""); code != http.StatusOK {
+		t.Fatalf("expected members to read messages; got %d", code)
+	}
+	if code := doAs(t, outsider, http.MethodGet, server.URL+"/messages/"+roomId, ""); code != http.StatusForbidden {
+		t.Fatalf("expected non-members not to read messages; got %d", code)
+	}
+
+	members, err := s.db.GetRoomMembers(roomId)
+	if err != nil || len(members) != 2 {
+		t.Fatalf("GetRoomMembers() = %+v, %v; want owner and guest", members, err)
+	}
+	if code := doAs(t, owner, http.MethodPost, roomURL+"/leave", ""); code != http.StatusConflict {
+		t.Fatalf("expected the owner not to leave; got %d", code)
+	}
+	if code := doAs(t, guest, http.MethodPost, roomURL+"/leave", ""); code != http.StatusOK {
+		t.Fatalf("expected members to leave; got %d", code)
+	}
+	if code := doAs(t, guest, http.MethodGet, roomURL+"/members", ""); code != http.StatusForbidden {
+		t.Fatalf("expected former members not to list members; got %d", code)
+	}
+
+	publicId := databasetest.CreateOwnedChatRoom(t, s.db, owner.Id)
+	if code := doAs(t, outsider, http.MethodPost, server.URL+"/chatroom/"+publicId+"/join", ""); code != http.StatusOK {
+		t.Fatalf("expected anyone to join a public room; got %d", code)
+	}
+	if code := doAs(t, outsider, http.MethodGet, server.URL+"/chatroom/"+publicId+"/members", ""); code != http.StatusOK {
+		t.Fatalf("expected members to list members; got %d", code)
+	}
+}
+
+func TestMessageHistoryIsPaginated(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		created, err := s.db.CreateMessage(model.Message{Sender_Id: bob.Id, Receiver_Id: alice.Id, Content: "hello"})
+		if err != nil {
+			t.Fatalf("CreateMessage() returned error: %v", err)
+		}
+		ids = append(ids, created.MessageId)
+	}
+
+	get := func(query string) (int, messagePageResponse) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/messages/direct/"+bob.Id+query, nil)
+		req.Header.Set("Authorization", authHeader(t, alice))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		defer resp.Body.Close()
+		var page messagePageResponse
+		json.NewDecoder(resp.Body).Decode(&page)
+		return resp.StatusCode, page
+	}
+	idsOf := func(page messagePageResponse) string {
+		var got []string
+		for _, message := range page.Messages {
+			got = append(got, message.MessageId)
+		}
+		return strings.Join(got, ",")
+	}
+
+	// Walk backwards from the newest page.
+	code, page := get("?limit=2")
+	if code != http.StatusOK || idsOf(page) != ids[3]+","+ids[4] || page.NextCursor != ids[3] {
+		t.Fatalf("newest page = %d %+v", code, page)
+	}
+	_, page = get("?limit=2&before=" + page.NextCursor)
+	if idsOf(page) != ids[1]+","+ids[2] || page.NextCursor != ids[1] {
+		t.Fatalf("second page = %+v", page)
+	}
+	_, page = get("?limit=2&before=" + page.NextCursor)
+	if idsOf(page) != ids[0] || page.NextCursor != "" {
+		t.Fatalf("last page = %+v", page)
+	}
+
+	// Walk forwards, newest first within each page.
+	_, page = get("?limit=3&after=" + ids[0] + "&order=newest")
+	if idsOf(page) != ids[3]+","+ids[2]+","+ids[1] || page.NextCursor != ids[3] {
+		t.Fatalf("forward page = %+v", page)
+	}
+	_, page = get("?limit=3&order=newest&after=" + page.NextCursor)
+	if idsOf(page) != ids[4] || page.NextCursor != "" {
+		t.Fatalf("last forward page = %+v", page)
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=1000", "?before=abc", "?after=-1", "?order=random"} {
+		if code, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected with Bad Request; got %d", query, code)
+		}
+	}
+}
+
+func TestSearchMessagesIsScopedToReadableMessages(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	owner := databasetest.CreateUser(t, s.db)
+	outsider := databasetest.CreateUser(t, s.db)
+	admin := databasetest.CreateUser(t, s.db)
+	if err := s.db.SetUserRole(admin.Id, model.RoleAdmin); err != nil {
+		t.Fatalf("SetUserRole() returned error: %v", err)
+	}
+	admin.Role = model.RoleAdmin
+
+	response, err := s.db.CreateChatRoom(model.ChatRoom{Name: "secret", OwnerId: owner.Id, IsPrivate: true})
+	if err != nil {
+		t.Fatalf("CreateChatRoom() returned error: %v", err)
+	}
+	roomId := response[strings.LastIndex(response, " ")+1:]
+	if _, err := s.db.CreateMessage(model.Message{ChatRoomId: roomId, Sender_Id: owner.Id, Content: "The launch is on Friday"}); err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+	if _, err := s.db.CreateMessage(model.Message{Sender_Id: owner.Id, Receiver_Id: outsider.Id, Content: "Launch party?"}); err != nil {
+		t.Fatalf("CreateMessage() returned error: %v", err)
+	}
+
+	search := func(user model.User, query string) (int, []model.MessageSearchResult) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/search/messages"+query, nil)
+		req.Header.Set("Authorization", authHeader(t, user))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		defer resp.Body.Close()
+		var results []model.MessageSearchResult
+		json.NewDecoder(resp.Body).Decode(&results)
+		return resp.StatusCode, results
+	}
+
+	code, results := search(owner, "?q=launch")
+	if code != http.StatusOK || len(results) != 2 {
+		t.Fatalf("owner search = %d %+v, want both messages", code, results)
+	}
+	if results[1].Snippet != "The <mark>launch</mark> is on Friday" {
+		t.Errorf("unexpected snippet %q", results[1].Snippet)
+	}
+	if _, results := search(outsider, "?q=launch"); len(results) != 1 || results[0].Message.Receiver_Id != outsider.Id {
+		t.Errorf("expected outsiders to find only their direct message; got %+v", results)
+	}
+	if _, results := search(admin, "?q=launch+friday"); len(results) != 1 || results[0].Message.ChatRoomId != roomId {
+		t.Errorf("expected admins to search every room; got %+v", results)
+	}
+	if _, results := search(owner, "?q=launch&room="+roomId+"&from=2000-01-01&to=2999-12-31"); len(results) != 1 {
+		t.Errorf("expected filters to keep the room message; got %+v", results)
+	}
+
+	for _, query := range []string{"", "?q=", "?q=%21%21", "?q=launch&limit=0", "?q=launch&from=yesterday", "?q=launch&to=2024-13-01"} {
+		if code, _ := search(owner, query); code != http.StatusBadRequest {
+			t.Errorf("expected %q to be rejected with Bad Request; got %d", query, code)
+		}
+	}
+}
+
+// logBuffer collects log output written by concurrent handlers.
+type logBuffer struct {
+	mu  sync.Mutex
+	out strings.Builder
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.out.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.out.String()
+}
+
+func TestRequestsAreLoggedWithIdsAndWithoutSecrets(t *testing.T) {
+	s, _ := newTestServer(t)
+	logs := &logBuffer{}
+	logger, err := logging.New(logs, "json", nil)
+	if err != nil {
+		t.Fatalf("New() returned error: %v", err)
+	}
+	s.logger = logger
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	user := databasetest.CreateUser(t, s.db)
+	resp, err := http.Post(server.URL+"/login", "application/json",
+		strings.NewReader(`{"UserName":"`+user.UserName+`","Password":"secret"}`))
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	var tokenPair map[string]string
+	json.NewDecoder(resp.Body).Decode(&tokenPair)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || tokenPair["access_token"] == "" {
+		t.Fatalf("login: expected 200 with tokens, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/me/unread", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenPair["access_token"])
+	req.Header.Set(requestIdHeader, "client-42")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(requestIdHeader); got != "client-42" {
+		t.Errorf("expected the request id to be echoed, got %q", got)
+	}
+
+	var served map[string]interface{}
+	waitFor(t, "the request to be logged", func() bool {
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var record map[string]interface{}
+			if json.Unmarshal([]byte(line), &record) == nil && record["request_id"] == "client-42" {
+				served = record
+				return true
+			}
+		}
+		return false
+	})
+	if served["route"] != "/me/unread" || served["user_id"] != user.Id || served["status"] != float64(http.StatusOK) {
+		t.Errorf("unexpected request record %v", served)
+	}
+	for _, secret := range []string{tokenPair["access_token"], tokenPair["refresh_token"], `"secret"`} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("logs leak %q:\n%s", secret, logs.String())
+		}
+	}
+}
+
+func TestMetricsCoverRequestsSocketsAndMessages(t *testing.T) {
+	s, _ := newTestServer(t)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	bob := databasetest.CreateUser(t, s.db)
+	if status := doAs(t, alice, "GET", server.URL+"/me/unread", ""); status != http.StatusOK {
+		t.Fatalf("GET /me/unread: expected 200, got %d", status)
+	}
+	aliceConn := dialAs(t, server, alice)
+	bobConn := dialAs(t, server, bob)
+	send(t, aliceConn, typeMessageSend, "client-1", model.Message{Receiver_Id: bob.Id, Content: "hi bob"})
+	if _, ok := receive(t, bobConn, typeMessageNew, time.Second); !ok {
+		t.Fatal("expected bob to receive the message")
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{
+		`chat_http_requests_total{code="200",method="GET",route="/me/unread"} 1`,
+		`chat_http_request_duration_seconds_count{method="GET",route="/me/unread"} 1`,
+		`chat_websocket_connections 2`,
+		`chat_messages_sent_total 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected %q in metrics:\n%s", line, body)
+		}
+	}
+	// Sockets are only counted once they close.
+	if strings.Contains(string(body), `route="/ws"`) {
+		t.Errorf("expected open sockets to be left out of the request metrics:\n%s", body)
+	}
+	if !regexp.MustCompile(`(?m)^chat_hub_deliveries_total [1-9]`).Match(body) ||
+		!regexp.MustCompile(`(?m)^chat_hub_queue_depth\{queue="sockets"\} \d+$`).Match(body) {
+		t.Errorf("expected deliveries and queue depth to be reported:\n%s", body)
+	}
+	if strings.Contains(string(body), "chat_db_") {
+		t.Error("the memory driver has no connection pool to report")
+	}
+}
+
+type fakePool struct{ stats sql.DBStats }
+
+func (p fakePool) Stats() sql.DBStats { return p.stats }
+
+func TestPoolCollectorExportsDBStats(t *testing.T) {
+	pool := fakePool{sql.DBStats{MaxOpenConnections: 50, OpenConnections: 3, InUse: 1, Idle: 2, WaitCount: 4, MaxLifetimeClosed: 5}}
+	expected := `
+# HELP chat_db_in_use_connections Connections currently in use.
+# TYPE chat_db_in_use_connections gauge
+chat_db_in_use_connections 1
+# HELP chat_db_waits_total Times a query waited for a free connection.
+# TYPE chat_db_waits_total counter
+chat_db_waits_total 4
+`
+	err := testutil.CollectAndCompare(poolCollector{pool}, strings.NewReader(expected),
+		"chat_db_in_use_connections", "chat_db_waits_total")
+	if err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(poolCollector{pool}, "chat_db_closed_connections_total"); n != 3 {
+		t.Errorf("expected 3 closed connection series, got %d", n)
+	}
+}
+
+// traceTo makes s record its spans in a new recorder, which it returns.
+func traceTo(t *testing.T, s *Server) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s.tracerProvider = provider
+	s.tracer = provider.Tracer(instrumentationName)
+	s.db = database.Traced(s.db, "memory", provider)
+
+	propagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(propagator) })
+	return recorder
+}
+
+// findSpan returns the first ended span called name whose attributes
+// include attrs.
+func findSpan(recorder *tracetest.SpanRecorder, name string, attrs ...attribute.KeyValue) (sdktrace.ReadOnlySpan, bool) {
+	for _, span := range recorder.Ended() {
+		if span.Name() != name {
+			continue
+		}
+		matched := 0
+		for _, want := range attrs {
+			for _, kv := range span.Attributes() {
+				if kv == want {
+					matched++
+				}
+			}
+		}
+		if matched == len(attrs) {
+			return span, true
+		}
+	}
+	return nil, false
+}
+
+func TestRequestsFramesAndQueriesAreTraced(t *testing.T) {
+	first, _ := newTestServer(t)
+	recorder := traceTo(t, first)
+	second := newReplica(t, first)
+	firstServer := httptest.NewServer(first.RegisterRoutes())
+	defer firstServer.Close()
+	secondServer := httptest.NewServer(second.RegisterRoutes())
+	defer secondServer.Close()
+
+	alice := databasetest.CreateUser(t, first.db)
+	bob := databasetest.CreateUser(t, first.db)
+
+	if status := doAs(t, alice, "GET", firstServer.URL+"/me/unread", ""); status != http.StatusOK {
+		t.Fatalf("GET /me/unread: expected 200, got %d", status)
+	}
+	var request sdktrace.ReadOnlySpan
+	waitFor(t, "the request span", func() (ok bool) {
+		request, ok = findSpan(recorder, "/me/unread")
+		return ok
+	})
+	if request.SpanKind() != trace.SpanKindServer {
+		t.Errorf("expected a server span for the request, got %v", request.SpanKind())
+	}
+	query, ok := findSpan(recorder, "database.GetUnreadCounts", attribute.String("db.system", "memory"))
+	if !ok || query.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("expected the request to trace its query, got %v", query)
+	}
+
+	// A message sent to one replica is traced into its delivery on the other.
+	bobConn := dialAs(t, secondServer, bob)
+	waitFor(t, "bob to connect", func() bool { return second.hub.connections(bob.Id) == 1 })
+	aliceConn := dialAs(t, firstServer, alice)
+	send(t, aliceConn, typeMessageSend, "client-1", model.Message{Receiver_Id: bob.Id, Content: "hi bob"})
+	if _, ok := receive(t, bobConn, typeMessageNew, 2*time.Second); !ok {
+		t.Fatal("expected bob to receive the message")
+	}
+
+	var received, sent sdktrace.ReadOnlySpan
+	waitFor(t, "the frame spans", func() bool {
+		received, ok = findSpan(recorder, "websocket.receive",
+			attribute.String("websocket.message.type", typeMessageSend),
+			attribute.String("websocket.message.id", "client-1"),
+			attribute.String("enduser.id", alice.Id))
+		if !ok {
+			return false
+		}
+		sent, ok = findSpan(recorder, "websocket.send",
+			attribute.String("websocket.message.type", typeMessageNew),
+			attribute.String("enduser.id", bob.Id))
+		return ok
+	})
+	if received.SpanContext().TraceID() != sent.SpanContext().TraceID() {
+		t.Errorf("expected bob's delivery to be part of the trace of alice's frame")
+	}
+	if len(received.Links()) != 1 {
+		t.Errorf("expected the frame to link to the request that opened the socket, got %v", received.Links())
+	}
+	insert, ok := findSpan(recorder, "database.CreateMessage")
+	if !ok || insert.Parent().SpanID() != received.SpanContext().SpanID() {
+		t.Errorf("expected the frame to trace its insert, got %v", insert)
+	}
+}
+
+func TestPasswordChangesStayOutOfTraces(t *testing.T) {
+	s, _ := newTestServer(t)
+	recorder := traceTo(t, s)
+	server := httptest.NewServer(s.RegisterRoutes())
+	defer server.Close()
+
+	alice := databasetest.CreateUser(t, s.db)
+	if code := doAs(t, alice, http.MethodPut, server.URL+"/user/"+alice.Id+"/password", `{"password":"short"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected a short password to be rejected; got %d", code)
+	}
+	if code := doAs(t, alice, http.MethodPut, server.URL+"/user/"+alice.Id+"/password", `{"password":"correct horse"}`); code != http.StatusOK {
+		t.Fatalf("expected users to change their own password; got %d", code)
+	}
+	resp, err := http.Post(server.URL+"/login", "application/json",
+		strings.NewReader(`{"UserName":"`+alice.UserName+`","Password":"correct horse"}`))
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the new password to log in; got %d", resp.StatusCode)
+	}
+
+	var spans []sdktrace.ReadOnlySpan
+	waitFor(t, "the request spans", func() bool {
+		spans = nil
+		for _, span := range recorder.Ended() {
+			if span.Name() == "/user/{id}/password" {
+				spans = append(spans, span)
+			}
+		}
+		return len(spans) == 2
+	})
+	for _, span := range spans {
+		for _, kv := range span.Attributes() {
+			if strings.Contains(kv.Value.Emit(), "correct horse") || strings.Contains(kv.Value.Emit(), "short") {
+				t.Errorf("span attribute %s leaks the password: %s", kv.Key, kv.Value.Emit())
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	model "chat-app/internal/Models"
+	"chat-app/internal/database"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSearchResults = 20
+	maxSearchResults     = 100
+)
+
+// searchMessages searches the rooms and direct conversations the caller can
+// read. Admins search every room.
+func (s *Server) searchMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	principal := principalFrom(r)
+
+	search, err := messageSearchFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	search.UserId = principal.UserId
+	search.AllRooms = principal.HasRole(model.RoleAdmin)
+
+	results, err := s.db.WithContext(r.Context()).SearchMessages(search)
+	if err == database.ErrNoSearchTerms {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// messageSearchFrom reads the q, sender, room, from, to and limit query
+// parameters of r.
+func messageSearchFrom(r *http.Request) (model.MessageSearch, error) {
+	query := r.URL.Query()
+	search := model.MessageSearch{
+		Query:      query.Get("q"),
+		SenderId:   query.Get("sender"),
+		ChatRoomId: query.Get("room"),
+		Limit:      defaultSearchResults,
+	}
+	if search.Query == "" {
+		return search, fmt.Errorf("q is required")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxSearchResults {
+			return search, fmt.Errorf("limit must be between 1 and %d", maxSearchResults)
+		}
+		search.Limit = n
+	}
+
+	var err error
+	if search.From, err = searchTime(query.Get("from"), false); err != nil {
+		return search, fmt.Errorf("from %v", err)
+	}
+	if search.To, err = searchTime(query.Get("to"), true); err != nil {
+		return search, fmt.Errorf("to %v", err)
+	}
+	return search, nil
+}
+
+// searchTime parses an RFC 3339 time or a date. A date used as the end of a
+// range includes the whole day.
+func searchTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be a date (2006-01-02) or an RFC 3339 time")
+	}
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
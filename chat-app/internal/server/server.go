@@ -1,39 +1,180 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 
+	jwtauth "chat-app/internal/Authentication"
+	"chat-app/internal/Authentication/password"
 	"chat-app/internal/database"
+	"chat-app/internal/mailer"
+	"chat-app/internal/pubsub"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Server struct {
 	port int
 
+	logger *slog.Logger
+	// tracerProvider creates the spans of requests, WebSocket frames and
+	// database calls.
+	tracerProvider trace.TracerProvider
+	tracer         trace.Tracer
+
 	db database.Service
+
+	passwords *password.Hasher
+
+	mailer mailer.Mailer
+	// baseURL is the public address used in links sent by email.
+	baseURL string
+
+	hub *Hub
+	// bus carries the hub's deliveries between replicas.
+	bus pubsub.PubSub
+
+	metrics *metrics
+
+	// http serves the routes. It is nil in tests, which use httptest.
+	http *http.Server
+	// sockets tracks the WebSocket handlers, which http.Server stops
+	// tracking once they hijack their connection.
+	sockets sync.WaitGroup
 }
 
-func NewServer() *http.Server {
+// NewServer configures the chat server from the environment. The server,
+// its hub and its database log to logger and are traced by tracerProvider.
+func NewServer(logger *slog.Logger, tracerProvider trace.TracerProvider) *Server {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
+
+	// fatal reports a configuration error and terminates the program.
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "error", err)
+		os.Exit(1)
+	}
+
+	passwordParams, err := password.ParamsFromEnv()
+	if err != nil {
+		fatal("Invalid password hashing configuration", err)
+	}
+	passwords, err := password.NewHasher(passwordParams)
+	if err != nil {
+		fatal("Invalid password hashing configuration", err)
+	}
+
+	// Fail fast on a bad key configuration instead of on the first login.
+	if _, err := jwtauth.DefaultKeyring(); err != nil {
+		fatal("Invalid JWT key configuration", err)
+	}
+
+	mail, err := mailer.FromEnv()
+	if err != nil {
+		fatal("Invalid mailer configuration", err)
+	}
+	baseURL := os.Getenv("APP_BASE_URL")
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("http://localhost:%d", port)
+	}
+
+	bus, err := pubsub.FromEnv()
+	if err != nil {
+		fatal("Invalid pubsub configuration", err)
+	}
+	db := database.New(logger)
+	hub, err := NewHub(db.GetContacts, bus, logger)
+	if err != nil {
+		fatal("Cannot subscribe to the pubsub bus", err)
+	}
+	go hub.Run()
+
 	NewServer := &Server{
 		port: port,
 
-		db: database.New(),
+		logger:         logger,
+		tracerProvider: tracerProvider,
+		tracer:         tracerProvider.Tracer(instrumentationName),
+
+		db: database.Traced(db, database.DriverName(), tracerProvider),
+
+		passwords: passwords,
+
+		mailer:  mail,
+		baseURL: baseURL,
+
+		hub: hub,
+		bus: bus,
+
+		metrics: newMetrics(hub, db),
 	}
 
 	// Declare Server config
-	server := &http.Server{
+	NewServer.http = &http.Server{
 		Addr:         fmt.Sprintf(":%d", NewServer.port),
 		Handler:      NewServer.RegisterRoutes(),
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
 
-	return server
+	return NewServer
+}
+
+// ListenAndServe serves HTTP and WebSocket requests until Shutdown is
+// called, when it returns http.ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	return s.http.ListenAndServe()
+}
+
+// Shutdown stops accepting connections and closes every WebSocket with a
+// going away frame once its queued updates are written. It then waits for
+// in-flight requests and WebSocket handlers to finish, stops the hub once it
+// published its last events, and closes the bus and finally the database.
+// If ctx is done first, Shutdown closes them anyway and returns ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) error {
+	// http.Server.Shutdown closes the listeners at once but does not track
+	// hijacked connections, so the hub drains the WebSockets meanwhile.
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.http.Shutdown(ctx) }()
+	s.hub.shutdown(ctx)
+	err := <-stopped
+
+	// The WebSocket handlers record the disconnections in the database.
+	if waitErr := waitGroup(ctx, &s.sockets); err == nil {
+		err = waitErr
+	}
+	if stopErr := s.hub.stop(ctx); err == nil {
+		err = stopErr
+	}
+	if closeErr := s.bus.Close(); closeErr != nil {
+		s.logger.Error("Error closing the pubsub bus", "error", closeErr)
+	}
+	if closeErr := s.db.Close(); closeErr != nil {
+		s.logger.Error("Error closing the database", "error", closeErr)
+	}
+	return err
+}
+
+// waitGroup waits for wg, or for ctx to be done.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
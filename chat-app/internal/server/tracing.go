@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of the WebSocket spans.
+const instrumentationName = "chat-app/internal/server"
+
+// tracedUpdate is an update queued for sockets together with the context of
+// the request or frame that caused it, so that writing it is traced as part
+// of the same trace.
+type tracedUpdate struct {
+	ctx    context.Context
+	update interface{}
+}
+
+// withTrace attaches the span of ctx, if any, to an update for the hub.
+func withTrace(ctx context.Context, v interface{}) interface{} {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return v
+	}
+	return tracedUpdate{ctx: ctx, update: v}
+}
+
+// untrace splits an update queued by the hub into its context and the
+// update itself.
+func untrace(v interface{}) (context.Context, interface{}) {
+	if traced, ok := v.(tracedUpdate); ok {
+		return traced.ctx, traced.update
+	}
+	return context.Background(), v
+}
+
+// frameTypeOf returns the type of a server frame, as an envelope or as the
+// JSON of one received from another replica.
+func frameTypeOf(v interface{}) string {
+	switch frame := v.(type) {
+	case envelope:
+		return frame.Type
+	case json.RawMessage:
+		var header struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(frame, &header)
+		return header.Type
+	}
+	return ""
+}
+
+// startFrame starts the span of a frame received on c. Sockets live for
+// long, so every frame starts a trace of its own, linked to the request that
+// opened the socket.
+func (s *Server) startFrame(ctx context.Context, c *client, frame envelope) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "websocket.receive",
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("websocket.message.type", frame.Type),
+			attribute.String("websocket.message.id", frame.Id),
+			attribute.String("enduser.id", c.userId),
+		))
+}
+
+// write writes an update to c's socket, traced as part of the event that
+// caused it, if known.
+func (c *client) write(v interface{}) error {
+	ctx, update := untrace(v)
+	_, span := c.tracer.Start(ctx, "websocket.send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("enduser.id", c.userId)))
+	defer span.End()
+	if span.IsRecording() {
+		span.SetAttributes(attribute.String("websocket.message.type", frameTypeOf(update)))
+	}
+
+	err := c.conn.WriteJSON(update)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// injectTrace records the trace of an update in an event for the bus.
+func injectTrace(e *busEvent, v interface{}) {
+	if traced, ok := v.(tracedUpdate); ok {
+		e.Trace = propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(traced.ctx, e.Trace)
+	}
+}
+
+// extractTrace returns the context of the trace recorded in an event of
+// another replica.
+func extractTrace(e busEvent) context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), e.Trace)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"time"
+)
+
+// typingTimeout is how long a typing indicator lasts without another
+// typing.start. Clients that keep typing repeat typing.start before then.
+var typingTimeout = 5 * time.Second
+
+const (
+	// typingBurst and typingRate limit the typing frames of one socket: up
+	// to typingBurst at once, refilled at typingRate per second.
+	typingBurst = 5
+	typingRate  = 1.0
+)
+
+// typingState is a typing indicator shown to the other participants of a
+// conversation. Owned by the hub goroutine.
+type typingState struct {
+	until  time.Time
+	expiry *time.Timer
+}
+
+// rateLimiter is a token bucket. It is not safe for concurrent use.
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is left.
+func (l *rateLimiter) allow(burst float64, rate float64) bool {
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// startTyping shows the other participants of a conversation that a user
+// is typing, until stopTyping is called or typingTimeout passes without
+// another startTyping. Only the first start is relayed.
+func (h *Hub) startTyping(typing typingPayload) {
+	h.run(func() {
+		if !h.isOnline(typing.UserId) {
+			return
+		}
+		state := h.typing[typing]
+		if state != nil {
+			state.until = time.Now().Add(typingTimeout)
+			state.expiry.Reset(typingTimeout)
+			return
+		}
+		state = &typingState{until: time.Now().Add(typingTimeout)}
+		state.expiry = time.AfterFunc(typingTimeout, func() {
+			h.run(func() {
+				// A start may have extended the indicator since the timer fired.
+				if h.typing[typing] == state && !time.Now().Before(state.until) {
+					h.endTyping(typing)
+				}
+			})
+		})
+		h.typing[typing] = state
+		h.relayTyping(typeTypingStart, typing)
+	})
+}
+
+// stopTyping ends a typing indicator, if it is shown.
+func (h *Hub) stopTyping(typing typingPayload) {
+	h.run(func() {
+		h.endTyping(typing)
+	})
+}
+
+func (h *Hub) isOnline(userId string) bool {
+	return len(h.users[userId]) > 0
+}
+
+// endTyping removes a typing indicator and relays typing.stop. Only called
+// on the hub goroutine.
+func (h *Hub) endTyping(typing typingPayload) {
+	state := h.typing[typing]
+	if state == nil {
+		return
+	}
+	state.expiry.Stop()
+	delete(h.typing, typing)
+	h.relayTyping(typeTypingStop, typing)
+}
+
+// endAllTyping ends every typing indicator of a user, for example once
+// their last socket closed. Only called on the hub goroutine.
+func (h *Hub) endAllTyping(userId string) {
+	for typing := range h.typing {
+		if typing.UserId == userId {
+			h.endTyping(typing)
+		}
+	}
+}
+
+// relayTyping sends a typing frame to the room's subscribers or to the
+// receiver, but never to the sockets of the typing user. Only called on the
+// hub goroutine.
+func (h *Hub) relayTyping(frameType string, typing typingPayload) {
+	update := newEnvelope(frameType, "", typing)
+	h.deliverTyping(typing, update)
+	h.share(busEvent{Kind: eventTyping, Typing: &typing}, update)
+}
+
+func (h *Hub) deliverTyping(typing typingPayload, v interface{}) {
+	if typing.ChatRoomId != "" {
+		for c := range h.rooms[typing.ChatRoomId] {
+			if c.userId != typing.UserId {
+				h.queue(c, v)
+			}
+		}
+		return
+	}
+	if typing.ReceiverId == typing.UserId {
+		return
+	}
+	for c := range h.users[typing.ReceiverId] {
+		h.queue(c, v)
+	}
+}
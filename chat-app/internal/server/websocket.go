@@ -2,8 +2,7 @@ package server
 
 import (
 	model "chat-app/internal/Models"
-	"fmt"
-	"log"
+	"context"
 	"net/http"
 
 	"github.com/gorilla/websocket"
@@ -15,55 +14,70 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-var clients = make(map[*websocket.Conn]bool)
-var broadcast = make(chan []model.Message)
-
-// func handleConnections(w http.ResponseWriter, r *http.Request) {
-// 	conn, err := upgrader.Upgrade(w, r, nil)
-// 	if err != nil {
-// 		fmt.Fprint(w, err)
-// 		return
-// 	}
-// 	defer conn.Close()
-// 	clients[conn] = true
-// 	for {
-// 		var message string
-// 		err := conn.ReadJSON(&message)
-// 		if err != nil {
-// 			fmt.Fprint(w, err)
-// 			delete(clients, conn)
-// 			break
-// 		}
-// 		fmt.Println("Message:", message)
-// 		broadcast <- message
-// 	}
-// }
-
-func HandleMessage() {
-	for {
-		messages := <-broadcast
+// publish pushes a new, edited or deleted message to the sockets that see
+// it as it happens. The origin socket, if any, already got an ack and is
+// skipped.
+//
+// Replies only reach the followers of their thread. The room's subscribers
+// get the parent message with its updated reply count instead. The sender
+// of a new direct message gets a delivery receipt if the receiver is online.
+// A new message also ends its sender's typing indicator. Writing the updates
+// is traced as part of ctx, the request or frame that made the change.
+func (s *Server) publish(ctx context.Context, frameType string, message model.Message, origin *client) {
+	update := newEnvelope(frameType, "", message)
+	if frameType == typeMessageNew {
+		s.metrics.messages.Inc()
+		defer s.hub.stopTyping(typingOf(message))
+	}
+	if frameType == typeMessageNew && message.ChatRoomId == "" {
+		s.hub.sendDirect(withTrace(ctx, update), origin, message.Sender_Id, message.Receiver_Id, withTrace(ctx, newEnvelope(typeReceipt, "", receiptPayload{
+			MessageId: message.MessageId,
+			UserId:    message.Receiver_Id,
+			Status:    receiptDelivered,
+		})))
+		return
+	}
+	s.deliver(ctx, message, update, origin)
+	if message.ParentMessageId == "" || frameType != typeMessageNew {
+		return
+	}
+	parent, err := s.db.WithContext(ctx).GetMessage(message.ParentMessageId)
+	if err != nil {
+		s.logger.Error("Error loading thread", "message_id", message.ParentMessageId, "error", err)
+		return
+	}
+	s.hub.sendToRoom(parent.ChatRoomId, withTrace(ctx, newEnvelope(typeThreadUpdated, "", parent)), nil)
+}
 
-		for client := range clients {
-			err := client.WriteJSON(&messages)
-			if err != nil {
-				fmt.Println("Err:", err)
-				client.Close()
-				delete(clients, client)
-			}
-		}
+// deliver sends an update about message to the followers of its thread, the
+// subscribers of its room, or both participants of a direct conversation.
+func (s *Server) deliver(ctx context.Context, message model.Message, update envelope, origin *client) {
+	v := withTrace(ctx, update)
+	switch {
+	case message.ParentMessageId != "":
+		s.hub.sendToThread(message.ParentMessageId, v, origin)
+	case message.ChatRoomId != "":
+		s.hub.sendToRoom(message.ChatRoomId, v, origin)
+	default:
+		s.hub.sendToUsers(v, origin, message.Sender_Id, message.Receiver_Id)
 	}
 }
 
-func (s *Server) sendChatHistory(message model.Message) error {
-	senderReceiver := make(map[string]string)
-	senderReceiver["sender_id"] = message.Sender_Id
-	senderReceiver["receiver_id"] = message.Receiver_Id
+// threadRoom fills in the chat room of a reply that only names its parent.
+// CreateMessage rejects replies whose parent is missing or elsewhere.
+func (s *Server) threadRoom(ctx context.Context, message *model.Message) {
+	if message.ParentMessageId == "" || message.ChatRoomId != "" || message.Receiver_Id != "" {
+		return
+	}
+	if parent, err := s.db.WithContext(ctx).GetMessage(message.ParentMessageId); err == nil {
+		message.ChatRoomId = parent.ChatRoomId
+	}
+}
 
-	messages, err := s.db.GetMessagesforIndividualChat(senderReceiver)
-	if err != nil {
-		log.Println("Error fetching chat history:", err)
-		return err
+// typingOf identifies the typing indicator of the sender of message.
+func typingOf(message model.Message) typingPayload {
+	if message.ChatRoomId != "" {
+		return typingPayload{UserId: message.Sender_Id, ChatRoomId: message.ChatRoomId}
 	}
-	broadcast <- messages
-	return nil
+	return typingPayload{UserId: message.Sender_Id, ReceiverId: message.Receiver_Id}
 }
@@ -0,0 +1,90 @@
+// Package tracing sets up OpenTelemetry tracing for the chat server. The
+// exporter is chosen with the OTEL_TRACES_EXPORTER environment variable.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// ServiceName names this service in traces unless OTEL_SERVICE_NAME is set.
+const ServiceName = "chat-app"
+
+// Provider creates tracers and flushes their spans on Shutdown.
+type Provider interface {
+	trace.TracerProvider
+	Shutdown(ctx context.Context) error
+}
+
+// FromEnv returns the Provider selected by OTEL_TRACES_EXPORTER:
+//
+//	none    (default) records nothing
+//	otlp    sends spans over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT
+//	        (default http://localhost:4318), configured with the standard
+//	        OTEL_EXPORTER_OTLP_* variables
+//	console writes spans to standard output, for local debugging
+//
+// Spans are sampled according to OTEL_TRACES_SAMPLER, all of them by
+// default.
+func FromEnv(ctx context.Context) (Provider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "", "none":
+		return noopProvider{}, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "console", "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", os.Getenv("OTEL_TRACES_EXPORTER"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(semconv.ServiceName(serviceName())))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// Install makes provider the global tracer provider used by the
+// instrumentation, and propagates W3C trace context and baggage.
+func Install(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// serviceName is OTEL_SERVICE_NAME, or ServiceName.
+func serviceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return ServiceName
+}
+
+type noopProvider struct {
+	noop.TracerProvider
+}
+
+func (noopProvider) Shutdown(ctx context.Context) error {
+	return nil
+}
@@ -1,22 +1,89 @@
 package main
 
 import (
+	"chat-app/internal/logging"
 	"chat-app/internal/server"
-	"fmt"
+	"chat-app/internal/tracing"
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// shutdownTimeout bounds how long a graceful shutdown waits for open
+// requests and WebSockets.
+const shutdownTimeout = 15 * time.Second
+
 func main() {
-	fmt.Println("START>>>>")
-	//database.PrintEnv()
-	go server.HandleMessage()
-	server := server.NewServer()
-	fmt.Println("Server is Listning on Port:", os.Getenv("PORT"))
-	err := server.ListenAndServe()
+	logger, err := logging.FromEnv()
 	if err != nil {
-		fmt.Println("error:", err)
-		panic(fmt.Sprintf("cannot start server: %s", err))
-		//log.Fatal(err)
+		log.Fatalf("invalid logging configuration: %v", err)
+	}
+	// Packages without an injected logger, and the standard log package,
+	// write through the same handler.
+	slog.SetDefault(logger)
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.Stdout); err != nil {
+			fatal(logger, "Migration failed", err)
+		}
+		return
 	}
-	fmt.Println("Server is Listning on Port:", os.Getenv("PORT"))
+	if len(os.Args) > 1 && os.Args[1] == "grant-admin" {
+		if err := runGrantAdmin(os.Args[2:], os.Stdout); err != nil {
+			fatal(logger, "Cannot grant admin role", err)
+		}
+		return
+	}
+
+	tracerProvider, err := tracing.FromEnv(context.Background())
+	if err != nil {
+		fatal(logger, "Invalid tracing configuration", err)
+	}
+	tracing.Install(tracerProvider)
+
+	server := server.NewServer(logger, tracerProvider)
+
+	// SIGINT and SIGTERM start a graceful shutdown; a second signal kills
+	// the process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	failed := make(chan error, 1)
+	go func() {
+		logger.Info("Server is listening", "port", os.Getenv("PORT"))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+	}()
+
+	select {
+	case err := <-failed:
+		fatal(logger, "Cannot start server", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	logger.Info("Shutting down, draining connections", "timeout", shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Error shutting down", "error", err)
+	}
+	// Flush the spans of the last requests.
+	if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Error flushing traces", "error", err)
+	}
+	logger.Info("Server stopped")
+}
+
+// fatal logs err and terminates the program.
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }